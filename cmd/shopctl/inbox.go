@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"shop/pkg/inbox"
+	"shop/pkg/tx"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func inboxCommand(db *sql.DB, command string, args []string) error {
+	switch command {
+	case "list":
+		f, err := parseFilter(args)
+		if err != nil {
+			return err
+		}
+		return inboxList(db, f)
+	case "show":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return inboxShow(db, args[0])
+	case "replay":
+		return replay(db, inbox.NewPostgresInbox(), args)
+	case "mark":
+		status, ids, err := parseMark(args)
+		if err != nil {
+			return err
+		}
+		return inboxMark(db, inbox.NewPostgresInbox(), inbox.MessageStatus(status), ids)
+	case "skip-gap":
+		if len(args) != 3 {
+			return errUsage
+		}
+		sequence, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || sequence < 1 {
+			return fmt.Errorf("invalid sequence %q", args[2])
+		}
+		return skipGap(db, inbox.NewPostgresInbox(), args[0], args[1], sequence)
+	default:
+		return errUsage
+	}
+}
+
+func inboxList(db *sql.DB, f filter) error {
+	where, args := f.where()
+	query := `SELECT message_id, status, topic, key, message_type, COALESCE(aggregate_id, ''), COALESCE(sequence, 0),
+		attempts, created_at, COALESCE(last_error, '') FROM inbox ` + where + ` ORDER BY created_at DESC LIMIT ` + strconv.Itoa(f.limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE ID\tSTATUS\tTOPIC\tKEY\tTYPE\tSEQUENCE\tATTEMPTS\tRECEIVED\tLAST ERROR")
+	for rows.Next() {
+		var m inbox.Message
+		err = rows.Scan(&m.MessageID, &m.Status, &m.Topic, &m.Key, &m.MessageType, &m.AggregateID, &m.Sequence, &m.Attempts, &m.CreatedAt, &m.LastError)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", m.MessageID, m.Status, m.Topic, m.Key, m.MessageType,
+			sequence(m.AggregateID, m.Sequence), m.Attempts, m.CreatedAt.Format(time.DateTime), shorten(m.LastError, 60))
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func inboxShow(db *sql.DB, id string) error {
+	query := `SELECT message_id, status, topic, key, message_type, COALESCE(aggregate_id, ''), COALESCE(sequence, 0), payload, headers,
+		attempts, created_at, COALESCE(last_error, ''), next_attempt_at FROM inbox WHERE message_id = $1`
+	var m inbox.Message
+	var payload, headers []byte
+	var nextAttemptAt sql.NullTime
+	err := db.QueryRow(query, id).Scan(&m.MessageID, &m.Status, &m.Topic, &m.Key, &m.MessageType, &m.AggregateID, &m.Sequence,
+		&payload, &headers, &m.Attempts, &m.CreatedAt, &m.LastError, &nextAttemptAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("inbox message %s not found", id)
+	}
+	if err != nil {
+		return err
+	}
+	m.Payload = payload
+	err = json.Unmarshal(headers, &m.Headers)
+	if err != nil {
+		return err
+	}
+
+	next := "-"
+	if nextAttemptAt.Valid {
+		next = nextAttemptAt.Time.Format(time.RFC3339)
+	}
+	printMessage([][2]string{
+		{"message id", m.MessageID},
+		{"type", m.MessageType},
+		{"status", string(m.Status)},
+		{"topic", m.Topic},
+		{"key", m.Key},
+		{"sequence", sequence(m.AggregateID, m.Sequence)},
+		{"attempts", strconv.Itoa(m.Attempts)},
+		{"last error", m.LastError},
+		{"next attempt", next},
+		{"received at", m.CreatedAt.Format(time.RFC3339)},
+	}, m.Headers, m.Payload)
+
+	return nil
+}
+
+func replay(db *sql.DB, in inbox.Inbox, ids []string) error {
+	t, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	n, err := in.Replay(tx.With(context.Background(), t), ids)
+	if err != nil {
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("replaying %d messages\n", n)
+	return nil
+}
+
+// skipGap moves the aggregate on topic past sequence, for numbered messages
+// that never reached the inbox, such as dead-lettered ones.
+func skipGap(db *sql.DB, in inbox.Inbox, topic string, aggregateID string, sequence int64) error {
+	t, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	moved, err := in.SkipGap(tx.With(context.Background(), t), topic, aggregateID, sequence)
+	if err != nil {
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		return err
+	}
+
+	if !moved {
+		fmt.Printf("%s on %s is at %d or later already\n", aggregateID, topic, sequence)
+		return nil
+	}
+	fmt.Printf("%s on %s handled up to %d\n", aggregateID, topic, sequence)
+	return nil
+}
+
+// inboxMark sets the status of messages. Completed skips a message for good,
+// error hands it to the inbox worker now and parked stops its retries. A
+// numbered message is only skipped when it is the next one of its aggregate,
+// which then moves on to the message after it. Parking a numbered message
+// moves its aggregate past it as the processor does.
+func inboxMark(db *sql.DB, in inbox.Inbox, status inbox.MessageStatus, ids []string) error {
+	var nextAttemptAt *time.Time
+	switch status {
+	case inbox.StatusError:
+		now := time.Now()
+		nextAttemptAt = &now
+	case inbox.StatusCompleted, inbox.StatusParked:
+	default:
+		return fmt.Errorf("cannot mark inbox messages %s", status)
+	}
+
+	t, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	ctx := tx.With(context.Background(), t)
+
+	query := `UPDATE inbox SET status = $1, next_attempt_at = $2 WHERE message_id = ANY($3) AND status <> $1
+		RETURNING message_id, topic, COALESCE(aggregate_id, ''), COALESCE(sequence, 0)`
+	rows, err := t.QueryContext(ctx, query, status, nextAttemptAt, ids)
+	if err != nil {
+		return err
+	}
+	var marked []inbox.Message
+	for rows.Next() {
+		var m inbox.Message
+		err = rows.Scan(&m.MessageID, &m.Topic, &m.AggregateID, &m.Sequence)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		marked = append(marked, m)
+	}
+	err = rows.Close()
+	if err != nil {
+		return err
+	}
+
+	if status == inbox.StatusCompleted || status == inbox.StatusParked {
+		sort.Slice(marked, func(i, j int) bool { return marked[i].Sequence < marked[j].Sequence })
+		for _, m := range marked {
+			if m.Sequence == 0 {
+				continue
+			}
+			err = in.Advance(ctx, m)
+			if status == inbox.StatusParked && inbox.IsOutOfOrder(err) {
+				// a parked message out of turn leaves its aggregate alone
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("skip message %s: %w", m.MessageID, err)
+			}
+		}
+	}
+
+	err = t.Commit()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("marked %d of %d messages %s\n", len(marked), len(ids), status)
+	return nil
+}
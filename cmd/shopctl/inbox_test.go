@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"shop/pkg/inbox"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// arrayConverter passes slices through to the expectations, as pgx takes
+// them for ANY($n).
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	if v != nil && reflect.TypeOf(v).Kind() == reflect.Slice && reflect.TypeOf(v).Elem().Kind() != reflect.Uint8 {
+		return v, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+func newMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db, mock
+}
+
+// expectMarked expects the messages to be marked, rows holding the id and the
+// number of each in the order the database returns them.
+func expectMarked(mock sqlmock.Sqlmock, status inbox.MessageStatus, ids []string, rows [][2]any) {
+	result := sqlmock.NewRows([]string{"message_id", "topic", "aggregate_id", "sequence"})
+	for _, r := range rows {
+		result.AddRow(r[0], "order-events", "saga-1", r[1])
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE inbox SET status = \$1, next_attempt_at = \$2 WHERE message_id = ANY\(\$3\) AND status <> \$1`).
+		WithArgs(status, nil, ids).
+		WillReturnRows(result)
+}
+
+// expectAdvance expects the aggregate to be read at last and, when moved,
+// to move to sequence.
+func expectAdvance(mock sqlmock.Sqlmock, sequence int64, last int64, moved bool) {
+	mock.ExpectExec(`INSERT INTO inbox_sequences`).
+		WithArgs("order-events", "saga-1", sequence, sqlmock.AnyArg(), inbox.StatusCompleted).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT sequence FROM inbox_sequences`).
+		WillReturnRows(sqlmock.NewRows([]string{"sequence"}).AddRow(last))
+	if !moved {
+		return
+	}
+	mock.ExpectExec(`UPDATE inbox_sequences SET sequence = \$1`).
+		WithArgs(sequence, sqlmock.AnyArg(), "order-events", "saga-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE inbox SET next_attempt_at = \$1`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestInboxMarkCompletedAdvancesInOrder(t *testing.T) {
+	db, mock := newMockDB(t)
+	ids := []string{"message-3", "message-2"}
+
+	// returned out of order, the aggregate moves to 2 before 3
+	expectMarked(mock, inbox.StatusCompleted, ids, [][2]any{{"message-3", 3}, {"message-2", 2}})
+	expectAdvance(mock, 2, 1, true)
+	expectAdvance(mock, 3, 2, true)
+	mock.ExpectCommit()
+
+	err := inboxMark(db, inbox.NewPostgresInbox(), inbox.StatusCompleted, ids)
+	if err != nil {
+		t.Fatalf("inboxMark: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInboxMarkCompletedRefusesGap(t *testing.T) {
+	db, mock := newMockDB(t)
+	ids := []string{"message-3"}
+
+	expectMarked(mock, inbox.StatusCompleted, ids, [][2]any{{"message-3", 3}})
+	expectAdvance(mock, 3, 1, false)
+	mock.ExpectRollback()
+
+	err := inboxMark(db, inbox.NewPostgresInbox(), inbox.StatusCompleted, ids)
+	if !errors.Is(err, inbox.ErrSequenceGap) {
+		t.Fatalf("inboxMark = %v, want %v", err, inbox.ErrSequenceGap)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInboxMarkParkedMovesPastNextMessageOnly(t *testing.T) {
+	db, mock := newMockDB(t)
+	ids := []string{"message-2", "message-5"}
+
+	expectMarked(mock, inbox.StatusParked, ids, [][2]any{{"message-2", 2}, {"message-5", 5}})
+	expectAdvance(mock, 2, 1, true)
+	// 5 is not the next message, parking it leaves the aggregate at 2
+	expectAdvance(mock, 5, 2, false)
+	mock.ExpectCommit()
+
+	err := inboxMark(db, inbox.NewPostgresInbox(), inbox.StatusParked, ids)
+	if err != nil {
+		t.Fatalf("inboxMark: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
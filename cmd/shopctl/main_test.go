@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterWhere(t *testing.T) {
+	tests := []struct {
+		name      string
+		filter    filter
+		wantWhere string
+		wantArgs  []any
+	}{
+		{name: "no conditions", filter: filter{limit: 50}},
+		{name: "one condition", filter: filter{status: "parked"}, wantWhere: "WHERE status = $1", wantArgs: []any{"parked"}},
+		{
+			name:      "placeholders follow the arguments",
+			filter:    filter{status: "error", topic: "order-events", key: "saga-1"},
+			wantWhere: "WHERE status = $1 AND topic = $2 AND key = $3",
+			wantArgs:  []any{"error", "order-events", "saga-1"},
+		},
+		{
+			name:      "saga uses one argument twice",
+			filter:    filter{topic: "order-events", saga: "saga-1", status: "sent"},
+			wantWhere: "WHERE status = $1 AND topic = $2 AND (key = $3 OR headers->>'correlation-id' = $3)",
+			wantArgs:  []any{"sent", "order-events", "saga-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.filter.where()
+			if where != tt.wantWhere || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("where = %q, %v, want %q, %v", where, args, tt.wantWhere, tt.wantArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"shop/pkg/broker"
+	"shop/pkg/messaging"
+	"shop/pkg/outbox"
+	"shop/pkg/tx"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func outboxCommand(db *sql.DB, logger *log.Logger, command string, args []string) error {
+	switch command {
+	case "list":
+		f, err := parseFilter(args)
+		if err != nil {
+			return err
+		}
+		return outboxList(db, f)
+	case "show":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return outboxShow(db, args[0])
+	case "requeue":
+		return requeue(db, outbox.NewPostgresOutbox(), args)
+	case "mark":
+		status, ids, err := parseMark(args)
+		if err != nil {
+			return err
+		}
+		return outboxMark(db, outbox.MessageStatus(status), ids)
+	case "publish":
+		if len(args) == 0 {
+			return errUsage
+		}
+		return publish(db, logger, args)
+	default:
+		return errUsage
+	}
+}
+
+func outboxList(db *sql.DB, f filter) error {
+	where, args := f.where()
+	query := `SELECT id, status, topic, key, COALESCE(headers->>'` + broker.HeaderMessageType + `', ''), COALESCE(aggregate_id, ''), COALESCE(sequence, 0),
+		attempts, created_at, COALESCE(last_error, '') FROM outbox ` + where + ` ORDER BY created_at DESC LIMIT ` + strconv.Itoa(f.limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tTOPIC\tKEY\tTYPE\tSEQUENCE\tATTEMPTS\tCREATED\tLAST ERROR")
+	for rows.Next() {
+		var m outbox.Message
+		var messageType string
+		err = rows.Scan(&m.ID, &m.Status, &m.Topic, &m.Key, &messageType, &m.AggregateID, &m.Sequence, &m.Attempts, &m.CreatedAt, &m.LastError)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", m.ID, m.Status, m.Topic, m.Key, messageType,
+			sequence(m.AggregateID, m.Sequence), m.Attempts, m.CreatedAt.Format(time.DateTime), shorten(m.LastError, 60))
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func outboxShow(db *sql.DB, id string) error {
+	messages, err := findOutbox(db, []string{id})
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("outbox message %s not found", id)
+	}
+	m := messages[0]
+
+	printMessage([][2]string{
+		{"id", m.ID},
+		{"status", string(m.Status)},
+		{"topic", m.Topic},
+		{"key", m.Key},
+		{"sequence", sequence(m.AggregateID, m.Sequence)},
+		{"attempts", strconv.Itoa(m.Attempts)},
+		{"last error", m.LastError},
+		{"created at", m.CreatedAt.Format(time.RFC3339)},
+	}, m.Headers, m.Payload.(json.RawMessage))
+
+	return nil
+}
+
+// findOutbox loads the messages with ids, keeping the payload as it is stored.
+func findOutbox(db *sql.DB, ids []string) ([]outbox.Message, error) {
+	query := `SELECT id, status, topic, key, COALESCE(aggregate_id, ''), COALESCE(sequence, 0), payload, headers,
+		attempts, created_at, COALESCE(last_error, '') FROM outbox WHERE id = ANY($1) ORDER BY created_at`
+	rows, err := db.Query(query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []outbox.Message
+	for rows.Next() {
+		var m outbox.Message
+		var payload, headers []byte
+		err = rows.Scan(&m.ID, &m.Status, &m.Topic, &m.Key, &m.AggregateID, &m.Sequence, &payload, &headers, &m.Attempts, &m.CreatedAt, &m.LastError)
+		if err != nil {
+			return nil, err
+		}
+		m.Payload = json.RawMessage(payload)
+		err = json.Unmarshal(headers, &m.Headers)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+func requeue(db *sql.DB, out outbox.Outbox, ids []string) error {
+	t, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	n, err := out.Requeue(tx.With(context.Background(), t), ids)
+	if err != nil {
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("requeued %d messages\n", n)
+	return nil
+}
+
+// outboxMark sets the status of messages. Pending messages belong to a worker
+// and are left alone.
+func outboxMark(db *sql.DB, status outbox.MessageStatus, ids []string) error {
+	switch status {
+	case outbox.StatusInit, outbox.StatusSent, outbox.StatusError:
+	default:
+		return fmt.Errorf("cannot mark outbox messages %s", status)
+	}
+
+	query := `UPDATE outbox SET status = $1, next_attempt_at = NULL, locked_at = NULL, locked_by = NULL
+		WHERE id = ANY($2) AND status <> $3`
+	r, err := db.Exec(query, status, ids, outbox.StatusPending)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("marked %d of %d messages %s\n", n, len(ids), status)
+	return nil
+}
+
+// publish sends messages the worker is done with to the broker again, with
+// their sequence numbers, and marks them sent. Messages in init or pending
+// are the worker's, it numbers and sends them itself.
+func publish(db *sql.DB, logger *log.Logger, ids []string) error {
+	messages, err := findOutbox(db, ids)
+	if err != nil {
+		return err
+	}
+	if len(messages) != len(ids) {
+		return fmt.Errorf("found %d of %d outbox messages", len(messages), len(ids))
+	}
+
+	var brokerMessages []broker.Message
+	for _, m := range messages {
+		if m.Status != outbox.StatusSent && m.Status != outbox.StatusError {
+			return fmt.Errorf("outbox message %s is %s, the worker sends it", m.ID, m.Status)
+		}
+		brokerMessage, err := outbox.BrokerMessage(m)
+		if err != nil {
+			return err
+		}
+		brokerMessages = append(brokerMessages, brokerMessage)
+	}
+
+	// only publishes, a group of its own per run never shares the offsets or
+	// leases of another run or of a service
+	br, closeBroker, err := messaging.Connect(messaging.ConfigFromEnv(), "shopctl-"+uuid.New().String(), logger)
+	if err != nil {
+		return err
+	}
+	defer closeBroker()
+
+	err = br.PublishBatch(brokerMessages)
+	if err != nil {
+		return err
+	}
+
+	return outboxMark(db, outbox.StatusSent, ids)
+}
@@ -3,25 +3,36 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"shop/gateway/internal/handler"
 	"shop/gateway/internal/middleware"
+	"shop/gateway/internal/notifier"
 	"shop/gateway/internal/repository"
 	"shop/pkg/broker"
+	"shop/pkg/health"
+	"shop/pkg/inbox"
+	"shop/pkg/messaging"
 	"shop/pkg/outbox"
 	"shop/pkg/proto"
+	"shop/pkg/topology"
+	"shop/pkg/tx"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/IBM/sarama"
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+// maxConsumerLag is the lag per partition above which the gateway reports not ready.
+const maxConsumerLag = 1000
+
 func main() {
 	logger := log.New(os.Stdout, "[gateway] ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 
@@ -35,6 +46,11 @@ func main() {
 		logger.Fatal("failed to ping database", "error", err)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+
 	redisRepo, err := repository.NewRedisSessionRepository(
 		"localhost:6379",
 		"",
@@ -44,7 +60,30 @@ func main() {
 		log.Fatalf("Failed to initialize Redis: %v", err)
 	}
 
-	userRepo := repository.NewPostgresUserRepository(db)
+	hub := notifier.NewHub(16)
+	redisNotifier, err := notifier.NewRedisNotifier(
+		"localhost:6379",
+		"",
+		"order-status",
+		hub,
+		logger,
+	)
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis notifier: %v", err)
+	}
+	defer redisNotifier.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := redisNotifier.Run(ctx)
+		if err != nil {
+			logger.Printf("notifier stopped: %v", err)
+		}
+	}()
+
+	txm := tx.NewManager(db)
+	userRepo := repository.NewPostgresUserRepository(txm)
+	orderStatusRepo := repository.NewPostgresOrderStatusRepository(txm)
 
 	sessionMiddleware := middleware.NewSessionMiddleware(
 		redisRepo,
@@ -75,17 +114,20 @@ func main() {
 	productServiceClient := proto.NewProductServiceClient(productServiceConn)
 
 	authHandler := handler.NewAuthHandler(db, sessionMiddleware, userRepo)
-	orderHandler := handler.NewOrderHandler(db, out, orderHistoryClient, logger)
+	orderHandler := handler.NewOrderHandler(txm, out, orderStatusRepo, orderHistoryClient, logger)
 	productHandler := handler.NewProductHandler(db, out, productServiceClient, logger)
+	streamHandler := handler.NewStreamHandler(hub, 15*time.Second, logger)
 
 	router := mux.NewRouter()
 
 	// Public
 	router.HandleFunc("/auth/register", authHandler.Register).Methods("POST")
 	router.HandleFunc("/auth/login", authHandler.Login).Methods("POST")
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("OK"))
-	}).Methods("GET")
+	hc := health.New(logger)
+	hc.AddCheck("database", health.Database(db))
+	router.Handle("/health", hc.Handler()).Methods("GET")
+	router.Handle("/ready", hc.Handler()).Methods("GET")
+	router.Handle("/metrics", hc.Handler()).Methods("GET")
 
 	router.HandleFunc("/api/categories", productHandler.GetCategories).Methods("GET")
 	router.HandleFunc("/api/products", productHandler.GetProducts).Methods("GET")
@@ -98,37 +140,111 @@ func main() {
 	protected.HandleFunc("/auth/profile", authHandler.Profile).Methods("GET")
 
 	protected.HandleFunc("/api/orders", orderHandler.CreateOrder).Methods("POST")
+	protected.HandleFunc("/api/orders/status/{id}", orderHandler.GetOrderStatus).Methods("GET")
+	protected.HandleFunc("/api/orders/events", streamHandler.OrderEvents).Methods("GET")
 	protected.HandleFunc("/api/my-orders", orderHandler.GetMyOrders).Methods("GET")
 
-	brokers := []string{"localhost:9093"}
-
-	config := sarama.NewConfig()
-	config.Producer.Return.Successes = true
-	config.Producer.Idempotent = true
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	config.Net.MaxOpenRequests = 1
-	config.Producer.Transaction.ID = uuid.New().String()
+	// message broker, kafka or postgres depending on BROKER_DRIVER
+	brokerConfig := messaging.ConfigFromEnv()
+	brokerConfig.Retention = true
+	br, closeBroker, err := messaging.Connect(brokerConfig, "gateway-group", logger)
+	if err != nil {
+		logger.Fatalf("failed to connect to message broker: %v", err)
+	}
+	defer closeBroker()
+	hc.AddBroker(br, maxConsumerLag)
+
+	in := inbox.NewPostgresInbox()
+	processor := inbox.NewProcessor(db, in, logger)
+	// handles messages again whose handler failed, see inbox.Worker
+	inboxWorker := inbox.NewWorker(db, in, logger, 100, 10*time.Second)
+
+	// retention of sent and handled messages
+	outboxRetention := outbox.NewRetention(db, outbox.DefaultRetention, logger)
+	inboxRetention := inbox.NewRetention(db, inbox.DefaultRetention, logger)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		outboxRetention.Start(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		inboxRetention.Start(ctx)
+	}()
 
-	// kafka producer
-	kafkaProducer, err := sarama.NewSyncProducer(brokers, config)
+	// subscribe order status handler
+	// the other events of saga-events do not change the order status
+	metrics := broker.NewMetrics()
+	events := broker.NewRouter(broker.SkipUnknown, logger)
+	handler.NewEventHandler(orderStatusRepo, redisNotifier, logger).Register(events, topology.SagaEvents)
+	eventHandler := broker.Chain(events.HandleMessage,
+		broker.Recover(logger),
+		broker.Logging(logger),
+		broker.Measure(metrics),
+		broker.Trace(),
+		broker.Idempotent(processor),
+	)
+	err = events.SubscribeAll(br, eventHandler)
 	if err != nil {
-		logger.Fatalf("Ошибка при создании продюсера: %v", err)
+		logger.Fatalf("failed to subscribe to saga events topic: %v", err)
+	}
+	for _, topic := range events.Topics() {
+		inboxWorker.Handle(topic, broker.InboxHandler(eventHandler))
 	}
-	defer kafkaProducer.Close()
+	hc.SetMetrics(metrics)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		inboxWorker.Start(ctx)
+	}()
 
-	br := broker.NewKafkaBroker(kafkaProducer, nil, logger)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := br.StartConsume(ctx, events.Topics())
+		if err != nil {
+			logger.Printf("consumer stopped: %v", err)
+			stop()
+		}
+	}()
 
 	// outbox worker
 	workerBatchSize := 100
-	workerInterval := 1 * time.Second
+	// fallback poll, the worker is woken up by commits to the outbox
+	workerInterval := 5 * time.Second
 	outboxWorker := outbox.NewWorker(db, br, out, logger, workerBatchSize, workerInterval)
+	wg.Add(1)
 	go func() {
-		err := outboxWorker.Start(context.Background())
+		defer wg.Done()
+		err := outboxWorker.Start(ctx)
 		if err != nil {
-			logger.Printf("failed to start outbox worker: %v", err)
+			logger.Printf("outbox worker stopped: %v", err)
 		}
 	}()
 
-	log.Println("API Gateway started on :8081")
-	log.Fatal(http.ListenAndServe(":8081", router))
+	srv := &http.Server{Addr: ":8081", Handler: router}
+	srv.RegisterOnShutdown(hub.Close)
+
+	go func() {
+		log.Println("API Gateway started on :8081")
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Printf("HTTP server stopped: %v", err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Println("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Printf("HTTP server shutdown: %v", err)
+	}
+
+	wg.Wait()
+	logger.Println("shutdown complete")
 }
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"shop/gateway/internal/model"
+	"shop/gateway/internal/notifier"
+	"shop/gateway/internal/repository"
+	"shop/pkg/broker"
+	"shop/pkg/event"
+	"time"
+)
+
+type EventHandler struct {
+	orderStatusRepo repository.OrderStatusRepository
+	publisher       notifier.Publisher
+	logger          *log.Logger
+}
+
+func NewEventHandler(orderStatusRepo repository.OrderStatusRepository, publisher notifier.Publisher, logger *log.Logger) *EventHandler {
+	return &EventHandler{
+		orderStatusRepo: orderStatusRepo,
+		publisher:       publisher,
+		logger:          logger,
+	}
+}
+
+// Register routes the saga status events of topic, the router skips the other
+// events of the topic.
+func (h *EventHandler) Register(router *broker.Router, topic string) {
+	router.Handle(topic, broker.Event(h.handleSagaStatusChanged), string(event.SagaStatusChanged))
+}
+
+// notify is best effort: the status endpoint stays the source of truth when a push is lost.
+func (h *EventHandler) notify(orderStatus *model.OrderStatus, e event.Event) {
+	notification := notifier.Notification{
+		UserID:        orderStatus.UserID,
+		SagaID:        orderStatus.SagaID,
+		OrderID:       orderStatus.OrderID,
+		EventType:     string(e.Type),
+		Status:        string(orderStatus.Status),
+		Outcome:       orderStatus.Outcome(),
+		Step:          orderStatus.Step,
+		FailureReason: orderStatus.FailureReason,
+		CreatedAt:     time.Now(),
+	}
+
+	err := h.publisher.Publish(context.Background(), notification)
+	if err != nil {
+		h.logger.Printf("Failed to publish notification: %s", err)
+	}
+}
+
+// handleSagaStatusChanged pushes only a stored status, a stale revision is
+// ignored. The push happens before the inbox commits, a message that is rolled
+// back is handled again and pushes the same status again.
+func (h *EventHandler) handleSagaStatusChanged(ctx context.Context, e event.Event, payload event.SagaStatusChangedPayload) error {
+	orderStatus := &model.OrderStatus{
+		SagaID:        payload.SagaID,
+		UserID:        payload.UserID,
+		OrderID:       payload.OrderID,
+		Status:        model.OrderStatusValue(payload.Status),
+		CurrentStep:   payload.CurrentStep,
+		Step:          payload.Step,
+		FailureReason: payload.FailureReason,
+		Revision:      payload.Revision,
+		CreatedAt:     payload.UpdatedAt,
+		UpdatedAt:     payload.UpdatedAt,
+	}
+
+	applied, err := h.orderStatusRepo.Upsert(ctx, orderStatus)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		h.logger.Printf("Ignore revision %d of saga %s, a newer one is stored", payload.Revision, payload.SagaID)
+		return nil
+	}
+
+	h.notify(orderStatus, e)
+	return nil
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"shop/gateway/internal/model"
+	"shop/gateway/internal/notifier"
+	"shop/pkg/broker"
+	"shop/pkg/event"
+	"sync"
+	"testing"
+)
+
+// memoryOrderStatusRepo keeps the status with the highest revision, as the
+// Postgres repository does.
+type memoryOrderStatusRepo struct {
+	mu       sync.Mutex
+	statuses map[string]model.OrderStatus
+}
+
+func newMemoryOrderStatusRepo() *memoryOrderStatusRepo {
+	return &memoryOrderStatusRepo{statuses: make(map[string]model.OrderStatus)}
+}
+
+func (r *memoryOrderStatusRepo) Create(ctx context.Context, status *model.OrderStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.statuses[status.SagaID] = *status
+	return nil
+}
+
+func (r *memoryOrderStatusRepo) Upsert(ctx context.Context, status *model.OrderStatus) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if current, ok := r.statuses[status.SagaID]; ok && current.Revision >= status.Revision {
+		return false, nil
+	}
+	r.statuses[status.SagaID] = *status
+	return true, nil
+}
+
+func (r *memoryOrderStatusRepo) FindBySagaID(ctx context.Context, sagaID string) (*model.OrderStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.statuses[sagaID]
+	return &status, nil
+}
+
+// recordingPublisher keeps the pushed notifications.
+type recordingPublisher struct {
+	mu            sync.Mutex
+	notifications []notifier.Notification
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, notification notifier.Notification) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.notifications = append(p.notifications, notification)
+	return nil
+}
+
+func eventMessage(t *testing.T, eventType event.Type, payload any) broker.Message {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal payload: %v", err)
+	}
+	value, err := json.Marshal(event.Event{ID: "event-1", Type: eventType, SagaID: "saga-1", Payload: data})
+	if err != nil {
+		t.Fatalf("marshal event: %v", err)
+	}
+	return broker.Message{
+		Topic:   "saga-events",
+		Key:     "saga-1",
+		Value:   value,
+		Headers: broker.Headers{broker.HeaderMessageType: string(eventType)},
+	}
+}
+
+func newTestRouter(repo *memoryOrderStatusRepo, publisher *recordingPublisher) *broker.Router {
+	logger := log.New(io.Discard, "", 0)
+	router := broker.NewRouter(broker.SkipUnknown, logger)
+	NewEventHandler(repo, publisher, logger).Register(router, "saga-events")
+	return router
+}
+
+func TestSagaStatusChangedOutOfOrder(t *testing.T) {
+	repo := newMemoryOrderStatusRepo()
+	publisher := &recordingPublisher{}
+	router := newTestRouter(repo, publisher)
+
+	revisions := []struct {
+		revision int64
+		status   string
+	}{
+		{revision: 1, status: "running"},
+		{revision: 3, status: "completed"},
+		// arrives late, the stored status must not go back and nothing is pushed
+		{revision: 2, status: "running"},
+		{revision: 3, status: "completed"},
+	}
+	for _, r := range revisions {
+		payload := event.SagaStatusChangedPayload{SagaID: "saga-1", UserID: "user-1", Status: r.status, Revision: r.revision}
+		err := router.HandleMessage(context.Background(), eventMessage(t, event.SagaStatusChanged, payload))
+		if err != nil {
+			t.Fatalf("revision %d: %v", r.revision, err)
+		}
+	}
+
+	stored, _ := repo.FindBySagaID(context.Background(), "saga-1")
+	if stored.Revision != 3 || stored.Status != "completed" {
+		t.Errorf("stored %s at revision %d, want completed at revision 3", stored.Status, stored.Revision)
+	}
+
+	var pushed []string
+	for _, n := range publisher.notifications {
+		pushed = append(pushed, n.Status)
+	}
+	if len(pushed) != 2 || pushed[0] != "running" || pushed[1] != "completed" {
+		t.Errorf("pushed %v, want [running completed]", pushed)
+	}
+}
+
+func TestOtherEventsAreSkipped(t *testing.T) {
+	repo := newMemoryOrderStatusRepo()
+	publisher := &recordingPublisher{}
+	router := newTestRouter(repo, publisher)
+
+	err := router.HandleMessage(context.Background(), eventMessage(t, event.OrderCompleted, map[string]string{"order_id": "order-1"}))
+	if err != nil {
+		t.Fatalf("HandleMessage: %v", err)
+	}
+	if len(repo.statuses) != 0 || len(publisher.notifications) != 0 {
+		t.Errorf("stored %d statuses and pushed %d notifications, want none", len(repo.statuses), len(publisher.notifications))
+	}
+}
@@ -4,30 +4,40 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"shop/gateway/internal/middleware"
+	"shop/gateway/internal/model"
+	"shop/gateway/internal/repository"
+	"shop/pkg/broker"
 	"shop/pkg/command"
 	"shop/pkg/outbox"
 	"shop/pkg/proto"
+	"shop/pkg/topology"
+	"shop/pkg/tx"
 	"shop/pkg/types"
 	"strconv"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 type OrderHandler struct {
-	db                        *sql.DB
+	txm                       *tx.Manager
 	outbox                    outbox.Outbox
+	orderStatusRepo           repository.OrderStatusRepository
 	orderHistoryServiceClient proto.OrderHistoryServiceClient
 	logger                    *log.Logger
 }
 
-func NewOrderHandler(db *sql.DB, outbox outbox.Outbox, orderHistoryServiceClient proto.OrderHistoryServiceClient, logger *log.Logger) *OrderHandler {
+func NewOrderHandler(txm *tx.Manager, outbox outbox.Outbox, orderStatusRepo repository.OrderStatusRepository, orderHistoryServiceClient proto.OrderHistoryServiceClient, logger *log.Logger) *OrderHandler {
 	return &OrderHandler{
-		db:                        db,
+		txm:                       txm,
 		outbox:                    outbox,
+		orderStatusRepo:           orderStatusRepo,
 		orderHistoryServiceClient: orderHistoryServiceClient,
 		logger:                    logger,
 	}
@@ -51,6 +61,7 @@ func (o *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	payload := command.SagaCreateOrderPayload{
@@ -62,53 +73,122 @@ func (o *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	sagaID := uuid.New().String()
+
 	cmd := command.Command{
 		ID:      uuid.New().String(),
 		Type:    command.SagaCreateOrder,
+		SagaID:  sagaID,
 		Payload: jsonPayload,
 	}
 
+	timeNow := time.Now()
+
+	headers := broker.NewHeaders(string(cmd.Type), cmd.ID, sagaID, "")
+	headers[broker.HeaderTraceParent] = broker.NewTraceParent()
+
 	outboxMessage := outbox.Message{
 		ID:        uuid.New().String(),
-		Topic:     "order-saga-commands",
+		Topic:     topology.OrderSagaCommands,
+		Key:       sagaID,
 		Payload:   cmd,
+		Headers:   headers,
 		Status:    outbox.StatusInit,
-		CreatedAt: time.Now(),
+		CreatedAt: timeNow,
 	}
 
-	tx, err := o.db.Begin()
-	if err != nil {
-		o.logger.Println("Failed to begin transaction", "error", err)
-		http.Error(w, "Failed to begin transaction", http.StatusInternalServerError)
+	orderStatus := &model.OrderStatus{
+		SagaID:    sagaID,
+		UserID:    session.UserID,
+		Status:    model.OrderStatusPending,
+		CreatedAt: timeNow,
+		UpdatedAt: timeNow,
 	}
-	defer tx.Rollback()
 
-	ctxWithTx := context.WithValue(context.Background(), "tx", tx)
+	err = o.txm.WithinTx(r.Context(), func(ctx context.Context) error {
+		err := o.orderStatusRepo.Create(ctx, orderStatus)
+		if err != nil {
+			return fmt.Errorf("failed to create order status: %w", err)
+		}
 
-	err = o.outbox.Publish(ctxWithTx, outboxMessage)
-	if err != nil {
-		o.logger.Println("failed to publish outbox message", "error", err)
-		http.Error(w, "failed to publish outbox message", http.StatusInternalServerError)
-	}
+		err = o.outbox.Publish(ctx, outboxMessage)
+		if err != nil {
+			return fmt.Errorf("failed to publish outbox message: %w", err)
+		}
 
-	err = tx.Commit()
+		return nil
+	})
 	if err != nil {
-		o.logger.Println("failed to commit transaction", "error", err)
+		o.logger.Println("failed to create order", "error", err)
+		http.Error(w, "failed to create order", http.StatusInternalServerError)
+		return
 	}
 
 	response := map[string]interface{}{
 		"success": true,
-		"message": "Order created",
+		"message": "Order accepted",
+		"saga_id": sagaID,
+		"status":  orderStatus.Status,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/orders/status/"+sagaID)
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 
 	o.logger.Println("CreateOrder handler finish")
 }
 
+func (o *OrderHandler) GetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	o.logger.Println("GetOrderStatus handler start")
+
+	session := middleware.GetSessionFromContext(r.Context())
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sagaID := mux.Vars(r)["id"]
+
+	orderStatus, err := o.orderStatusRepo.FindBySagaID(r.Context(), sagaID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+			return
+		}
+		o.logger.Println("Failed to find order status", "error", err)
+		http.Error(w, "Failed to find order status", http.StatusInternalServerError)
+		return
+	}
+
+	// do not reveal other users' orders
+	if orderStatus.UserID != session.UserID {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":        true,
+		"saga_id":        orderStatus.SagaID,
+		"order_id":       orderStatus.OrderID,
+		"status":         orderStatus.Status,
+		"outcome":        orderStatus.Outcome(),
+		"current_step":   orderStatus.CurrentStep,
+		"step":           orderStatus.Step,
+		"failure_reason": orderStatus.FailureReason,
+		"created_at":     orderStatus.CreatedAt,
+		"updated_at":     orderStatus.UpdatedAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	o.logger.Println("GetOrderStatus handler finish")
+}
+
 func (o *OrderHandler) GetMyOrders(w http.ResponseWriter, r *http.Request) {
 	o.logger.Println("GetOrdersByUserID handler start")
 
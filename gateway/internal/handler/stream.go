@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shop/gateway/internal/middleware"
+	"shop/gateway/internal/notifier"
+	"time"
+)
+
+type StreamHandler struct {
+	hub               *notifier.Hub
+	heartbeatInterval time.Duration
+	logger            *log.Logger
+}
+
+func NewStreamHandler(hub *notifier.Hub, heartbeatInterval time.Duration, logger *log.Logger) *StreamHandler {
+	return &StreamHandler{
+		hub:               hub,
+		heartbeatInterval: heartbeatInterval,
+		logger:            logger,
+	}
+}
+
+// OrderEvents streams the order status changes of the session user as Server-Sent Events.
+func (h *StreamHandler) OrderEvents(w http.ResponseWriter, r *http.Request) {
+	session := middleware.GetSessionFromContext(r.Context())
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	notifications, unsubscribe := h.hub.Subscribe(session.UserID)
+	defer unsubscribe()
+
+	h.logger.Printf("Order events stream opened for user %s", session.UserID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			h.logger.Printf("Order events stream closed for user %s", session.UserID)
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case notification, ok := <-notifications:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(notification)
+			if err != nil {
+				h.logger.Printf("Failed to marshal notification: %v", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: order-status\ndata: %s\n\n", data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"shop/gateway/internal/model"
+	"shop/gateway/internal/notifier"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStreamServer serves OrderEvents to user-1 as if SessionRequired passed.
+func newStreamServer(t *testing.T, hub *notifier.Hub, heartbeat time.Duration) *httptest.Server {
+	t.Helper()
+
+	h := NewStreamHandler(hub, heartbeat, log.New(io.Discard, "", 0))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), "session", &model.Session{UserID: "user-1"})
+		h.OrderEvents(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// openStream returns once the handler subscribed, it flushes the headers after that.
+func openStream(t *testing.T, server *httptest.Server) *bufio.Reader {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+// readFrame reads the lines of one event up to the blank line that ends it.
+func readFrame(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestOrderEventsRequiresSession(t *testing.T) {
+	h := NewStreamHandler(notifier.NewHub(1), time.Hour, log.New(io.Discard, "", 0))
+
+	rec := httptest.NewRecorder()
+	h.OrderEvents(rec, httptest.NewRequest(http.MethodGet, "/api/orders/events", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOrderEventsFramesNotifications(t *testing.T) {
+	hub := notifier.NewHub(1)
+	stream := openStream(t, newStreamServer(t, hub, time.Hour))
+
+	// notifications of other users are not streamed
+	hub.Dispatch(notifier.Notification{UserID: "user-2", SagaID: "saga-2"})
+	if delivered := hub.Dispatch(notifier.Notification{UserID: "user-1", SagaID: "saga-1", Status: "completed"}); delivered != 1 {
+		t.Fatalf("Dispatch() = %d, want 1", delivered)
+	}
+
+	frame := readFrame(t, stream)
+	if len(frame) != 2 || frame[0] != "event: order-status" || !strings.HasPrefix(frame[1], "data: ") {
+		t.Fatalf("frame = %q, want an order-status event with data", frame)
+	}
+	var n notifier.Notification
+	err := json.Unmarshal([]byte(strings.TrimPrefix(frame[1], "data: ")), &n)
+	if err != nil {
+		t.Fatalf("unmarshal data: %v", err)
+	}
+	if n.SagaID != "saga-1" || n.Status != "completed" {
+		t.Errorf("got %+v, want completed saga-1", n)
+	}
+}
+
+func TestOrderEventsSendsHeartbeats(t *testing.T) {
+	stream := openStream(t, newStreamServer(t, notifier.NewHub(1), 10*time.Millisecond))
+
+	for range 2 {
+		frame := readFrame(t, stream)
+		if len(frame) != 1 || frame[0] != ": heartbeat" {
+			t.Fatalf("frame = %q, want a heartbeat comment", frame)
+		}
+	}
+}
+
+func TestOrderEventsEndsWhenHubCloses(t *testing.T) {
+	hub := notifier.NewHub(1)
+	stream := openStream(t, newStreamServer(t, hub, time.Hour))
+
+	hub.Close()
+	_, err := stream.ReadString('\n')
+	if err != io.EOF {
+		t.Errorf("read after Close = %v, want EOF", err)
+	}
+}
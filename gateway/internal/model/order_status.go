@@ -0,0 +1,44 @@
+package model
+
+import "time"
+
+type OrderStatusValue string
+
+const (
+	OrderStatusPending      OrderStatusValue = "pending"
+	OrderStatusInit         OrderStatusValue = "init"
+	OrderStatusRunning      OrderStatusValue = "running"
+	OrderStatusCompensating OrderStatusValue = "compensating"
+	OrderStatusCompleted    OrderStatusValue = "completed"
+	OrderStatusCompensated  OrderStatusValue = "compensated"
+)
+
+const (
+	OutcomePending   = "pending"
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+type OrderStatus struct {
+	SagaID        string           `json:"saga_id"`
+	UserID        string           `json:"user_id"`
+	OrderID       string           `json:"order_id"`
+	Status        OrderStatusValue `json:"status"`
+	CurrentStep   int              `json:"current_step"`
+	Step          string           `json:"step"`
+	FailureReason string           `json:"failure_reason"`
+	Revision      int64            `json:"revision"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+}
+
+func (s *OrderStatus) Outcome() string {
+	switch s.Status {
+	case OrderStatusCompleted:
+		return OutcomeSucceeded
+	case OrderStatusCompensated:
+		return OutcomeFailed
+	default:
+		return OutcomePending
+	}
+}
@@ -0,0 +1,76 @@
+package notifier
+
+import "sync"
+
+// Hub keeps the stream connections open on this gateway replica, grouped by user.
+type Hub struct {
+	mu         sync.RWMutex
+	clients    map[string]map[chan Notification]struct{}
+	bufferSize int
+}
+
+func NewHub(bufferSize int) *Hub {
+	return &Hub{
+		clients:    make(map[string]map[chan Notification]struct{}),
+		bufferSize: bufferSize,
+	}
+}
+
+func (h *Hub) Subscribe(userID string) (<-chan Notification, func()) {
+	ch := make(chan Notification, h.bufferSize)
+
+	h.mu.Lock()
+	if _, ok := h.clients[userID]; !ok {
+		h.clients[userID] = make(map[chan Notification]struct{})
+	}
+	h.clients[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := h.clients[userID][ch]; !ok {
+			return
+		}
+		delete(h.clients[userID], ch)
+		if len(h.clients[userID]) == 0 {
+			delete(h.clients, userID)
+		}
+		close(ch)
+	}
+
+	return ch, unsubscribe
+}
+
+// Dispatch never blocks: a client that does not keep up loses the notification
+// and can catch up through the status endpoint.
+func (h *Hub) Dispatch(notification Notification) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	delivered := 0
+	for ch := range h.clients[notification.UserID] {
+		select {
+		case ch <- notification:
+			delivered++
+		default:
+		}
+	}
+
+	return delivered
+}
+
+// Close ends every open stream, so the HTTP server can shut down without
+// waiting for long-lived connections.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for userID, clients := range h.clients {
+		for ch := range clients {
+			close(ch)
+		}
+		delete(h.clients, userID)
+	}
+}
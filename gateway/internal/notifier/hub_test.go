@@ -0,0 +1,89 @@
+package notifier
+
+import "testing"
+
+func TestHubDispatchesToTheUsersStreams(t *testing.T) {
+	hub := NewHub(1)
+	first, unsubscribeFirst := hub.Subscribe("user-1")
+	defer unsubscribeFirst()
+	second, unsubscribeSecond := hub.Subscribe("user-1")
+	defer unsubscribeSecond()
+	other, unsubscribeOther := hub.Subscribe("user-2")
+	defer unsubscribeOther()
+
+	if delivered := hub.Dispatch(Notification{UserID: "user-1", SagaID: "saga-1"}); delivered != 2 {
+		t.Errorf("Dispatch() = %d, want 2", delivered)
+	}
+	for _, ch := range []<-chan Notification{first, second} {
+		if n := <-ch; n.SagaID != "saga-1" {
+			t.Errorf("got saga %q, want saga-1", n.SagaID)
+		}
+	}
+	select {
+	case n := <-other:
+		t.Errorf("user-2 got %+v, want nothing", n)
+	default:
+	}
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	hub := NewHub(1)
+	ch, unsubscribe := hub.Subscribe("user-1")
+
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Error("channel is open after unsubscribe, want closed")
+	}
+	if delivered := hub.Dispatch(Notification{UserID: "user-1"}); delivered != 0 {
+		t.Errorf("Dispatch() after unsubscribe = %d, want 0", delivered)
+	}
+	if len(hub.clients) != 0 {
+		t.Errorf("hub keeps %d users, want none", len(hub.clients))
+	}
+
+	// a second call, e.g. after Close, must not close the channel again
+	unsubscribe()
+}
+
+func TestHubDropsNotificationsOfSlowClients(t *testing.T) {
+	hub := NewHub(1)
+	slow, unsubscribeSlow := hub.Subscribe("user-1")
+	defer unsubscribeSlow()
+
+	hub.Dispatch(Notification{UserID: "user-1", Status: "running"})
+	fast, unsubscribeFast := hub.Subscribe("user-1")
+	defer unsubscribeFast()
+
+	// the buffer of slow is full, only fast gets the second notification
+	if delivered := hub.Dispatch(Notification{UserID: "user-1", Status: "completed"}); delivered != 1 {
+		t.Errorf("Dispatch() = %d, want 1", delivered)
+	}
+	if n := <-slow; n.Status != "running" {
+		t.Errorf("slow client got %q, want running", n.Status)
+	}
+	select {
+	case n := <-slow:
+		t.Errorf("slow client got %+v, want the notification dropped", n)
+	default:
+	}
+	if n := <-fast; n.Status != "completed" {
+		t.Errorf("fast client got %q, want completed", n.Status)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(1)
+	first, unsubscribeFirst := hub.Subscribe("user-1")
+	second, unsubscribeSecond := hub.Subscribe("user-2")
+
+	hub.Close()
+	for _, ch := range []<-chan Notification{first, second} {
+		if _, ok := <-ch; ok {
+			t.Error("channel is open after Close, want closed")
+		}
+	}
+
+	// streams unsubscribe when their handler returns
+	unsubscribeFirst()
+	unsubscribeSecond()
+}
@@ -0,0 +1,22 @@
+package notifier
+
+import (
+	"context"
+	"time"
+)
+
+type Notification struct {
+	UserID        string    `json:"user_id"`
+	SagaID        string    `json:"saga_id"`
+	OrderID       string    `json:"order_id"`
+	EventType     string    `json:"event_type"`
+	Status        string    `json:"status"`
+	Outcome       string    `json:"outcome"`
+	Step          string    `json:"step"`
+	FailureReason string    `json:"failure_reason"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, notification Notification) error
+}
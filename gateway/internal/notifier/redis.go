@@ -0,0 +1,92 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisNotifier fans notifications out to every gateway replica: the replica
+// that consumed the event publishes it, and each replica delivers it to its own
+// connections.
+type RedisNotifier struct {
+	client  *redis.Client
+	channel string
+	hub     *Hub
+	logger  *log.Logger
+}
+
+func NewRedisNotifier(addr, password, channel string, hub *Hub, logger *log.Logger) (*RedisNotifier, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       0,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	return &RedisNotifier{
+		client:  client,
+		channel: channel,
+		hub:     hub,
+		logger:  logger,
+	}, nil
+}
+
+func (n *RedisNotifier) Publish(ctx context.Context, notification Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	err = n.client.Publish(ctx, n.channel, data).Err()
+	if err != nil {
+		return fmt.Errorf("failed to publish notification: %w", err)
+	}
+
+	return nil
+}
+
+func (n *RedisNotifier) Run(ctx context.Context) error {
+	pubsub := n.client.Subscribe(ctx, n.channel)
+	defer pubsub.Close()
+
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to redis channel: %w", err)
+	}
+
+	n.logger.Printf("Listening for notifications on %s", n.channel)
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			var notification Notification
+			err = json.Unmarshal([]byte(msg.Payload), &notification)
+			if err != nil {
+				n.logger.Printf("Failed to unmarshal notification: %v", err)
+				continue
+			}
+			n.hub.Dispatch(notification)
+		}
+	}
+}
+
+func (n *RedisNotifier) Close() error {
+	return n.client.Close()
+}
@@ -0,0 +1,70 @@
+package notifier
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisNotifierDeliversToTheHub(t *testing.T) {
+	server := miniredis.RunT(t)
+	hub := NewHub(1)
+	n, err := NewRedisNotifier(server.Addr(), "", "order-status", hub, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewRedisNotifier: %v", err)
+	}
+	defer n.Close()
+
+	ch, unsubscribe := hub.Subscribe("user-1")
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- n.Run(ctx)
+	}()
+
+	// Run subscribes in the background, publish until it listens
+	deadline := time.After(5 * time.Second)
+	for len(server.PubSubChannels("order-status")) == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("notifier did not subscribe")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	err = n.Publish(context.Background(), Notification{UserID: "user-1", SagaID: "saga-1", Status: "completed"})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	select {
+	case got := <-ch:
+		if got.SagaID != "saga-1" || got.Status != "completed" {
+			t.Errorf("got %+v, want completed saga-1", got)
+		}
+	case <-deadline:
+		t.Fatal("notification was not delivered")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestNewRedisNotifierFailsWithoutRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+
+	_, err := NewRedisNotifier(addr, "", "order-status", NewHub(1), log.New(io.Discard, "", 0))
+	if err == nil {
+		t.Error("NewRedisNotifier() error = nil, want an error")
+	}
+}
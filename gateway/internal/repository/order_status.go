@@ -0,0 +1,13 @@
+package repository
+
+import (
+	"context"
+	"shop/gateway/internal/model"
+)
+
+type OrderStatusRepository interface {
+	Create(ctx context.Context, status *model.OrderStatus) error
+	// Upsert reports whether it stored status, see PostgresOrderStatusRepository.
+	Upsert(ctx context.Context, status *model.OrderStatus) (bool, error)
+	FindBySagaID(ctx context.Context, sagaID string) (*model.OrderStatus, error)
+}
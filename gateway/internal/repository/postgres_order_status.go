@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"shop/gateway/internal/model"
+	"shop/pkg/tx"
+)
+
+type PostgresOrderStatusRepository struct {
+	db tx.Source
+}
+
+func NewPostgresOrderStatusRepository(db tx.Source) *PostgresOrderStatusRepository {
+	return &PostgresOrderStatusRepository{db: db}
+}
+
+func (r *PostgresOrderStatusRepository) Create(ctx context.Context, status *model.OrderStatus) error {
+	conn := r.db.Conn(ctx)
+
+	q := `INSERT INTO order_status (saga_id, user_id, order_id, status, current_step, step, failure_reason, revision, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err := conn.ExecContext(
+		ctx,
+		q,
+		status.SagaID,
+		status.UserID,
+		status.OrderID,
+		status.Status,
+		status.CurrentStep,
+		status.Step,
+		status.FailureReason,
+		status.Revision,
+		status.CreatedAt,
+		status.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Upsert ignores updates whose saga revision is not newer than the stored
+// row, so a late event cannot move the status backwards, and reports whether
+// it stored status. The row the gateway creates has revision 0 and loses to
+// any saga status.
+func (r *PostgresOrderStatusRepository) Upsert(ctx context.Context, status *model.OrderStatus) (bool, error) {
+	conn := r.db.Conn(ctx)
+
+	q := `INSERT INTO order_status (saga_id, user_id, order_id, status, current_step, step, failure_reason, revision, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (saga_id) DO UPDATE SET
+			order_id = EXCLUDED.order_id,
+			status = EXCLUDED.status,
+			current_step = EXCLUDED.current_step,
+			step = EXCLUDED.step,
+			failure_reason = EXCLUDED.failure_reason,
+			revision = EXCLUDED.revision,
+			updated_at = EXCLUDED.updated_at
+		WHERE order_status.revision < EXCLUDED.revision`
+	res, err := conn.ExecContext(
+		ctx,
+		q,
+		status.SagaID,
+		status.UserID,
+		status.OrderID,
+		status.Status,
+		status.CurrentStep,
+		status.Step,
+		status.FailureReason,
+		status.Revision,
+		status.CreatedAt,
+		status.UpdatedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (r *PostgresOrderStatusRepository) FindBySagaID(ctx context.Context, sagaID string) (*model.OrderStatus, error) {
+	var status model.OrderStatus
+	q := `SELECT saga_id, user_id, order_id, status, current_step, step, failure_reason, revision, created_at, updated_at FROM order_status WHERE saga_id = $1`
+	err := r.db.Conn(ctx).QueryRowContext(ctx, q, sagaID).Scan(
+		&status.SagaID,
+		&status.UserID,
+		&status.OrderID,
+		&status.Status,
+		&status.CurrentStep,
+		&status.Step,
+		&status.FailureReason,
+		&status.Revision,
+		&status.CreatedAt,
+		&status.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
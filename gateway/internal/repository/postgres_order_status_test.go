@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"shop/gateway/internal/model"
+	"shop/pkg/tx"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpsertReportsWhetherItStored(t *testing.T) {
+	tests := []struct {
+		name        string
+		affected    int64
+		wantApplied bool
+	}{
+		{name: "newer revision is stored", affected: 1, wantApplied: true},
+		{name: "stale revision is ignored", affected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectExec(`INSERT INTO order_status .* ON CONFLICT \(saga_id\) DO UPDATE SET .* WHERE order_status.revision < EXCLUDED.revision`).
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			repo := NewPostgresOrderStatusRepository(tx.NewManager(db))
+			applied, err := repo.Upsert(context.Background(), &model.OrderStatus{SagaID: "saga-1", Status: model.OrderStatusRunning, Revision: 2})
+			if applied != tt.wantApplied || err != nil {
+				t.Errorf("Upsert = %v, %v, want %v, nil", applied, err, tt.wantApplied)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1 @@
+DROP TABLE inbox;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE order_status;
\ No newline at end of file
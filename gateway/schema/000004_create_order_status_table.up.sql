@@ -0,0 +1,14 @@
+CREATE TABLE order_status
+(
+    saga_id        VARCHAR(255) PRIMARY KEY,
+    user_id        VARCHAR(255) NOT NULL,
+    order_id       VARCHAR(255) NOT NULL,
+    status         VARCHAR(50)  NOT NULL,
+    current_step   INTEGER      NOT NULL,
+    step           VARCHAR(255) NOT NULL,
+    failure_reason TEXT         NOT NULL,
+    created_at     TIMESTAMPTZ  NOT NULL,
+    updated_at     TIMESTAMPTZ  NOT NULL
+);
+
+CREATE INDEX order_status_user_id_index ON order_status (user_id);
\ No newline at end of file
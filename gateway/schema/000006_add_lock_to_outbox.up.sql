@@ -0,0 +1,5 @@
+ALTER TABLE outbox
+    ADD COLUMN locked_at TIMESTAMP    NULL,
+    ADD COLUMN locked_by VARCHAR(255) NULL;
+
+CREATE INDEX outbox_pending_locked_at_index ON outbox (locked_at) WHERE status = 'pending';
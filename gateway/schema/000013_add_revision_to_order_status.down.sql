@@ -0,0 +1 @@
+ALTER TABLE order_status DROP COLUMN revision;
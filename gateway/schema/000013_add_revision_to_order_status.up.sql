@@ -0,0 +1 @@
+ALTER TABLE order_status ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
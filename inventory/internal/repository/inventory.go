@@ -2,9 +2,9 @@ package repository
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"shop/inventory/internal/model"
+	"shop/pkg/tx"
 	"time"
 )
 
@@ -16,21 +16,20 @@ type InventoryRepository interface {
 	Release(ctx context.Context, items []model.Item) error
 }
 
-type PostgresInventoryRepository struct{}
+type PostgresInventoryRepository struct {
+	db tx.Source
+}
 
-func NewPostgresInventoryRepository() *PostgresInventoryRepository {
-	return &PostgresInventoryRepository{}
+func NewPostgresInventoryRepository(db tx.Source) *PostgresInventoryRepository {
+	return &PostgresInventoryRepository{db: db}
 }
 
 func (r *PostgresInventoryRepository) Create(ctx context.Context, inventory model.Inventory) (model.Inventory, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Inventory{}, errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	timeNow := time.Now()
 	q := `INSERT INTO inventory (product_id, quantity, created_at, updated_at) VALUES ($1, $2, $3, $4)`
-	_, err := tx.ExecContext(ctx, q, inventory.ProductID, inventory.Quantity, timeNow, timeNow)
+	_, err := conn.ExecContext(ctx, q, inventory.ProductID, inventory.Quantity, timeNow, timeNow)
 	if err != nil {
 		return model.Inventory{}, err
 	}
@@ -39,13 +38,10 @@ func (r *PostgresInventoryRepository) Create(ctx context.Context, inventory mode
 }
 
 func (r *PostgresInventoryRepository) FindByProductID(ctx context.Context, productID string) (model.Inventory, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Inventory{}, errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 	q := `SELECT product_id, quantity, created_at, updated_at FROM inventory WHERE product_id = $1`
 	var inventory model.Inventory
-	err := tx.QueryRowContext(ctx, q, productID).Scan(
+	err := conn.QueryRowContext(ctx, q, productID).Scan(
 		&inventory.ProductID, &inventory.Quantity, &inventory.CreatedAt, &inventory.UpdatedAt,
 	)
 	if err != nil {
@@ -56,14 +52,11 @@ func (r *PostgresInventoryRepository) FindByProductID(ctx context.Context, produ
 }
 
 func (r *PostgresInventoryRepository) GetAvailableQuantity(ctx context.Context, productID string) (int, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return 0, errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	q := `SELECT quantity FROM inventory WHERE product_id = $1`
 	var quantity int
-	err := tx.QueryRowContext(ctx, q, productID).Scan(&quantity)
+	err := conn.QueryRowContext(ctx, q, productID).Scan(&quantity)
 	if err != nil {
 		return 0, err
 	}
@@ -72,14 +65,11 @@ func (r *PostgresInventoryRepository) GetAvailableQuantity(ctx context.Context,
 }
 
 func (r *PostgresInventoryRepository) Reserve(ctx context.Context, items []model.Item) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	for _, item := range items {
 		q := `UPDATE inventory SET quantity = quantity - $1, updated_at = $2 WHERE product_id = $3 AND quantity >= $1`
-		result, err := tx.ExecContext(ctx, q, item.Quantity, time.Now(), item.ProductID)
+		result, err := conn.ExecContext(ctx, q, item.Quantity, time.Now(), item.ProductID)
 		if err != nil {
 			return err
 		}
@@ -96,14 +86,11 @@ func (r *PostgresInventoryRepository) Reserve(ctx context.Context, items []model
 }
 
 func (r *PostgresInventoryRepository) Release(ctx context.Context, items []model.Item) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	for _, item := range items {
 		q := `UPDATE inventory SET quantity = quantity + $1, updated_at = $2 WHERE product_id = $3`
-		result, err := tx.ExecContext(ctx, q, item.Quantity, time.Now(), item.ProductID)
+		result, err := conn.ExecContext(ctx, q, item.Quantity, time.Now(), item.ProductID)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,11 @@
+CREATE TABLE outbox_archive (LIKE outbox INCLUDING DEFAULTS);
+ALTER TABLE outbox_archive ADD PRIMARY KEY (id);
+ALTER TABLE outbox_archive ADD COLUMN archived_at TIMESTAMP NOT NULL DEFAULT now();
+
+CREATE TABLE inbox_archive (LIKE inbox INCLUDING DEFAULTS);
+ALTER TABLE inbox_archive ADD PRIMARY KEY (message_id);
+ALTER TABLE inbox_archive ADD COLUMN archived_at TIMESTAMP NOT NULL DEFAULT now();
+
+-- retention removes the oldest sent/completed rows first
+CREATE INDEX outbox_status_created_at_index ON outbox (status, created_at);
+CREATE INDEX inbox_status_created_at_index ON inbox (status, created_at);
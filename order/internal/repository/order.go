@@ -2,9 +2,8 @@ package repository
 
 import (
 	"context"
-	"database/sql"
-	"errors"
 	"shop/order/internal/model"
+	"shop/pkg/tx"
 	"time"
 )
 
@@ -14,28 +13,27 @@ type OrderRepository interface {
 	UpdateStatus(ctx context.Context, id string, status model.OrderStatus) error
 }
 
-type PostgresOrderRepository struct{}
+type PostgresOrderRepository struct {
+	db tx.Source
+}
 
-func NewPostgresOrderRepository() *PostgresOrderRepository {
-	return &PostgresOrderRepository{}
+func NewPostgresOrderRepository(db tx.Source) *PostgresOrderRepository {
+	return &PostgresOrderRepository{db: db}
 }
 
 func (p *PostgresOrderRepository) Create(ctx context.Context, order model.Order) (model.Order, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Order{}, errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	timeNow := time.Now()
 	q1 := `INSERT INTO orders (id, user_id, payment_method_id, phone, email, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := tx.ExecContext(ctx, q1, order.ID, order.UserID, order.PaymentMethodID, order.Phone, order.Email, order.Status, timeNow, timeNow)
+	_, err := conn.ExecContext(ctx, q1, order.ID, order.UserID, order.PaymentMethodID, order.Phone, order.Email, order.Status, timeNow, timeNow)
 	if err != nil {
 		return model.Order{}, err
 	}
 
 	for _, item := range order.Items {
 		q2 := `INSERT INTO order_items (id, order_id, product_id, quantity, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)`
-		_, err := tx.ExecContext(ctx, q2, item.ID, item.OrderID, item.ProductID, item.Quantity, timeNow, timeNow)
+		_, err := conn.ExecContext(ctx, q2, item.ID, item.OrderID, item.ProductID, item.Quantity, timeNow, timeNow)
 		if err != nil {
 			return model.Order{}, err
 		}
@@ -45,14 +43,11 @@ func (p *PostgresOrderRepository) Create(ctx context.Context, order model.Order)
 }
 
 func (p *PostgresOrderRepository) FindByID(ctx context.Context, id string) (model.Order, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Order{}, errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	var order model.Order
 	q1 := `SELECT id, user_id, payment_method_id, phone, email, status, created_at, updated_at  FROM orders WHERE id = $1`
-	err := tx.QueryRowContext(ctx, q1, id).Scan(
+	err := conn.QueryRowContext(ctx, q1, id).Scan(
 		&order.ID,
 		&order.UserID,
 		&order.PaymentMethodID,
@@ -68,7 +63,7 @@ func (p *PostgresOrderRepository) FindByID(ctx context.Context, id string) (mode
 
 	var items []model.OrderItem
 	q2 := `SELECT id, order_id, product_id, quantity, created_at, updated_at  FROM order_items WHERE order_id = $1`
-	rows, err := tx.QueryContext(ctx, q2, id)
+	rows, err := conn.QueryContext(ctx, q2, id)
 	defer rows.Close()
 	if err != nil {
 		return model.Order{}, err
@@ -95,14 +90,11 @@ func (p *PostgresOrderRepository) FindByID(ctx context.Context, id string) (mode
 }
 
 func (p *PostgresOrderRepository) UpdateStatus(ctx context.Context, id string, status model.OrderStatus) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	timeNow := time.Now()
 	q := `UPDATE orders SET status = $1, updated_at = $2 WHERE id = $3`
-	_, err := tx.ExecContext(ctx, q, status, timeNow, id)
+	_, err := conn.ExecContext(ctx, q, status, timeNow, id)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS outbox_pending_locked_at_index;
+
+ALTER TABLE outbox
+    DROP COLUMN locked_at,
+    DROP COLUMN locked_by;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS inbox_waiting_aggregate_sequence_index;
+DROP INDEX IF EXISTS inbox_waiting_next_attempt_at_index;
+
+UPDATE inbox SET status = 'error' WHERE status = 'held';
+
+CREATE INDEX inbox_error_next_attempt_at_index ON inbox (next_attempt_at) WHERE status = 'error';
+CREATE INDEX inbox_error_aggregate_sequence_index ON inbox (topic, aggregate_id, sequence) WHERE status = 'error';
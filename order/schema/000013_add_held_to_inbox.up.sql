@@ -0,0 +1,7 @@
+-- held messages wait for the message before them like failed ones wait for
+-- their retry, the worker finds both by next_attempt_at
+DROP INDEX IF EXISTS inbox_error_next_attempt_at_index;
+DROP INDEX IF EXISTS inbox_error_aggregate_sequence_index;
+
+CREATE INDEX inbox_waiting_next_attempt_at_index ON inbox (next_attempt_at) WHERE status IN ('error', 'held');
+CREATE INDEX inbox_waiting_aggregate_sequence_index ON inbox (topic, aggregate_id, sequence) WHERE status IN ('error', 'held');
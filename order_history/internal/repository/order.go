@@ -2,10 +2,9 @@ package repository
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"shop/order_history/internal/model"
+	"shop/pkg/tx"
 )
 
 type OrderRepository interface {
@@ -16,20 +15,17 @@ type OrderRepository interface {
 }
 
 type PostgresOrderRepository struct {
-	db *sql.DB
+	db tx.Source
 }
 
-func NewPostgresOrderRepository(db *sql.DB) *PostgresOrderRepository {
+func NewPostgresOrderRepository(db tx.Source) *PostgresOrderRepository {
 	return &PostgresOrderRepository{
 		db: db,
 	}
 }
 
 func (o *PostgresOrderRepository) Create(ctx context.Context, order *model.Order) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := o.db.Conn(ctx)
 
 	itemsJson, err := json.Marshal(order.OrderItems)
 	if err != nil {
@@ -37,7 +33,7 @@ func (o *PostgresOrderRepository) Create(ctx context.Context, order *model.Order
 	}
 
 	query := `INSERT INTO order_history (id, user_id, order_items, payment_id, payment_method_id, payment_type, payment_gateway, payment_sum, payment_external_id, payment_status, status, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
-	_, err = tx.ExecContext(
+	_, err = conn.ExecContext(
 		ctx,
 		query,
 		order.ID,
@@ -62,16 +58,13 @@ func (o *PostgresOrderRepository) Create(ctx context.Context, order *model.Order
 }
 
 func (o *PostgresOrderRepository) FindByID(ctx context.Context, id string) (*model.Order, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return nil, errors.New("transaction not found in context")
-	}
+	conn := o.db.Conn(ctx)
 
 	var order model.Order
 	var itemsJson []byte
 
 	query := `SELECT id, user_id, order_items, payment_id, payment_method_id, payment_type, payment_gateway, payment_sum, payment_external_id, payment_status, status, created_at, updated_at FROM order_history WHERE id = $1`
-	err := tx.QueryRowContext(ctx, query, id).Scan(
+	err := conn.QueryRowContext(ctx, query, id).Scan(
 		&order.ID,
 		&order.UserID,
 		&itemsJson,
@@ -96,10 +89,7 @@ func (o *PostgresOrderRepository) FindByID(ctx context.Context, id string) (*mod
 }
 
 func (o *PostgresOrderRepository) Update(ctx context.Context, order *model.Order) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := o.db.Conn(ctx)
 
 	itemsJson, err := json.Marshal(order.OrderItems)
 	if err != nil {
@@ -107,7 +97,7 @@ func (o *PostgresOrderRepository) Update(ctx context.Context, order *model.Order
 	}
 
 	query := `UPDATE order_history SET user_id = $1, order_items = $2, payment_id = $3, payment_method_id = $4, payment_type = $5, payment_gateway = $6, payment_sum = $7, payment_external_id = $8, payment_status = $9, status = $10, created_at = $11, updated_at = $12 WHERE id = $13`
-	_, err = tx.ExecContext(
+	_, err = conn.ExecContext(
 		ctx,
 		query,
 		order.UserID,
@@ -137,7 +127,7 @@ func (o *PostgresOrderRepository) GetByUserID(ctx context.Context, userID string
 	offset := (page - 1) * limit
 
 	query := `SELECT id, user_id, order_items, payment_id, payment_method_id, payment_type, payment_gateway, payment_sum, payment_external_id, payment_status, status, created_at, updated_at FROM order_history WHERE user_id = $1 ORDER BY created_at DESC OFFSET $2 LIMIT $3`
-	rows, err := o.db.QueryContext(ctx, query, userID, offset, limit)
+	rows, err := o.db.Conn(ctx).QueryContext(ctx, query, userID, offset, limit)
 	if err != nil {
 		return nil, err
 	}
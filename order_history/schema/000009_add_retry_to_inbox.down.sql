@@ -0,0 +1,13 @@
+DROP INDEX IF EXISTS inbox_error_next_attempt_at_index;
+
+ALTER TABLE inbox_archive
+    DROP COLUMN headers,
+    DROP COLUMN attempts,
+    DROP COLUMN last_error,
+    DROP COLUMN next_attempt_at;
+
+ALTER TABLE inbox
+    DROP COLUMN headers,
+    DROP COLUMN attempts,
+    DROP COLUMN last_error,
+    DROP COLUMN next_attempt_at;
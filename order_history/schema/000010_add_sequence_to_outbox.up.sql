@@ -0,0 +1,17 @@
+ALTER TABLE outbox
+    ADD COLUMN aggregate_id TEXT   NULL,
+    ADD COLUMN sequence     BIGINT NULL;
+
+ALTER TABLE outbox_archive
+    ADD COLUMN aggregate_id TEXT   NULL,
+    ADD COLUMN sequence     BIGINT NULL;
+
+-- last sequence number given to a message of the aggregate on the topic
+CREATE TABLE outbox_sequences
+(
+    topic        TEXT      NOT NULL,
+    aggregate_id TEXT      NOT NULL,
+    sequence     BIGINT    NOT NULL,
+    updated_at   TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (topic, aggregate_id)
+);
@@ -0,0 +1,20 @@
+ALTER TABLE inbox
+    ADD COLUMN aggregate_id TEXT   NULL,
+    ADD COLUMN sequence     BIGINT NULL;
+
+ALTER TABLE inbox_archive
+    ADD COLUMN aggregate_id TEXT   NULL,
+    ADD COLUMN sequence     BIGINT NULL;
+
+-- last sequence number handled for the aggregate on the topic
+CREATE TABLE inbox_sequences
+(
+    topic        TEXT      NOT NULL,
+    aggregate_id TEXT      NOT NULL,
+    sequence     BIGINT    NOT NULL,
+    updated_at   TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (topic, aggregate_id)
+);
+
+-- messages held until the one before them is handled
+CREATE INDEX inbox_error_aggregate_sequence_index ON inbox (topic, aggregate_id, sequence) WHERE status = 'error';
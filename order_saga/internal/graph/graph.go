@@ -0,0 +1,145 @@
+// Package graph renders saga definitions and saga instances as Mermaid or
+// Graphviz diagrams, built from the same step definitions the orchestrator runs.
+package graph
+
+import (
+	"fmt"
+	"shop/order_saga/internal/model"
+)
+
+type NodeKind string
+
+const (
+	NodeTerminal   NodeKind = "terminal"
+	NodeCommand    NodeKind = "command"
+	NodeCompensate NodeKind = "compensate"
+)
+
+type EdgeKind string
+
+const (
+	EdgeSuccess EdgeKind = "success"
+	EdgeFailure EdgeKind = "failure"
+)
+
+type Node struct {
+	ID      string
+	Label   string
+	Kind    NodeKind
+	Status  model.StepStatus
+	Current bool
+}
+
+type Edge struct {
+	From  string
+	To    string
+	Label string
+	Kind  EdgeKind
+}
+
+type Graph struct {
+	Title string
+	Nodes []Node
+	Edges []Edge
+}
+
+const (
+	startNode              = "start"
+	completedNode          = "completed"
+	compensatedNode        = "compensated"
+	compensationFailedNode = "compensation_failed"
+)
+
+// Build turns a definition into a graph. When s is not nil, the step statuses
+// and the current step of that saga are attached to the nodes.
+func Build(def model.Definition, s *model.Saga) Graph {
+	g := Graph{Title: fmt.Sprintf("%s v%d", def.Name, def.Version)}
+	if s != nil {
+		g.Title = fmt.Sprintf("%s v%d saga %s (%s)", def.Name, def.Version, s.ID, s.Status)
+	}
+
+	g.Nodes = append(g.Nodes, Node{ID: startNode, Label: "start", Kind: NodeTerminal})
+	hasCompensation := false
+
+	for i, step := range def.Steps {
+		node := Node{
+			ID:    commandNodeID(i),
+			Label: fmt.Sprintf("%s\n%s", step.Command, step.CommandTopic),
+			Kind:  NodeCommand,
+		}
+		if s != nil && i < len(s.Steps) {
+			node.Status = s.Steps[i].CommandStatus
+			node.Current = i == s.CurrentStep && !s.Compensating
+		}
+		g.Nodes = append(g.Nodes, node)
+
+		if step.Compensate == "" {
+			continue
+		}
+		hasCompensation = true
+		node = Node{
+			ID:    compensateNodeID(i),
+			Label: fmt.Sprintf("%s\n%s", step.Compensate, step.CommandTopic),
+			Kind:  NodeCompensate,
+		}
+		if s != nil && i < len(s.Steps) {
+			node.Status = s.Steps[i].CompensateStatus
+			node.Current = i == s.CurrentStep && s.Compensating
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+
+	g.Nodes = append(g.Nodes,
+		Node{ID: completedNode, Label: string(model.StatusCompleted), Kind: NodeTerminal, Current: s != nil && s.Status == model.StatusCompleted},
+		Node{ID: compensatedNode, Label: string(model.StatusCompensated), Kind: NodeTerminal, Current: s != nil && s.Status == model.StatusCompensated},
+	)
+	if hasCompensation {
+		g.Nodes = append(g.Nodes, Node{ID: compensationFailedNode, Label: "compensation failed", Kind: NodeTerminal})
+	}
+
+	if len(def.Steps) == 0 {
+		g.Edges = append(g.Edges, Edge{From: startNode, To: completedNode, Kind: EdgeSuccess})
+		return g
+	}
+	g.Edges = append(g.Edges, Edge{From: startNode, To: commandNodeID(0), Kind: EdgeSuccess})
+
+	for i, step := range def.Steps {
+		next := completedNode
+		if i+1 < len(def.Steps) {
+			next = commandNodeID(i + 1)
+		}
+		g.Edges = append(g.Edges,
+			Edge{From: commandNodeID(i), To: next, Label: string(step.CommandSuccessEvent), Kind: EdgeSuccess},
+			Edge{From: commandNodeID(i), To: compensationBelow(def, i), Label: string(step.CommandFailEvent), Kind: EdgeFailure},
+		)
+
+		if step.Compensate == "" {
+			continue
+		}
+		g.Edges = append(g.Edges,
+			Edge{From: compensateNodeID(i), To: compensationBelow(def, i), Label: string(step.CompensateSuccessEvent), Kind: EdgeSuccess},
+			Edge{From: compensateNodeID(i), To: compensationFailedNode, Label: string(step.CompensateFailEvent), Kind: EdgeFailure},
+		)
+	}
+
+	return g
+}
+
+// compensationBelow is where compensation continues after step i: the nearest
+// earlier step with a compensating command, the same walk the orchestrator does.
+func compensationBelow(def model.Definition, i int) string {
+	for j := i - 1; j >= 0; j-- {
+		if def.Steps[j].Compensate != "" {
+			return compensateNodeID(j)
+		}
+	}
+	return compensatedNode
+}
+
+func commandNodeID(i int) string {
+	return fmt.Sprintf("step%d", i)
+}
+
+func compensateNodeID(i int) string {
+	return fmt.Sprintf("compensate%d", i)
+}
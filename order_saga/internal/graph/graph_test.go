@@ -0,0 +1,103 @@
+package graph
+
+import (
+	"shop/order_saga/internal/model"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"strings"
+	"testing"
+)
+
+// testDefinition has a step with and a step without compensation.
+var testDefinition = model.Definition{
+	Name:    "test",
+	Version: 1,
+	Steps: []model.Step{
+		{
+			Command:                command.Type("ReserveInventory"),
+			CommandSuccessEvent:    event.Type("InventoryReserved"),
+			CommandFailEvent:       event.Type("InventoryReserveFailed"),
+			Compensate:             command.Type("ReleaseInventory"),
+			CompensateSuccessEvent: event.Type("InventoryReleased"),
+			CompensateFailEvent:    event.Type("InventoryReleaseFailed"),
+			CommandTopic:           "inventory-commands",
+		},
+		{
+			Command:             command.Type("ProcessPayment"),
+			CommandSuccessEvent: event.Type("PaymentProcessed"),
+			CommandFailEvent:    event.Type("PaymentFailed"),
+			CommandTopic:        "payment-commands",
+		},
+	},
+}
+
+func TestMermaid(t *testing.T) {
+	want := `---
+title: test v1
+---
+flowchart TD
+    start(["start"])
+    step0["ReserveInventory<br/>inventory-commands"]
+    compensate0[/"ReleaseInventory<br/>inventory-commands"/]
+    step1["ProcessPayment<br/>payment-commands"]
+    completed(["completed"])
+    compensated(["compensated"])
+    compensation_failed(["compensation failed"])
+    start --> step0
+    step0 -->|InventoryReserved| step1
+    step0 -.->|InventoryReserveFailed| compensated
+    compensate0 -->|InventoryReleased| compensated
+    compensate0 -.->|InventoryReleaseFailed| compensation_failed
+    step1 -->|PaymentProcessed| completed
+    step1 -.->|PaymentFailed| compensate0
+    classDef running fill:#fff3b0
+    classDef completed fill:#c8f7c5
+    classDef failed fill:#f7c5c5
+    classDef skipped fill:#e0e0e0
+    classDef current stroke:#d00,stroke-width:3px
+`
+
+	got := Mermaid(Build(testDefinition, nil))
+	if got != want {
+		t.Errorf("Mermaid() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDOTOfSaga(t *testing.T) {
+	s := &model.Saga{
+		ID:           "saga-1",
+		Status:       model.StatusCompensating,
+		CurrentStep:  0,
+		Compensating: true,
+		Steps: []model.Step{
+			{CommandStatus: model.StepStatusCompleted, CompensateStatus: model.StepStatusRunning},
+			{CommandStatus: model.StepStatusFailed},
+		},
+	}
+
+	got := DOT(Build(testDefinition, s))
+	for _, line := range []string{
+		`label="test v1 saga saga-1 (compensating)";`,
+		`step0 [label="ReserveInventory\ninventory-commands", shape=box, style=filled, fillcolor="#c8f7c5"];`,
+		`compensate0 [label="ReleaseInventory\ninventory-commands", shape=parallelogram, style=filled, fillcolor="#fff3b0", color="#dd0000", penwidth=3];`,
+		`step1 [label="ProcessPayment\npayment-commands", shape=box, style=filled, fillcolor="#f7c5c5"];`,
+		`step1 -> compensate0 [label="PaymentFailed", style=dashed, color="#aa0000"];`,
+	} {
+		if !strings.Contains(got, "    "+line+"\n") {
+			t.Errorf("DOT() has no line %s:\n%s", line, got)
+		}
+	}
+}
+
+func TestBuildWithoutSteps(t *testing.T) {
+	g := Build(model.Definition{Name: "empty", Version: 1}, nil)
+
+	if len(g.Edges) != 1 || g.Edges[0] != (Edge{From: startNode, To: completedNode, Kind: EdgeSuccess}) {
+		t.Errorf("edges = %+v, want start to completed", g.Edges)
+	}
+	for _, n := range g.Nodes {
+		if n.ID == compensationFailedNode {
+			t.Error("graph without compensation has a compensation failed node")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package graph
+
+import (
+	"fmt"
+	"shop/order_saga/internal/model"
+	"strings"
+)
+
+var statusColors = map[model.StepStatus]string{
+	model.StepStatusRunning:   "#fff3b0",
+	model.StepStatusCompleted: "#c8f7c5",
+	model.StepStatusFailed:    "#f7c5c5",
+	model.StepStatusSkipped:   "#e0e0e0",
+}
+
+func Mermaid(g Graph) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "---\ntitle: %s\n---\n", g.Title)
+	b.WriteString("flowchart TD\n")
+
+	for _, n := range g.Nodes {
+		label := strings.ReplaceAll(n.Label, "\n", "<br/>")
+		switch n.Kind {
+		case NodeTerminal:
+			fmt.Fprintf(&b, "    %s([\"%s\"])\n", n.ID, label)
+		case NodeCompensate:
+			fmt.Fprintf(&b, "    %s[/\"%s\"/]\n", n.ID, label)
+		default:
+			fmt.Fprintf(&b, "    %s[\"%s\"]\n", n.ID, label)
+		}
+	}
+
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Kind == EdgeFailure {
+			arrow = "-.->"
+		}
+		if e.Label == "" {
+			fmt.Fprintf(&b, "    %s %s %s\n", e.From, arrow, e.To)
+			continue
+		}
+		fmt.Fprintf(&b, "    %s %s|%s| %s\n", e.From, arrow, e.Label, e.To)
+	}
+
+	for _, status := range []model.StepStatus{model.StepStatusRunning, model.StepStatusCompleted, model.StepStatusFailed, model.StepStatusSkipped} {
+		fmt.Fprintf(&b, "    classDef %s fill:%s\n", status, statusColors[status])
+	}
+	b.WriteString("    classDef current stroke:#d00,stroke-width:3px\n")
+
+	for _, n := range g.Nodes {
+		if _, ok := statusColors[n.Status]; ok {
+			fmt.Fprintf(&b, "    class %s %s\n", n.ID, n.Status)
+		}
+		if n.Current {
+			fmt.Fprintf(&b, "    class %s current\n", n.ID)
+		}
+	}
+
+	return b.String()
+}
+
+func DOT(g Graph) string {
+	var b strings.Builder
+
+	b.WriteString("digraph saga {\n")
+	fmt.Fprintf(&b, "    label=%q;\n    labelloc=t;\n    rankdir=TB;\n", g.Title)
+
+	for _, n := range g.Nodes {
+		attrs := []string{fmt.Sprintf("label=%q", n.Label)}
+		switch n.Kind {
+		case NodeTerminal:
+			attrs = append(attrs, "shape=oval")
+		case NodeCompensate:
+			attrs = append(attrs, "shape=parallelogram")
+		default:
+			attrs = append(attrs, "shape=box")
+		}
+		if color, ok := statusColors[n.Status]; ok {
+			attrs = append(attrs, "style=filled", fmt.Sprintf("fillcolor=%q", color))
+		}
+		if n.Current {
+			attrs = append(attrs, "color=\"#dd0000\"", "penwidth=3")
+		}
+		fmt.Fprintf(&b, "    %s [%s];\n", n.ID, strings.Join(attrs, ", "))
+	}
+
+	for _, e := range g.Edges {
+		attrs := []string{fmt.Sprintf("label=%q", e.Label)}
+		if e.Kind == EdgeFailure {
+			attrs = append(attrs, "style=dashed", "color=\"#aa0000\"")
+		}
+		fmt.Fprintf(&b, "    %s -> %s [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+	}
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
@@ -2,117 +2,44 @@ package handler
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"log"
+	"shop/order_saga/internal/model"
 	"shop/order_saga/internal/orchestrator"
 	"shop/pkg/broker"
 	"shop/pkg/event"
-	"shop/pkg/inbox"
-	"shop/pkg/outbox"
-	"time"
 )
 
 type EventHandler struct {
-	db           *sql.DB
 	orchestrator *orchestrator.Orchestrator
-	inbox        inbox.Inbox
-	outbox       outbox.Outbox
 	logger       *log.Logger
 }
 
-func NewEventHandler(db *sql.DB, orchestrator *orchestrator.Orchestrator, inbox inbox.Inbox, outbox outbox.Outbox, logger *log.Logger) *EventHandler {
+func NewEventHandler(orchestrator *orchestrator.Orchestrator, logger *log.Logger) *EventHandler {
 	return &EventHandler{
-		db:           db,
 		orchestrator: orchestrator,
-		inbox:        inbox,
-		outbox:       outbox,
 		logger:       logger,
 	}
 }
 
-func (h *EventHandler) Handle(message broker.Message) error {
-	h.logger.Printf("Handling message %s from %s", message.Key, message.Topic)
-	h.logger.Println(string(message.Value))
-
-	var e event.Event
-	err := json.Unmarshal(message.Value, &e)
-	if err != nil {
-		h.logger.Printf("Error unmarshalling command: %s", err)
-	}
-	h.logger.Printf("Handling event: %+v", e)
-
-	tx, err := h.db.Begin()
-	if err != nil {
-		h.logger.Println("Failed to begin transaction", "error", err)
-		return err
+// Register routes every reply event of the loaded saga definitions on topics
+// to the orchestrator.
+func (h *EventHandler) Register(router *broker.Router, definitions *model.Registry, topics ...string) {
+	var types []string
+	for _, t := range definitions.ReplyEvents() {
+		types = append(types, string(t))
 	}
-	defer tx.Rollback()
-
-	ctxWithTx := context.WithValue(context.Background(), "tx", tx)
-
-	exists, err := h.inbox.Exists(ctxWithTx, e.ID)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		h.logger.Printf("Failed to check if the message %s exists: %s", e.ID, err)
-		return err
-	}
-
-	if exists {
-		h.logger.Println("Ignore existing message")
-		return nil
-	} else {
-		h.logger.Println("Message not exists")
-		// store to inbox
-		inboxMessage := inbox.Message{
-			MessageID:   e.ID,
-			MessageType: string(e.Type),
-			Topic:       message.Topic,
-			Key:         message.Key,
-			Payload:     message.Value,
-			Status:      inbox.StatusPending,
-			CreatedAt:   time.Now(),
-		}
-		err = h.inbox.Store(ctxWithTx, inboxMessage)
-		if err != nil {
-			h.logger.Printf("Error storing inbox message: %s", err)
-			return err
-		}
-		h.logger.Printf("Successfully stored inbox message: %+v", inboxMessage)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		h.logger.Println("Failed to commit transaction", "error", err)
-		return err
+	for _, topic := range topics {
+		router.Handle(topic, broker.Event(h.handleReply), types...)
 	}
+}
 
-	tx, err = h.db.Begin()
-	if err != nil {
-		h.logger.Println("Failed to begin transaction", "error", err)
-		return err
-	}
-	defer tx.Rollback()
-
-	ctxWithTx = context.WithValue(context.Background(), "tx", tx)
-
-	err = h.orchestrator.HandleEvent(ctxWithTx, e)
+func (h *EventHandler) handleReply(ctx context.Context, e event.Event, _ json.RawMessage) error {
+	err := h.orchestrator.HandleEvent(ctx, e)
 	if err != nil {
 		h.logger.Printf("Error orc handling event: %s", err)
 		return err
 	}
 
-	err = h.inbox.MarkAsCompleted(ctxWithTx, e.ID)
-	if err != nil {
-		h.logger.Printf("failed to mark as completed: %s", err)
-		return err
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		h.logger.Println("failed to commit transaction", "error", err)
-		return err
-	}
-
 	return nil
 }
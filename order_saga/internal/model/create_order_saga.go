@@ -3,83 +3,95 @@ package model
 import (
 	"shop/pkg/command"
 	"shop/pkg/event"
+	"shop/pkg/topology"
 	"shop/pkg/types"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-func NewCreateOrderSaga(userID string, items []types.Item, paymentMethod string) *Saga {
-	steps := []Step{
+const CreateOrderSagaName = "create_order"
+
+// CreateOrderSagaDefinitions lists every version that may still have sagas in
+// flight. Add a new version instead of editing a released one, and drop an old
+// version only when the admin versions command shows no active sagas for it.
+var CreateOrderSagaDefinitions = []Definition{
+	{
+		Name:    CreateOrderSagaName,
+		Version: 1,
+		Steps:   createOrderSagaStepsV1(),
+	},
+}
+
+func createOrderSagaStepsV1() []Step {
+	return []Step{
 		// create order
 		{
 			Command:                command.CreateOrder,
-			CommandStatus:          StepStatusInit,
 			CommandSuccessEvent:    event.OrderCreated,
 			CommandFailEvent:       event.OrderCreateFailed,
 			Compensate:             command.CancelOrder,
-			CompensateStatus:       StepStatusInit,
 			CompensateSuccessEvent: event.OrderCancelled,
 			CompensateFailEvent:    event.OrderCancelFailed,
-			CommandTopic:           "order-commands",
+			CommandTopic:           topology.OrderCommands,
 		},
 		// validate products
 		{
 			Command:                command.ValidateProducts,
-			CommandStatus:          StepStatusInit,
 			CommandSuccessEvent:    event.ProductsValidated,
 			CommandFailEvent:       event.ProductsValidationFailed,
 			Compensate:             "",
-			CompensateStatus:       "",
 			CompensateSuccessEvent: "",
 			CompensateFailEvent:    "",
-			CommandTopic:           "product-commands",
+			CommandTopic:           topology.ProductCommands,
 		},
 		// reserve inventory
 		{
 			Command:                command.ReserveInventory,
-			CommandStatus:          StepStatusInit,
 			CommandSuccessEvent:    event.InventoryReserved,
 			CommandFailEvent:       event.InventoryReserveFailed,
 			Compensate:             command.ReleaseInventory,
-			CompensateStatus:       StepStatusInit,
 			CompensateSuccessEvent: event.InventoryReleased,
 			CompensateFailEvent:    event.InventoryReleaseFailed,
-			CommandTopic:           "inventory-commands",
+			CommandTopic:           topology.InventoryCommands,
 		},
 		// process payment
 		{
 			Command:                command.ProcessPayment,
-			CommandStatus:          StepStatusInit,
 			CommandSuccessEvent:    event.PaymentCompleted,
 			CommandFailEvent:       event.PaymentFailed,
 			Compensate:             command.RefundPayment,
-			CompensateStatus:       StepStatusInit,
 			CompensateSuccessEvent: event.PaymentRefunded,
 			CompensateFailEvent:    event.PaymentRefundFailed,
-			CommandTopic:           "payment-commands",
+			CommandTopic:           topology.PaymentCommands,
 		},
 		// complete order
 		{
 			Command:                command.CompleteOrder,
-			CommandStatus:          StepStatusInit,
 			CommandSuccessEvent:    event.OrderCompleted,
 			CommandFailEvent:       event.OrderCompleteFailed,
 			Compensate:             "",
-			CompensateStatus:       "",
 			CompensateSuccessEvent: "",
 			CompensateFailEvent:    "",
-			CommandTopic:           "order-commands",
+			CommandTopic:           topology.OrderCommands,
 		},
 	}
+}
+
+func NewCreateOrderSaga(def Definition, id string, userID string, items []types.Item, paymentMethod string) *Saga {
+	if id == "" {
+		id = uuid.New().String()
+	}
 
 	timeNow := time.Now()
 
 	return &Saga{
-		ID:          uuid.New().String(),
+		ID:          id,
 		CurrentStep: 0,
+		Definition:  def.Name,
+		Version:     def.Version,
 		Status:      StatusInit,
-		Steps:       steps,
+		Steps:       def.NewSteps(),
 		Payload: types.SagaPayload{
 			UserID:          userID,
 			OrderItems:      items,
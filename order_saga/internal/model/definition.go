@@ -0,0 +1,186 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"shop/pkg/event"
+	"sort"
+	"sync"
+)
+
+var ErrDefinitionNotFound = errors.New("saga definition not found")
+
+// Definition is one version of a saga's step list. Sagas record the name and
+// version they started with, so a definition stays registered until no saga of
+// that version is left in flight.
+type Definition struct {
+	Name    string
+	Version int
+	Steps   []Step
+}
+
+// NewSteps returns a fresh copy of the steps for a new saga.
+func (d Definition) NewSteps() []Step {
+	steps := make([]Step, len(d.Steps))
+	copy(steps, d.Steps)
+	for i := range steps {
+		steps[i].CommandStatus = StepStatusInit
+		if steps[i].Compensate != "" {
+			steps[i].CompensateStatus = StepStatusInit
+		}
+	}
+	return steps
+}
+
+// Bind takes the step definitions from d and the step statuses from the saga row.
+func (d Definition) Bind(s *Saga) error {
+	if len(s.Steps) != len(d.Steps) {
+		return fmt.Errorf("saga %s has %d steps, definition %s v%d has %d", s.ID, len(s.Steps), d.Name, d.Version, len(d.Steps))
+	}
+
+	steps := make([]Step, len(d.Steps))
+	copy(steps, d.Steps)
+	for i := range steps {
+		steps[i].CommandStatus = s.Steps[i].CommandStatus
+		steps[i].CompensateStatus = s.Steps[i].CompensateStatus
+	}
+	s.Steps = steps
+
+	return nil
+}
+
+// CanMigrate reports whether a saga can move to target. Only running sagas
+// whose executed steps are identical in both versions are safe to move: the
+// replies they wait for and the compensations they may need stay the same.
+func (d Definition) CanMigrate(s *Saga, target Definition) error {
+	if s.Definition != d.Name || s.Version != d.Version {
+		return fmt.Errorf("saga %s is %s v%d, not %s v%d", s.ID, s.Definition, s.Version, d.Name, d.Version)
+	}
+	if target.Name != d.Name {
+		return fmt.Errorf("cannot migrate %s saga to %s", d.Name, target.Name)
+	}
+	if s.Status != StatusInit && s.Status != StatusRunning {
+		return fmt.Errorf("saga %s is %s", s.ID, s.Status)
+	}
+	if s.Compensating {
+		return fmt.Errorf("saga %s is compensating", s.ID)
+	}
+	if s.CurrentStep >= len(target.Steps) {
+		return fmt.Errorf("saga %s is at step %d, %s v%d has %d steps", s.ID, s.CurrentStep, target.Name, target.Version, len(target.Steps))
+	}
+	for i := 0; i <= s.CurrentStep && i < len(d.Steps); i++ {
+		if !d.Steps[i].sameDefinition(target.Steps[i]) {
+			return fmt.Errorf("step %d (%s) differs between v%d and v%d", i, d.Steps[i].Command, d.Version, target.Version)
+		}
+	}
+
+	return nil
+}
+
+// Migrate moves the saga to target, keeping the statuses of the executed steps.
+func (d Definition) Migrate(s *Saga, target Definition) error {
+	err := d.CanMigrate(s, target)
+	if err != nil {
+		return err
+	}
+
+	steps := target.NewSteps()
+	for i := 0; i <= s.CurrentStep; i++ {
+		steps[i].CommandStatus = s.Steps[i].CommandStatus
+		steps[i].CompensateStatus = s.Steps[i].CompensateStatus
+	}
+	s.Steps = steps
+	s.Version = target.Version
+
+	return nil
+}
+
+type Registry struct {
+	mu          sync.RWMutex
+	definitions map[string]map[int]Definition
+}
+
+func NewRegistry(definitions ...Definition) *Registry {
+	r := &Registry{definitions: make(map[string]map[int]Definition)}
+	for _, d := range definitions {
+		r.Register(d)
+	}
+	return r
+}
+
+func (r *Registry) Register(d Definition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.definitions[d.Name]; !ok {
+		r.definitions[d.Name] = make(map[int]Definition)
+	}
+	r.definitions[d.Name][d.Version] = d
+}
+
+func (r *Registry) Get(name string, version int) (Definition, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	d, ok := r.definitions[name][version]
+	if !ok {
+		return Definition{}, fmt.Errorf("%w: %s v%d", ErrDefinitionNotFound, name, version)
+	}
+	return d, nil
+}
+
+func (r *Registry) Latest(name string) (Definition, error) {
+	versions := r.Versions(name)
+	if len(versions) == 0 {
+		return Definition{}, fmt.Errorf("%w: %s", ErrDefinitionNotFound, name)
+	}
+	return r.Get(name, versions[len(versions)-1])
+}
+
+// Versions returns the loaded versions of a definition in ascending order.
+func (r *Registry) Versions(name string) []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var versions []int
+	for v := range r.definitions[name] {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// ReplyEvents returns every event type a step of a loaded definition waits
+// for, in a stable order.
+func (r *Registry) ReplyEvents() []event.Type {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[event.Type]bool)
+	var types []event.Type
+	for _, versions := range r.definitions {
+		for _, d := range versions {
+			for _, step := range d.Steps {
+				for _, t := range []event.Type{step.CommandSuccessEvent, step.CommandFailEvent, step.CompensateSuccessEvent, step.CompensateFailEvent} {
+					if t != "" && !seen[t] {
+						seen[t] = true
+						types = append(types, t)
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+func (s Step) sameDefinition(o Step) bool {
+	return s.Command == o.Command &&
+		s.CommandSuccessEvent == o.CommandSuccessEvent &&
+		s.CommandFailEvent == o.CommandFailEvent &&
+		s.Compensate == o.Compensate &&
+		s.CompensateSuccessEvent == o.CompensateSuccessEvent &&
+		s.CompensateFailEvent == o.CompensateFailEvent &&
+		s.CommandTopic == o.CommandTopic
+}
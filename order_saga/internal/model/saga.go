@@ -16,14 +16,20 @@ const (
 )
 
 type Saga struct {
-	ID           string            `json:"id"`
-	CurrentStep  int               `json:"current_step"`
-	Status       Status            `json:"status"`
-	Steps        []Step            `json:"steps"`
-	Payload      types.SagaPayload `json:"payload"`
-	Compensating bool              `json:"compensating"`
-	CreatedAt    time.Time         `json:"created_at"`
-	UpdatedAt    time.Time         `json:"updated_at"`
+	ID            string            `json:"id"`
+	Definition    string            `json:"definition"`
+	Version       int               `json:"version"`
+	CurrentStep   int               `json:"current_step"`
+	Status        Status            `json:"status"`
+	Steps         []Step            `json:"steps"`
+	Payload       types.SagaPayload `json:"payload"`
+	Compensating  bool              `json:"compensating"`
+	FailureReason string            `json:"failure_reason"`
+	// Revision counts the saved changes of the saga, it orders the status
+	// events of one saga for their consumers.
+	Revision  int64     `json:"revision"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 //type SagaPayload struct {
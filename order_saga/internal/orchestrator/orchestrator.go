@@ -7,9 +7,11 @@ import (
 	"log"
 	"shop/order_saga/internal/model"
 	"shop/order_saga/internal/repository"
+	"shop/pkg/broker"
 	"shop/pkg/command"
 	"shop/pkg/event"
 	"shop/pkg/outbox"
+	"shop/pkg/topology"
 	"shop/pkg/types"
 	"time"
 
@@ -17,16 +19,18 @@ import (
 )
 
 type Orchestrator struct {
-	repo   repository.Repository
-	outbox outbox.Outbox
-	logger *log.Logger
+	repo        repository.Repository
+	outbox      outbox.Outbox
+	definitions *model.Registry
+	logger      *log.Logger
 }
 
-func NewOrchestrator(repo repository.Repository, outbox outbox.Outbox, logger *log.Logger) *Orchestrator {
+func NewOrchestrator(repo repository.Repository, outbox outbox.Outbox, definitions *model.Registry, logger *log.Logger) *Orchestrator {
 	return &Orchestrator{
-		repo:   repo,
-		outbox: outbox,
-		logger: logger,
+		repo:        repo,
+		outbox:      outbox,
+		definitions: definitions,
+		logger:      logger,
 	}
 }
 
@@ -44,6 +48,11 @@ func (o *Orchestrator) StartSaga(ctx context.Context, s *model.Saga) error {
 		return err
 	}
 
+	err = o.publishStatus(ctx, s)
+	if err != nil {
+		return err
+	}
+
 	o.logger.Println("Saga started")
 	return nil
 }
@@ -92,6 +101,7 @@ func (o *Orchestrator) executeNextStep(ctx context.Context, s *model.Saga) error
 		Topic:     currentStep.CommandTopic,
 		Key:       s.ID,
 		Payload:   cmd,
+		Headers:   o.headers(ctx, string(cmd.Type), cmd.ID, s.ID),
 		Status:    outbox.StatusInit,
 		CreatedAt: time.Now(),
 	}
@@ -151,6 +161,7 @@ func (o *Orchestrator) compensateNextStep(ctx context.Context, s *model.Saga) er
 		Topic:     currentStep.CommandTopic,
 		Key:       s.ID,
 		Payload:   cmd,
+		Headers:   o.headers(ctx, string(cmd.Type), cmd.ID, s.ID),
 		Status:    outbox.StatusInit,
 		CreatedAt: time.Now(),
 	}
@@ -198,6 +209,7 @@ func (o *Orchestrator) handleFailReply(ctx context.Context, s *model.Saga, e eve
 	o.logger.Println("Saga start handle fail event: ", e)
 
 	if !s.Compensating {
+		s.FailureReason = o.failureReason(e)
 		err := o.StartCompensating(ctx, s)
 		if err != nil {
 			return err
@@ -246,6 +258,11 @@ func (o *Orchestrator) handleFailCompensatingReply(ctx context.Context, s *model
 	o.logger.Println("Saga start handle fail compensating event: ", e)
 
 	// TODO retry ?
+	s.FailureReason = "compensation failed: " + o.failureReason(e)
+	err := o.repo.Update(ctx, s)
+	if err != nil {
+		return err
+	}
 
 	o.logger.Println("Saga finish handle fail compensating event: ", e)
 	return nil
@@ -259,6 +276,21 @@ func (o *Orchestrator) HandleEvent(ctx context.Context, event event.Event) error
 		return err
 	}
 
+	// steps are driven by the definition version the saga started with
+	def, err := o.definitions.Get(s.Definition, s.Version)
+	if err != nil {
+		return err
+	}
+	err = def.Bind(s)
+	if err != nil {
+		return err
+	}
+
+	if s.CurrentStep < 0 || s.CurrentStep >= len(s.Steps) {
+		o.logger.Printf("Saga %s is %s, ignore event type: %s", s.ID, s.Status, event.Type)
+		return nil
+	}
+
 	currentStep := s.Steps[s.CurrentStep]
 	switch event.Type {
 	case currentStep.CommandSuccessEvent:
@@ -287,10 +319,78 @@ func (o *Orchestrator) HandleEvent(ctx context.Context, event event.Event) error
 		return errors.New("unknown event type")
 	}
 
+	err = o.publishStatus(ctx, s)
+	if err != nil {
+		return err
+	}
+
 	o.logger.Println("Saga finish handle event type: ", event.Type)
 	return nil
 }
 
+func (o *Orchestrator) publishStatus(ctx context.Context, s *model.Saga) error {
+	step := ""
+	if s.CurrentStep >= 0 && s.CurrentStep < len(s.Steps) {
+		step = string(s.Steps[s.CurrentStep].Command)
+		if s.Compensating {
+			step = string(s.Steps[s.CurrentStep].Compensate)
+		}
+	}
+
+	payload := event.SagaStatusChangedPayload{
+		SagaID:        s.ID,
+		UserID:        s.Payload.UserID,
+		OrderID:       s.Payload.OrderID,
+		Status:        string(s.Status),
+		CurrentStep:   s.CurrentStep,
+		Step:          step,
+		Compensating:  s.Compensating,
+		FailureReason: s.FailureReason,
+		Revision:      s.Revision,
+		UpdatedAt:     time.Now(),
+	}
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	e := event.Event{
+		ID:      uuid.New().String(),
+		Type:    event.SagaStatusChanged,
+		SagaID:  s.ID,
+		Payload: jsonPayload,
+	}
+	outboxMessage := outbox.Message{
+		ID:        uuid.New().String(),
+		Topic:     topology.SagaEvents,
+		Key:       s.ID,
+		Payload:   e,
+		Headers:   o.headers(ctx, string(e.Type), e.ID, s.ID),
+		Status:    outbox.StatusInit,
+		CreatedAt: time.Now(),
+	}
+
+	return o.outbox.Publish(ctx, outboxMessage)
+}
+
+// headers sets the message being handled, if any, as the cause of the new message.
+func (o *Orchestrator) headers(ctx context.Context, messageType, messageID, sagaID string) broker.Headers {
+	parent := broker.HeadersFromContext(ctx)
+	return broker.NewHeaders(messageType, messageID, sagaID, parent.Get(broker.HeaderMessageID)).WithTrace(parent)
+}
+
+func (o *Orchestrator) failureReason(e event.Event) string {
+	var payload struct {
+		Error string `json:"error"`
+	}
+	err := json.Unmarshal(e.Payload, &payload)
+	if err != nil || payload.Error == "" {
+		return string(e.Type)
+	}
+
+	return payload.Error
+}
+
 func (o *Orchestrator) updatePayload(sagaPayload types.SagaPayload, e event.Event) (types.SagaPayload, error) {
 	o.logger.Println("Saga start update payload")
 
@@ -2,10 +2,9 @@ package repository
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"shop/order_saga/internal/model"
+	"shop/pkg/tx"
 	"time"
 )
 
@@ -15,65 +14,124 @@ type Repository interface {
 	Find(ctx context.Context, id string) (*model.Saga, error)
 }
 
-type PostgresSagaRepo struct{}
+type VersionCount struct {
+	Definition string
+	Version    int
+	Status     model.Status
+	Count      int
+}
+
+type PostgresSagaRepo struct {
+	db tx.Source
+}
 
-func NewPostgresSagaRepo() *PostgresSagaRepo {
-	return &PostgresSagaRepo{}
+func NewPostgresSagaRepo(db tx.Source) *PostgresSagaRepo {
+	return &PostgresSagaRepo{db: db}
 }
 
 func (r *PostgresSagaRepo) Create(ctx context.Context, saga *model.Saga) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	stepsJSON, _ := json.Marshal(saga.Steps)
 	payloadJSON, _ := json.Marshal(saga.Payload)
 	createdAt := time.Now()
-	_, err := tx.ExecContext(
+	saga.Revision = 1
+	_, err := conn.ExecContext(
 		ctx,
-		"INSERT INTO sagas (id, current_step, status, steps, payload, compensating, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		saga.ID, saga.CurrentStep, saga.Status, stepsJSON, payloadJSON, saga.Compensating, createdAt, createdAt,
+		"INSERT INTO sagas (id, definition, version, current_step, status, steps, payload, compensating, failure_reason, revision, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)",
+		saga.ID, saga.Definition, saga.Version, saga.CurrentStep, saga.Status, stepsJSON, payloadJSON, saga.Compensating, saga.FailureReason, saga.Revision, createdAt, createdAt,
 	)
 
 	return err
 }
 
+// Update saves the saga as its next revision.
 func (r *PostgresSagaRepo) Update(ctx context.Context, saga *model.Saga) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	stepsJSON, _ := json.Marshal(saga.Steps)
 	payloadJSON, _ := json.Marshal(saga.Payload)
 	updatedAt := time.Now()
-	_, err := tx.ExecContext(
+	saga.UpdatedAt = updatedAt
+	err := conn.QueryRowContext(
 		ctx,
-		"UPDATE sagas SET current_step = $1, status = $2, steps = $3, payload = $4, compensating = $5, updated_at = $6 WHERE id = $7",
-		saga.CurrentStep, saga.Status, stepsJSON, payloadJSON, saga.Compensating, updatedAt, saga.ID,
-	)
+		"UPDATE sagas SET version = $1, current_step = $2, status = $3, steps = $4, payload = $5, compensating = $6, failure_reason = $7, revision = revision + 1, updated_at = $8 WHERE id = $9 RETURNING revision",
+		saga.Version, saga.CurrentStep, saga.Status, stepsJSON, payloadJSON, saga.Compensating, saga.FailureReason, updatedAt, saga.ID,
+	).Scan(&saga.Revision)
 
 	return err
 }
 
+// Find locks the saga row until the transaction ends, so event handling and an
+// admin migration of the same saga never interleave.
 func (r *PostgresSagaRepo) Find(ctx context.Context, id string) (*model.Saga, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return nil, errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	var saga model.Saga
 	var stepsJSON []byte
 	var payloadJSON []byte
-	err := tx.QueryRowContext(
+	err := conn.QueryRowContext(
 		ctx,
-		"SELECT id, current_step, status, steps, payload, compensating, created_at FROM sagas WHERE id = $1",
+		"SELECT id, definition, version, current_step, status, steps, payload, compensating, failure_reason, revision, created_at, updated_at FROM sagas WHERE id = $1 FOR UPDATE",
 		id,
-	).Scan(&saga.ID, &saga.CurrentStep, &saga.Status, &stepsJSON, &payloadJSON, &saga.Compensating, &saga.CreatedAt)
+	).Scan(
+		&saga.ID, &saga.Definition, &saga.Version, &saga.CurrentStep, &saga.Status, &stepsJSON, &payloadJSON, &saga.Compensating, &saga.FailureReason, &saga.Revision, &saga.CreatedAt, &saga.UpdatedAt,
+	)
 
 	json.Unmarshal(stepsJSON, &saga.Steps)
 	json.Unmarshal(payloadJSON, &saga.Payload)
 
 	return &saga, err
 }
+
+// FindActiveIDs returns the sagas of a definition version that have not finished yet.
+func (r *PostgresSagaRepo) FindActiveIDs(ctx context.Context, definition string, version int) ([]string, error) {
+	conn := r.db.Conn(ctx)
+
+	rows, err := conn.QueryContext(
+		ctx,
+		"SELECT id FROM sagas WHERE definition = $1 AND version = $2 AND status NOT IN ($3, $4) ORDER BY created_at",
+		definition, version, model.StatusCompleted, model.StatusCompensated,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (r *PostgresSagaRepo) CountByVersion(ctx context.Context) ([]VersionCount, error) {
+	conn := r.db.Conn(ctx)
+
+	rows, err := conn.QueryContext(
+		ctx,
+		"SELECT definition, version, status, COUNT(*) FROM sagas GROUP BY definition, version, status ORDER BY definition, version, status",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []VersionCount
+	for rows.Next() {
+		var c VersionCount
+		err = rows.Scan(&c.Definition, &c.Version, &c.Status, &c.Count)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
@@ -0,0 +1,279 @@
+package sagatest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"shop/order_saga/internal/handler"
+	"shop/order_saga/internal/service"
+	"shop/pkg/broker"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"shop/pkg/outbox"
+	"shop/pkg/topology"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// replyTopics are the topics the participant services publish their replies on.
+var replyTopics = map[string]string{
+	topology.OrderCommands:     topology.OrderEvents,
+	topology.ProductCommands:   topology.ProductEvents,
+	topology.InventoryCommands: topology.InventoryEvents,
+	topology.PaymentCommands:   topology.PaymentEvents,
+}
+
+// flow wires the saga service, the fake participants and stand-ins for the
+// gateway and order_history to one MemoryBroker, each in its own group.
+type flow struct {
+	h      *Harness
+	broker *broker.MemoryBroker
+
+	mu       sync.Mutex
+	statuses map[string]event.SagaStatusChangedPayload
+	history  map[string][]event.Type
+}
+
+func newFlow(t *testing.T) *flow {
+	t.Helper()
+
+	logger := log.New(io.Discard, "", 0)
+	f := &flow{
+		h:        New(logger),
+		broker:   broker.NewMemoryBroker(3, logger),
+		statuses: make(map[string]event.SagaStatusChangedPayload),
+		history:  make(map[string][]event.Type),
+	}
+
+	// order saga, as wired in its main, every message handled atomically
+	sagaGroup := f.broker.Group("order-saga-group")
+	orderSagaService := service.NewOrderSagaService(f.h.Orchestrator, f.h.Definitions, logger)
+	commands := broker.NewRouter(broker.DeadLetterUnknown, logger)
+	handler.NewCommandHandler(orderSagaService, logger).Register(commands, topology.OrderSagaCommands)
+	events := broker.NewRouter(broker.SkipUnknown, logger)
+	handler.NewEventHandler(f.h.Orchestrator, logger).Register(events, f.h.Definitions, topology.ProductEvents, topology.InventoryEvents, topology.OrderEvents, topology.PaymentEvents)
+	for _, router := range []*broker.Router{commands, events} {
+		err := router.SubscribeAll(sagaGroup, broker.Chain(router.HandleMessage, f.atomically))
+		if err != nil {
+			t.Fatalf("subscribe order saga: %v", err)
+		}
+	}
+
+	// participants answer on their event topics
+	for topic, participant := range f.h.participants {
+		err := f.broker.Group(topic+"-group").Subscribe(topic, f.participant(participant, replyTopics[topic]))
+		if err != nil {
+			t.Fatalf("subscribe participant %s: %v", topic, err)
+		}
+	}
+
+	// the gateway keeps the status with the highest revision
+	gateway := f.broker.Group("gateway-group")
+	err := gateway.Subscribe(topology.SagaEvents, broker.Event(f.gatewayStatus))
+	if err != nil {
+		t.Fatalf("subscribe gateway: %v", err)
+	}
+
+	// order_history records the order and payment events of each saga
+	history := f.broker.Group("order-history-group")
+	for _, topic := range []string{topology.OrderEvents, topology.PaymentEvents} {
+		err = history.Subscribe(topic, broker.Event(f.recordHistory))
+		if err != nil {
+			t.Fatalf("subscribe order history: %v", err)
+		}
+	}
+
+	return f
+}
+
+func (f *flow) atomically(next broker.HandlerFunc) broker.HandlerFunc {
+	return func(ctx context.Context, message broker.Message) error {
+		return f.h.atomically(func(context.Context) error {
+			return next(ctx, message)
+		})
+	}
+}
+
+func (f *flow) participant(p *Participant, replyTopic string) broker.HandlerFunc {
+	return broker.Command(func(ctx context.Context, cmd command.Command, _ json.RawMessage) error {
+		e, _, err := p.handle(cmd)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return f.broker.Publish(broker.Message{
+			Topic:   replyTopic,
+			Key:     e.SagaID,
+			Value:   value,
+			Headers: broker.NewHeaders(string(e.Type), e.ID, e.SagaID, cmd.ID),
+		})
+	})
+}
+
+func (f *flow) gatewayStatus(ctx context.Context, e event.Event, payload event.SagaStatusChangedPayload) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if current, ok := f.statuses[payload.SagaID]; ok && current.Revision >= payload.Revision {
+		return nil
+	}
+	f.statuses[payload.SagaID] = payload
+	return nil
+}
+
+func (f *flow) recordHistory(ctx context.Context, e event.Event, _ json.RawMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.history[e.SagaID] = append(f.history[e.SagaID], e.Type)
+	return nil
+}
+
+// createOrder publishes the command the gateway sends for a new order.
+func (f *flow) createOrder(userID string) (string, error) {
+	sagaID := uuid.New().String()
+	payload, err := json.Marshal(command.SagaCreateOrderPayload{UserID: userID, PaymentMethodID: "method-1", OrderItems: orderItems})
+	if err != nil {
+		return "", err
+	}
+	cmd := command.Command{ID: uuid.New().String(), Type: command.SagaCreateOrder, SagaID: sagaID, Payload: payload}
+	value, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	return sagaID, f.broker.Publish(broker.Message{
+		Topic:   topology.OrderSagaCommands,
+		Key:     sagaID,
+		Value:   value,
+		Headers: broker.NewHeaders(string(cmd.Type), cmd.ID, sagaID, ""),
+	})
+}
+
+// run relays the saga outbox to the broker and delivers messages until
+// neither has anything left.
+func (f *flow) run(maxSteps int) error {
+	ctx := context.Background()
+	for i := 0; i < maxSteps; i++ {
+		claimed, err := f.h.Outbox.Claim(ctx, 100, "flow")
+		if err != nil {
+			return err
+		}
+		var messages []broker.Message
+		var ids []string
+		for _, m := range claimed {
+			message, err := outbox.BrokerMessage(m)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, message)
+			ids = append(ids, m.ID)
+		}
+		if len(messages) > 0 {
+			err = f.broker.PublishBatch(messages)
+			if err != nil {
+				return err
+			}
+			err = f.h.Outbox.BatchMarkAsSent(ctx, ids)
+			if err != nil {
+				return err
+			}
+		}
+
+		delivered, err := f.broker.Step()
+		if err != nil {
+			return err
+		}
+		if !delivered && len(messages) == 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("flow did not settle after %d steps", maxSteps)
+}
+
+func (f *flow) status(sagaID string) event.SagaStatusChangedPayload {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.statuses[sagaID]
+}
+
+func (f *flow) orderHistory(sagaID string) []event.Type {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.history[sagaID]
+}
+
+func TestCreateOrderFlow(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      func(h *Harness)
+		wantStatus  string
+		wantHistory []event.Type
+	}{
+		{
+			name:        "order completed",
+			script:      func(h *Harness) {},
+			wantStatus:  "completed",
+			wantHistory: []event.Type{event.OrderCreated, event.PaymentCompleted, event.OrderCompleted},
+		},
+		{
+			name: "payment fails",
+			script: func(h *Harness) {
+				h.Participant(topology.PaymentCommands).On(command.ProcessPayment, Reply{Fail: true})
+			},
+			wantStatus:  "compensated",
+			wantHistory: []event.Type{event.OrderCreated, event.PaymentFailed, event.OrderCancelled},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFlow(t)
+			tt.script(f.h)
+
+			var sagaIDs []string
+			for _, user := range []string{"user-1", "user-2", "user-3"} {
+				sagaID, err := f.createOrder(user)
+				if err != nil {
+					t.Fatalf("create order: %v", err)
+				}
+				sagaIDs = append(sagaIDs, sagaID)
+			}
+
+			err := f.run(10000)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if n := f.broker.Pending(); n != 0 {
+				t.Fatalf("pending messages = %d, want 0", n)
+			}
+
+			for _, sagaID := range sagaIDs {
+				saga, err := f.h.Saga(sagaID)
+				if err != nil {
+					t.Fatalf("find saga: %v", err)
+				}
+				if string(saga.Status) != tt.wantStatus {
+					t.Errorf("saga status = %s, want %s", saga.Status, tt.wantStatus)
+				}
+				if status := f.status(sagaID); status.Status != tt.wantStatus || status.Revision != saga.Revision {
+					t.Errorf("gateway status = %s at revision %d, want %s at revision %d", status.Status, status.Revision, tt.wantStatus, saga.Revision)
+				}
+				if got := f.orderHistory(sagaID); !reflect.DeepEqual(got, tt.wantHistory) {
+					t.Errorf("order history = %v, want %v", got, tt.wantHistory)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+// Package sagatest runs the order saga orchestrator in process, against
+// in-memory storage and scripted fake participants instead of Kafka and the
+// participant services.
+package sagatest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"shop/order_saga/internal/model"
+	"shop/order_saga/internal/orchestrator"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"shop/pkg/topology"
+	"shop/pkg/types"
+
+	"github.com/google/uuid"
+)
+
+const defaultMaxRounds = 1000
+
+type pendingEvent struct {
+	event   event.Event
+	due     int
+	reorder bool
+}
+
+type Harness struct {
+	Repo         *MemoryRepo
+	Outbox       *MemoryOutbox
+	Definitions  *model.Registry
+	Orchestrator *orchestrator.Orchestrator
+
+	participants map[string]*Participant
+	queue        []pendingEvent
+	handled      map[string]bool
+	commands     map[string][]command.Type
+	statuses     map[string][]event.SagaStatusChangedPayload
+	errors       []error
+	duplicates   int
+	round        int
+	maxRounds    int
+}
+
+// New wires the orchestrator to in-memory storage and registers a fake
+// participant for every command topic of the create-order saga.
+func New(logger *log.Logger) *Harness {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	repo := NewMemoryRepo()
+	out := NewMemoryOutbox()
+	definitions := model.NewRegistry(model.CreateOrderSagaDefinitions...)
+
+	h := &Harness{
+		Repo:         repo,
+		Outbox:       out,
+		Definitions:  definitions,
+		Orchestrator: orchestrator.NewOrchestrator(repo, out, definitions, logger),
+		participants: make(map[string]*Participant),
+		handled:      make(map[string]bool),
+		commands:     make(map[string][]command.Type),
+		statuses:     make(map[string][]event.SagaStatusChangedPayload),
+		maxRounds:    defaultMaxRounds,
+	}
+
+	for _, def := range model.CreateOrderSagaDefinitions {
+		for _, step := range def.Steps {
+			if _, ok := h.participants[step.CommandTopic]; !ok {
+				h.participants[step.CommandTopic] = NewParticipant(step.CommandTopic)
+			}
+		}
+	}
+
+	return h
+}
+
+func (h *Harness) Participant(topic string) *Participant {
+	return h.participants[topic]
+}
+
+// Start creates a create-order saga with the latest definition, the same way
+// the SagaCreateOrder command does.
+func (h *Harness) Start(userID string, items []types.Item, paymentMethodID string) (string, error) {
+	def, err := h.Definitions.Latest(model.CreateOrderSagaName)
+	if err != nil {
+		return "", err
+	}
+
+	return h.StartWith(def, userID, items, paymentMethodID)
+}
+
+// StartWith creates a create-order saga with the given definition version.
+func (h *Harness) StartWith(def model.Definition, userID string, items []types.Item, paymentMethodID string) (string, error) {
+	saga := model.NewCreateOrderSaga(def, uuid.New().String(), userID, items, paymentMethodID)
+
+	err := h.atomically(func(ctx context.Context) error {
+		return h.Orchestrator.StartSaga(ctx, saga)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return saga.ID, nil
+}
+
+// Run delivers commands and replies until nothing is left in flight.
+func (h *Harness) Run() error {
+	for ; h.round < h.maxRounds; h.round++ {
+		dispatched, err := h.dispatch()
+		if err != nil {
+			return err
+		}
+		delivered := h.deliver()
+
+		if !dispatched && !delivered && len(h.queue) == 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("saga simulation did not settle after %d rounds", h.maxRounds)
+}
+
+func (h *Harness) Saga(id string) (*model.Saga, error) {
+	return h.Repo.Find(context.Background(), id)
+}
+
+// Commands returns the command types sent for a saga, in order.
+func (h *Harness) Commands(sagaID string) []command.Type {
+	return h.commands[sagaID]
+}
+
+// Statuses returns the SagaStatusChanged payloads published for a saga, in order.
+func (h *Harness) Statuses(sagaID string) []event.SagaStatusChangedPayload {
+	return h.statuses[sagaID]
+}
+
+// Errors returns the errors the orchestrator returned while handling replies.
+func (h *Harness) Errors() []error {
+	return h.errors
+}
+
+// Duplicates returns how many replies were dropped by the inbox check.
+func (h *Harness) Duplicates() int {
+	return h.duplicates
+}
+
+func (h *Harness) dispatch() (bool, error) {
+	messages := h.Outbox.take()
+
+	for _, m := range messages {
+		jsonPayload, err := json.Marshal(m.Payload)
+		if err != nil {
+			return false, err
+		}
+
+		if m.Topic == topology.SagaEvents {
+			var e event.Event
+			err = json.Unmarshal(jsonPayload, &e)
+			if err != nil {
+				return false, err
+			}
+			var payload event.SagaStatusChangedPayload
+			err = json.Unmarshal(e.Payload, &payload)
+			if err != nil {
+				return false, err
+			}
+			h.statuses[payload.SagaID] = append(h.statuses[payload.SagaID], payload)
+			continue
+		}
+
+		participant, ok := h.participants[m.Topic]
+		if !ok {
+			return false, fmt.Errorf("no participant for topic %s", m.Topic)
+		}
+
+		var cmd command.Command
+		err = json.Unmarshal(jsonPayload, &cmd)
+		if err != nil {
+			return false, err
+		}
+		h.commands[cmd.SagaID] = append(h.commands[cmd.SagaID], cmd.Type)
+
+		e, reply, err := participant.handle(cmd)
+		if err != nil {
+			return false, err
+		}
+		h.enqueue(e, reply)
+		if reply.Duplicate {
+			h.enqueue(e, Reply{Delay: reply.Delay})
+		}
+	}
+
+	return len(messages) > 0, nil
+}
+
+func (h *Harness) enqueue(e event.Event, reply Reply) {
+	h.queue = append(h.queue, pendingEvent{
+		event:   e,
+		due:     h.round + reply.Delay,
+		reorder: reply.Reorder,
+	})
+}
+
+// deliver hands at most one due reply to the orchestrator. A reordered reply
+// waits while any later reply is due.
+func (h *Harness) deliver() bool {
+	i := h.next()
+	if i < 0 {
+		return false
+	}
+
+	p := h.queue[i]
+	h.queue = append(h.queue[:i], h.queue[i+1:]...)
+
+	if h.handled[p.event.ID] {
+		h.duplicates++
+		return true
+	}
+
+	err := h.atomically(func(ctx context.Context) error {
+		return h.Orchestrator.HandleEvent(ctx, p.event)
+	})
+	if err != nil {
+		h.errors = append(h.errors, fmt.Errorf("handle %s for saga %s: %w", p.event.Type, p.event.SagaID, err))
+		return true
+	}
+	h.handled[p.event.ID] = true
+
+	return true
+}
+
+func (h *Harness) next() int {
+	held := -1
+	for i, p := range h.queue {
+		if p.due > h.round {
+			continue
+		}
+		if p.reorder {
+			if held < 0 {
+				held = i
+			}
+			continue
+		}
+		return i
+	}
+
+	return held
+}
+
+// atomically emulates the handler transaction: a failed call leaves no saga
+// changes and no outbox messages behind.
+func (h *Harness) atomically(fn func(ctx context.Context) error) error {
+	snapshot := h.Repo.snapshot()
+	mark := h.Outbox.mark()
+
+	err := fn(context.Background())
+	if err != nil {
+		h.Repo.restore(snapshot)
+		h.Outbox.rollback(mark)
+		return err
+	}
+
+	return nil
+}
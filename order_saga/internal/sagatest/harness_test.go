@@ -0,0 +1,398 @@
+package sagatest
+
+import (
+	"context"
+	"reflect"
+	"shop/order_saga/internal/model"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"shop/pkg/types"
+	"strings"
+	"testing"
+)
+
+var orderItems = []types.Item{
+	{ProductID: "product-1", Quantity: 2},
+	{ProductID: "product-2", Quantity: 1},
+}
+
+func TestCreateOrderSaga(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        func(h *Harness)
+		wantStatus    model.Status
+		wantCommands  []command.Type
+		wantReason    string
+		wantPayment   int
+		wantDuplicate int
+	}{
+		{
+			name:       "happy path",
+			script:     func(h *Harness) {},
+			wantStatus: model.StatusCompleted,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.ReserveInventory,
+				command.ProcessPayment,
+				command.CompleteOrder,
+			},
+			wantPayment: 300,
+		},
+		{
+			name: "happy path with delayed, duplicated and reordered replies",
+			script: func(h *Harness) {
+				h.Participant("order-commands").On(command.CreateOrder, Reply{Delay: 3, Duplicate: true})
+				h.Participant("product-commands").On(command.ValidateProducts, Reply{Reorder: true})
+				h.Participant("payment-commands").On(command.ProcessPayment, Reply{Duplicate: true, Reorder: true})
+			},
+			wantStatus: model.StatusCompleted,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.ReserveInventory,
+				command.ProcessPayment,
+				command.CompleteOrder,
+			},
+			wantPayment:   300,
+			wantDuplicate: 2,
+		},
+		{
+			name: "create order fails",
+			script: func(h *Harness) {
+				h.Participant("order-commands").On(command.CreateOrder, Reply{Fail: true})
+			},
+			wantStatus:   model.StatusCompensated,
+			wantCommands: []command.Type{command.CreateOrder},
+			wantReason:   "scripted CreateOrder failure",
+		},
+		{
+			name: "products validation fails",
+			script: func(h *Harness) {
+				h.Participant("product-commands").On(command.ValidateProducts, Reply{Fail: true})
+			},
+			wantStatus: model.StatusCompensated,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.CancelOrder,
+			},
+			wantReason: "scripted ValidateProducts failure",
+		},
+		{
+			name: "inventory reservation fails",
+			script: func(h *Harness) {
+				h.Participant("inventory-commands").On(command.ReserveInventory, Reply{Fail: true})
+			},
+			wantStatus: model.StatusCompensated,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.ReserveInventory,
+				command.CancelOrder,
+			},
+			wantReason:  "scripted ReserveInventory failure",
+			wantPayment: 300,
+		},
+		{
+			name: "payment fails",
+			script: func(h *Harness) {
+				h.Participant("payment-commands").On(command.ProcessPayment, Reply{Fail: true})
+			},
+			wantStatus: model.StatusCompensated,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.ReserveInventory,
+				command.ProcessPayment,
+				command.ReleaseInventory,
+				command.CancelOrder,
+			},
+			wantReason:  "scripted ProcessPayment failure",
+			wantPayment: 300,
+		},
+		{
+			name: "order completion fails",
+			script: func(h *Harness) {
+				h.Participant("order-commands").On(command.CompleteOrder, Reply{Fail: true})
+			},
+			wantStatus: model.StatusCompensated,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.ReserveInventory,
+				command.ProcessPayment,
+				command.CompleteOrder,
+				command.RefundPayment,
+				command.ReleaseInventory,
+				command.CancelOrder,
+			},
+			wantReason:  "scripted CompleteOrder failure",
+			wantPayment: 300,
+		},
+		{
+			name: "compensation fails",
+			script: func(h *Harness) {
+				h.Participant("payment-commands").On(command.ProcessPayment, Reply{Fail: true})
+				h.Participant("inventory-commands").On(command.ReleaseInventory, Reply{Fail: true})
+			},
+			wantStatus: model.StatusCompensating,
+			wantCommands: []command.Type{
+				command.CreateOrder,
+				command.ValidateProducts,
+				command.ReserveInventory,
+				command.ProcessPayment,
+				command.ReleaseInventory,
+			},
+			wantReason:  "compensation failed: scripted ReleaseInventory failure",
+			wantPayment: 300,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(nil)
+			tt.script(h)
+
+			sagaID, err := h.Start("user-1", orderItems, "method-1")
+			if err != nil {
+				t.Fatalf("start saga: %v", err)
+			}
+			err = h.Run()
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if errs := h.Errors(); len(errs) > 0 {
+				t.Fatalf("orchestrator errors: %v", errs)
+			}
+
+			saga, err := h.Saga(sagaID)
+			if err != nil {
+				t.Fatalf("find saga: %v", err)
+			}
+			if saga.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", saga.Status, tt.wantStatus)
+			}
+			if got := h.Commands(sagaID); !reflect.DeepEqual(got, tt.wantCommands) {
+				t.Errorf("commands = %v, want %v", got, tt.wantCommands)
+			}
+			if saga.FailureReason != tt.wantReason {
+				t.Errorf("failure reason = %q, want %q", saga.FailureReason, tt.wantReason)
+			}
+			if saga.Payload.PaymentSum != tt.wantPayment {
+				t.Errorf("payment sum = %d, want %d", saga.Payload.PaymentSum, tt.wantPayment)
+			}
+			if h.Duplicates() != tt.wantDuplicate {
+				t.Errorf("duplicates = %d, want %d", h.Duplicates(), tt.wantDuplicate)
+			}
+
+			statuses := h.Statuses(sagaID)
+			if len(statuses) == 0 {
+				t.Fatal("no status events published")
+			}
+			if last := statuses[len(statuses)-1]; last.Status != string(tt.wantStatus) {
+				t.Errorf("last status event = %s, want %s", last.Status, tt.wantStatus)
+			}
+			for i := 1; i < len(statuses); i++ {
+				if statuses[i].Revision <= statuses[i-1].Revision {
+					t.Errorf("status event %d has revision %d after %d", i, statuses[i].Revision, statuses[i-1].Revision)
+				}
+			}
+		})
+	}
+}
+
+func TestCompensationStepStatuses(t *testing.T) {
+	h := New(nil)
+	h.Participant("order-commands").On(command.CompleteOrder, Reply{Fail: true})
+
+	sagaID, err := h.Start("user-1", orderItems, "method-1")
+	if err != nil {
+		t.Fatalf("start saga: %v", err)
+	}
+	if err = h.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	saga, err := h.Saga(sagaID)
+	if err != nil {
+		t.Fatalf("find saga: %v", err)
+	}
+
+	want := []struct {
+		command    model.StepStatus
+		compensate model.StepStatus
+	}{
+		{model.StepStatusCompleted, model.StepStatusCompleted},
+		{model.StepStatusCompleted, model.StepStatusSkipped},
+		{model.StepStatusCompleted, model.StepStatusCompleted},
+		{model.StepStatusCompleted, model.StepStatusCompleted},
+		{model.StepStatusFailed, ""},
+	}
+	for i, step := range saga.Steps {
+		if step.CommandStatus != want[i].command || step.CompensateStatus != want[i].compensate {
+			t.Errorf("step %d (%s) = %s/%s, want %s/%s", i, step.Command,
+				step.CommandStatus, step.CompensateStatus, want[i].command, want[i].compensate)
+		}
+	}
+}
+
+func TestEventForFinishedSaga(t *testing.T) {
+	h := New(nil)
+
+	sagaID, err := h.Start("user-1", orderItems, "method-1")
+	if err != nil {
+		t.Fatalf("start saga: %v", err)
+	}
+	if err = h.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	statuses := len(h.Statuses(sagaID))
+
+	// a late redelivery of the last reply must not fail the consumer
+	late := event.Event{ID: "late-reply", Type: event.OrderCompleted, SagaID: sagaID}
+	err = h.Orchestrator.HandleEvent(context.Background(), late)
+	if err != nil {
+		t.Fatalf("handle event for finished saga: %v", err)
+	}
+
+	saga, err := h.Saga(sagaID)
+	if err != nil {
+		t.Fatalf("find saga: %v", err)
+	}
+	if saga.Status != model.StatusCompleted {
+		t.Errorf("saga status = %s, want %s", saga.Status, model.StatusCompleted)
+	}
+	if err = h.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := len(h.Statuses(sagaID)); got != statuses {
+		t.Errorf("status events = %d, want %d", got, statuses)
+	}
+}
+
+func TestConcurrentSagasWithReorderedReplies(t *testing.T) {
+	h := New(nil)
+	h.Participant("order-commands").On(command.CreateOrder, Reply{Reorder: true})
+	h.Participant("payment-commands").On(command.ProcessPayment, Reply{Delay: 2})
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id, err := h.Start("user-1", orderItems, "method-1")
+		if err != nil {
+			t.Fatalf("start saga: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := h.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if errs := h.Errors(); len(errs) > 0 {
+		t.Fatalf("orchestrator errors: %v", errs)
+	}
+
+	for _, id := range ids {
+		saga, err := h.Saga(id)
+		if err != nil {
+			t.Fatalf("find saga: %v", err)
+		}
+		if saga.Status != model.StatusCompleted {
+			t.Errorf("saga %s status = %s, want %s", id, saga.Status, model.StatusCompleted)
+		}
+		if !strings.HasPrefix(saga.Payload.OrderID, "order-") {
+			t.Errorf("saga %s order id = %q", id, saga.Payload.OrderID)
+		}
+	}
+}
+
+func TestDefinitionVersions(t *testing.T) {
+	h := New(nil)
+	v1, err := h.Definitions.Get(model.CreateOrderSagaName, 1)
+	if err != nil {
+		t.Fatalf("get v1: %v", err)
+	}
+
+	oldID, err := h.Start("user-1", orderItems, "method-1")
+	if err != nil {
+		t.Fatalf("start v1 saga: %v", err)
+	}
+
+	// v2 drops the products validation step
+	v2 := model.Definition{Name: model.CreateOrderSagaName, Version: 2}
+	v2.Steps = append(v2.Steps, v1.Steps[0])
+	v2.Steps = append(v2.Steps, v1.Steps[2:]...)
+	h.Definitions.Register(v2)
+
+	newID, err := h.Start("user-1", orderItems, "method-1")
+	if err != nil {
+		t.Fatalf("start v2 saga: %v", err)
+	}
+	if err = h.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if errs := h.Errors(); len(errs) > 0 {
+		t.Fatalf("orchestrator errors: %v", errs)
+	}
+
+	tests := []struct {
+		id           string
+		wantVersion  int
+		wantCommands int
+	}{
+		{oldID, 1, 5},
+		{newID, 2, 4},
+	}
+	for _, tt := range tests {
+		saga, err := h.Saga(tt.id)
+		if err != nil {
+			t.Fatalf("find saga: %v", err)
+		}
+		if saga.Version != tt.wantVersion || saga.Status != model.StatusCompleted {
+			t.Errorf("saga v%d is %s, want v%d completed", saga.Version, saga.Status, tt.wantVersion)
+		}
+		if got := len(h.Commands(tt.id)); got != tt.wantCommands {
+			t.Errorf("saga v%d sent %d commands, want %d", saga.Version, got, tt.wantCommands)
+		}
+	}
+}
+
+func TestDefinitionMigrate(t *testing.T) {
+	v1 := model.CreateOrderSagaDefinitions[0]
+	v2 := model.Definition{Name: model.CreateOrderSagaName, Version: 2}
+	v2.Steps = append(v2.Steps, v1.Steps[0])
+	v2.Steps = append(v2.Steps, v1.Steps[2:]...)
+
+	tests := []struct {
+		name         string
+		currentStep  int
+		compensating bool
+		wantErr      bool
+	}{
+		{name: "first step is shared", currentStep: 0},
+		{name: "executed step differs", currentStep: 1, wantErr: true},
+		{name: "compensating", currentStep: 0, compensating: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := model.NewCreateOrderSaga(v1, "", "user-1", orderItems, "method-1")
+			s.Status = model.StatusRunning
+			s.CurrentStep = tt.currentStep
+			s.Compensating = tt.compensating
+			s.Steps[0].CommandStatus = model.StepStatusRunning
+
+			err := v1.Migrate(s, v2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("migrate error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if s.Version != 2 || len(s.Steps) != len(v2.Steps) {
+				t.Errorf("saga is v%d with %d steps, want v2 with %d", s.Version, len(s.Steps), len(v2.Steps))
+			}
+			if s.Steps[0].CommandStatus != model.StepStatusRunning {
+				t.Errorf("step 0 status = %s, want %s", s.Steps[0].CommandStatus, model.StepStatusRunning)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package sagatest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"shop/order_saga/internal/model"
+	"shop/pkg/outbox"
+	"shop/pkg/topology"
+	"sync"
+	"time"
+)
+
+// MemoryRepo stores sagas as JSON, like the sagas table, so callers never share
+// step slices with the stored copy.
+type MemoryRepo struct {
+	mu    sync.Mutex
+	sagas map[string][]byte
+}
+
+func NewMemoryRepo() *MemoryRepo {
+	return &MemoryRepo{sagas: make(map[string][]byte)}
+}
+
+func (r *MemoryRepo) Create(ctx context.Context, saga *model.Saga) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sagas[saga.ID]; ok {
+		return errors.New("saga already exists")
+	}
+
+	saga.Revision = 1
+	return r.store(saga)
+}
+
+func (r *MemoryRepo) Update(ctx context.Context, saga *model.Saga) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sagas[saga.ID]; !ok {
+		return errors.New("saga not found")
+	}
+
+	saga.Revision++
+	return r.store(saga)
+}
+
+func (r *MemoryRepo) Find(ctx context.Context, id string) (*model.Saga, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.sagas[id]
+	if !ok {
+		return nil, errors.New("saga not found")
+	}
+
+	var saga model.Saga
+	err := json.Unmarshal(data, &saga)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saga, nil
+}
+
+func (r *MemoryRepo) store(saga *model.Saga) error {
+	data, err := json.Marshal(saga)
+	if err != nil {
+		return err
+	}
+	r.sagas[saga.ID] = data
+
+	return nil
+}
+
+func (r *MemoryRepo) snapshot() map[string][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := make(map[string][]byte, len(r.sagas))
+	for id, data := range r.sagas {
+		s[id] = data
+	}
+
+	return s
+}
+
+func (r *MemoryRepo) restore(s map[string][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sagas = s
+}
+
+var _ outbox.Outbox = (*MemoryOutbox)(nil)
+
+// MemoryOutbox keeps published messages in memory until the harness takes them.
+type MemoryOutbox struct {
+	mu        sync.Mutex
+	messages  []outbox.Message
+	sequences map[string]int64
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{sequences: make(map[string]int64)}
+}
+
+func (o *MemoryOutbox) Publish(ctx context.Context, message outbox.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if message.AggregateID == "" {
+		message.AggregateID = message.Key
+	}
+	if message.Key == "" {
+		message.Key = message.AggregateID
+	}
+	if message.Key != message.AggregateID {
+		return outbox.ErrKeyNotAggregate
+	}
+	o.messages = append(o.messages, message)
+
+	return nil
+}
+
+// Claim marks the oldest init messages pending and numbers them. The harness
+// runs one worker, so there is nothing to lock.
+func (o *MemoryOutbox) Claim(ctx context.Context, limit int, lockedBy string) ([]outbox.Message, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var messages []outbox.Message
+	for i, m := range o.messages {
+		if m.Status == outbox.StatusInit && len(messages) < limit {
+			o.messages[i].Status = outbox.StatusPending
+			if m.AggregateID != "" && m.Sequence == 0 && !topology.Compacted(m.Topic) {
+				key := m.Topic + "/" + m.AggregateID
+				o.sequences[key]++
+				o.messages[i].Sequence = o.sequences[key]
+			}
+			messages = append(messages, o.messages[i])
+		}
+	}
+
+	return messages, nil
+}
+
+func (o *MemoryOutbox) BatchMarkAsSent(ctx context.Context, ids []string) error {
+	return o.batchUpdateStatus(ids, outbox.StatusPending, outbox.StatusSent)
+}
+
+func (o *MemoryOutbox) BatchMarkAsError(ctx context.Context, ids []string) error {
+	return o.batchUpdateStatus(ids, outbox.StatusPending, outbox.StatusError)
+}
+
+func (o *MemoryOutbox) MarkAsFailed(ctx context.Context, id string, cause string, retryAt *time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, m := range o.messages {
+		if m.ID == id && m.Status == outbox.StatusPending {
+			o.messages[i].Attempts++
+			o.messages[i].LastError = cause
+			o.messages[i].Status = outbox.StatusInit
+			if retryAt == nil {
+				o.messages[i].Status = outbox.StatusError
+			}
+			return nil
+		}
+	}
+
+	return errors.New("failed to update status: no rows affected")
+}
+
+func (o *MemoryOutbox) Requeue(ctx context.Context, ids []string) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var n int64
+	for i, m := range o.messages {
+		if m.Status == outbox.StatusError && (len(ids) == 0 || wanted[m.ID]) {
+			o.messages[i].Status = outbox.StatusInit
+			o.messages[i].Attempts = 0
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// ReclaimStale has nothing to do, the harness never leaves messages pending.
+func (o *MemoryOutbox) ReclaimStale(ctx context.Context, lease time.Duration) (int64, error) {
+	return 0, nil
+}
+
+func (o *MemoryOutbox) batchUpdateStatus(ids []string, from outbox.MessageStatus, to outbox.MessageStatus) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	n := 0
+	for i, m := range o.messages {
+		if wanted[m.ID] && m.Status == from {
+			o.messages[i].Status = to
+			n++
+		}
+	}
+	if n == 0 {
+		return errors.New("failed to update status: no rows affected")
+	}
+
+	return nil
+}
+
+// take returns the messages that are not sent yet and marks them as sent.
+func (o *MemoryOutbox) take() []outbox.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var messages []outbox.Message
+	for i, m := range o.messages {
+		if m.Status == outbox.StatusInit {
+			messages = append(messages, m)
+			o.messages[i].Status = outbox.StatusSent
+		}
+	}
+
+	return messages
+}
+
+func (o *MemoryOutbox) mark() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.messages)
+}
+
+func (o *MemoryOutbox) rollback(mark int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.messages = o.messages[:mark]
+}
@@ -0,0 +1,165 @@
+package sagatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"shop/order_saga/internal/model"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"shop/pkg/types"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Reply scripts how a fake participant answers one command type.
+type Reply struct {
+	// Fail answers with the failure event of the command instead of the success event.
+	Fail bool
+	// Delay holds the reply back for the given number of simulation rounds.
+	Delay int
+	// Duplicate delivers the reply twice with the same event ID.
+	Duplicate bool
+	// Reorder lets the next reply produced by any participant overtake this one.
+	Reorder bool
+	// Payload replaces the default event payload when set.
+	Payload any
+}
+
+type replyEvents struct {
+	success event.Type
+	fail    event.Type
+}
+
+// Participant fakes the service that consumes one command topic.
+type Participant struct {
+	mu       sync.Mutex
+	topic    string
+	script   map[command.Type]Reply
+	events   map[command.Type]replyEvents
+	received []command.Command
+}
+
+func NewParticipant(topic string) *Participant {
+	return &Participant{
+		topic:  topic,
+		script: make(map[command.Type]Reply),
+		events: createOrderReplyEvents(),
+	}
+}
+
+// On scripts the reply for a command type. Unscripted commands succeed.
+func (p *Participant) On(commandType command.Type, reply Reply) *Participant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.script[commandType] = reply
+
+	return p
+}
+
+func (p *Participant) Received() []command.Command {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]command.Command(nil), p.received...)
+}
+
+func (p *Participant) handle(cmd command.Command) (event.Event, Reply, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.received = append(p.received, cmd)
+	reply := p.script[cmd.Type]
+
+	replies, ok := p.events[cmd.Type]
+	if !ok {
+		return event.Event{}, reply, fmt.Errorf("participant %s cannot handle command %s", p.topic, cmd.Type)
+	}
+
+	eventType := replies.success
+	if reply.Fail {
+		eventType = replies.fail
+	}
+
+	payload := reply.Payload
+	if payload == nil {
+		payload = defaultPayload(cmd, reply.Fail)
+	}
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return event.Event{}, reply, err
+	}
+
+	e := event.Event{
+		ID:      uuid.New().String(),
+		Type:    eventType,
+		SagaID:  cmd.SagaID,
+		Payload: jsonPayload,
+	}
+
+	return e, reply, nil
+}
+
+// createOrderReplyEvents reads the reply events from the saga definition, so the
+// fakes answer exactly what the orchestrator waits for.
+func createOrderReplyEvents() map[command.Type]replyEvents {
+	events := make(map[command.Type]replyEvents)
+	for _, def := range model.CreateOrderSagaDefinitions {
+		for _, step := range def.Steps {
+			events[step.Command] = replyEvents{success: step.CommandSuccessEvent, fail: step.CommandFailEvent}
+			if step.Compensate != "" {
+				events[step.Compensate] = replyEvents{success: step.CompensateSuccessEvent, fail: step.CompensateFailEvent}
+			}
+		}
+	}
+
+	return events
+}
+
+func defaultPayload(cmd command.Command, fail bool) any {
+	if fail {
+		return map[string]string{"error": fmt.Sprintf("scripted %s failure", cmd.Type)}
+	}
+
+	switch cmd.Type {
+	case command.CreateOrder:
+		var payload command.CreateOrderPayload
+		_ = json.Unmarshal(cmd.Payload, &payload)
+		return event.OrderCreatedPayload{
+			OrderID:         "order-" + cmd.SagaID,
+			UserID:          payload.UserID,
+			PaymentMethodID: payload.PaymentMethodID,
+			OrderItems:      payload.OrderItems,
+		}
+	case command.ValidateProducts:
+		var payload command.ValidateProductsPayload
+		_ = json.Unmarshal(cmd.Payload, &payload)
+		var items []types.Item
+		for _, item := range payload.OrderItems {
+			items = append(items, types.Item{
+				ProductID: item.ProductID,
+				Quantity:  item.Quantity,
+				Name:      "product " + item.ProductID,
+				Price:     100,
+			})
+		}
+		return event.ProductsValidatedPayload{
+			OrderID:    payload.OrderID,
+			OrderItems: items,
+		}
+	case command.ProcessPayment:
+		var payload command.ProcessPaymentPayload
+		_ = json.Unmarshal(cmd.Payload, &payload)
+		return event.PaymentCompletedPayload{
+			PaymentID:         "payment-" + cmd.SagaID,
+			OrderID:           payload.OrderID,
+			UserID:            payload.UserID,
+			PaymentSum:        payload.PaymentSum,
+			PaymentMethodID:   payload.PaymentMethodID,
+			PaymentExternalID: "external-" + cmd.SagaID,
+		}
+	default:
+		return map[string]string{}
+	}
+}
@@ -10,21 +10,29 @@ import (
 
 type OrderSagaService struct {
 	orchestrator *orchestrator.Orchestrator
+	definitions  *model.Registry
 	logger       *log.Logger
 }
 
-func NewOrderSagaService(orc *orchestrator.Orchestrator, logger *log.Logger) *OrderSagaService {
+func NewOrderSagaService(orc *orchestrator.Orchestrator, definitions *model.Registry, logger *log.Logger) *OrderSagaService {
 	return &OrderSagaService{
 		orchestrator: orc,
+		definitions:  definitions,
 		logger:       logger,
 	}
 }
 
-func (s *OrderSagaService) Create(ctx context.Context, userID string, items []types.Item, paymentMethod string) error {
+func (s *OrderSagaService) Create(ctx context.Context, sagaID string, userID string, items []types.Item, paymentMethod string) error {
 	s.logger.Printf("Create order saga start")
 
-	saga := model.NewCreateOrderSaga(userID, items, paymentMethod)
-	err := s.orchestrator.StartSaga(ctx, saga)
+	def, err := s.definitions.Latest(model.CreateOrderSagaName)
+	if err != nil {
+		s.logger.Printf("Create order saga failed: %v", err)
+		return err
+	}
+
+	saga := model.NewCreateOrderSaga(def, sagaID, userID, items, paymentMethod)
+	err = s.orchestrator.StartSaga(ctx, saga)
 	if err != nil {
 		s.logger.Printf("Create order saga failed: %v", err)
 		return err
@@ -0,0 +1 @@
+ALTER TABLE sagas DROP COLUMN failure_reason;
\ No newline at end of file
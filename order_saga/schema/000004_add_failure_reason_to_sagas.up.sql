@@ -0,0 +1 @@
+ALTER TABLE sagas ADD COLUMN failure_reason TEXT NOT NULL DEFAULT '';
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX sagas_definition_version_status_index;
+ALTER TABLE sagas DROP COLUMN version;
+ALTER TABLE sagas DROP COLUMN definition;
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE sagas ADD COLUMN definition VARCHAR(255) NOT NULL DEFAULT 'create_order';
+ALTER TABLE sagas ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX sagas_definition_version_status_index ON sagas (definition, version, status);
\ No newline at end of file
@@ -0,0 +1,4 @@
+ALTER TABLE outbox
+    DROP COLUMN attempts,
+    DROP COLUMN last_error,
+    DROP COLUMN next_attempt_at;
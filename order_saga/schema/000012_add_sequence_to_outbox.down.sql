@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS outbox_sequences;
+
+ALTER TABLE outbox_archive
+    DROP COLUMN aggregate_id,
+    DROP COLUMN sequence;
+
+ALTER TABLE outbox
+    DROP COLUMN aggregate_id,
+    DROP COLUMN sequence;
@@ -0,0 +1 @@
+ALTER TABLE sagas ADD COLUMN revision BIGINT NOT NULL DEFAULT 1;
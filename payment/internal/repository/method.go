@@ -2,9 +2,8 @@ package repository
 
 import (
 	"context"
-	"database/sql"
-	"errors"
 	"shop/payment/internal/model"
+	"shop/pkg/tx"
 )
 
 type MethodRepository interface {
@@ -12,20 +11,19 @@ type MethodRepository interface {
 	FindByID(ctx context.Context, id string) (model.Method, error)
 }
 
-type PostgresMethodRepository struct{}
+type PostgresMethodRepository struct {
+	db tx.Source
+}
 
-func NewPostgresMethodRepository() *PostgresMethodRepository {
-	return &PostgresMethodRepository{}
+func NewPostgresMethodRepository(db tx.Source) *PostgresMethodRepository {
+	return &PostgresMethodRepository{db: db}
 }
 
 func (m *PostgresMethodRepository) Create(ctx context.Context, method model.Method) (model.Method, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Method{}, errors.New("transaction not found in context")
-	}
+	conn := m.db.Conn(ctx)
 
 	query := `INSERT INTO methods (id, user_id, gateway, payment_type, token) VALUES ($1, $2, $3, $4, $5)`
-	_, err := tx.ExecContext(ctx, query, method.ID, method.UserID, method.Gateway, method.PaymentType, method.Token)
+	_, err := conn.ExecContext(ctx, query, method.ID, method.UserID, method.Gateway, method.PaymentType, method.Token)
 	if err != nil {
 		return model.Method{}, err
 	}
@@ -34,15 +32,12 @@ func (m *PostgresMethodRepository) Create(ctx context.Context, method model.Meth
 }
 
 func (m *PostgresMethodRepository) FindByID(ctx context.Context, id string) (model.Method, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Method{}, errors.New("transaction not found in context")
-	}
+	conn := m.db.Conn(ctx)
 
 	var method model.Method
 
 	query := `SELECT id, user_id, gateway, payment_type, token FROM methods WHERE id = $1`
-	err := tx.QueryRowContext(ctx, query, id).Scan(
+	err := conn.QueryRowContext(ctx, query, id).Scan(
 		&method.ID,
 		&method.UserID,
 		&method.Gateway,
@@ -2,9 +2,8 @@ package repository
 
 import (
 	"context"
-	"database/sql"
-	"errors"
 	"shop/payment/internal/model"
+	"shop/pkg/tx"
 	"time"
 )
 
@@ -14,20 +13,19 @@ type PaymentRepository interface {
 	UpdateExternalID(ctx context.Context, id string, externalID string) error
 }
 
-type PostgresPaymentRepository struct{}
+type PostgresPaymentRepository struct {
+	db tx.Source
+}
 
-func NewPostgresPaymentRepository() *PostgresPaymentRepository {
-	return &PostgresPaymentRepository{}
+func NewPostgresPaymentRepository(db tx.Source) *PostgresPaymentRepository {
+	return &PostgresPaymentRepository{db: db}
 }
 
 func (p *PostgresPaymentRepository) Create(ctx context.Context, payment model.Payment) (model.Payment, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Payment{}, errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	query := `INSERT INTO payments (id, order_id, user_id, amount, external_id, status, method_id, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := tx.ExecContext(ctx, query, payment.ID, payment.OrderID, payment.UserID, payment.Amount, nil, model.PaymentStatusPending, payment.MethodID, time.Now(), time.Now())
+	_, err := conn.ExecContext(ctx, query, payment.ID, payment.OrderID, payment.UserID, payment.Amount, nil, model.PaymentStatusPending, payment.MethodID, time.Now(), time.Now())
 	if err != nil {
 		return model.Payment{}, err
 	}
@@ -36,13 +34,10 @@ func (p *PostgresPaymentRepository) Create(ctx context.Context, payment model.Pa
 }
 
 func (p *PostgresPaymentRepository) UpdateStatus(ctx context.Context, id string, status model.PaymentStatus) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	query := `UPDATE payments SET status = $1, updated_at = $2 WHERE id = $3`
-	_, err := tx.ExecContext(ctx, query, status, time.Now(), id)
+	_, err := conn.ExecContext(ctx, query, status, time.Now(), id)
 	if err != nil {
 		return err
 	}
@@ -51,13 +46,10 @@ func (p *PostgresPaymentRepository) UpdateStatus(ctx context.Context, id string,
 }
 
 func (p *PostgresPaymentRepository) UpdateExternalID(ctx context.Context, id string, externalID string) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	query := `UPDATE payments SET external_id = $1, updated_at = $2 WHERE id = $3`
-	_, err := tx.ExecContext(ctx, query, externalID, time.Now(), id)
+	_, err := conn.ExecContext(ctx, query, externalID, time.Now(), id)
 	if err != nil {
 		return err
 	}
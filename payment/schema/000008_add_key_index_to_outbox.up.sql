@@ -0,0 +1 @@
+CREATE INDEX outbox_key_status_index ON outbox (key, status);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS inbox_status_created_at_index;
+DROP INDEX IF EXISTS outbox_status_created_at_index;
+DROP TABLE IF EXISTS inbox_archive;
+DROP TABLE IF EXISTS outbox_archive;
@@ -1,13 +1,19 @@
 package broker
 
+import (
+	"context"
+	"hash/fnv"
+)
+
 type Handler interface {
 	Handle(message Message) error
 }
 
 type Message struct {
-	Topic string
-	Key   string
-	Value []byte
+	Topic   string
+	Key     string
+	Value   []byte
+	Headers Headers
 }
 
 type Broker interface {
@@ -15,3 +21,19 @@ type Broker interface {
 	PublishBatch(messages []Message) error
 	Subscribe(topic string, handler Handler) error
 }
+
+// Client is a Broker that also consumes. Services depend on it, so the Kafka
+// and Postgres implementations are interchangeable.
+type Client interface {
+	Broker
+	StatsReporter
+	StartConsume(ctx context.Context, topics []string) error
+}
+
+// partitionFor spreads keys over n partitions, the same key always landing
+// on the same partition.
+func partitionFor(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
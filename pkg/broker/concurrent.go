@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// offsetTracker marks offsets of a partition in order although messages
+// finish out of order: an offset is marked only when it and every offset
+// before it are done.
+type offsetTracker struct {
+	mu      sync.Mutex
+	session sarama.ConsumerGroupSession
+	claim   sarama.ConsumerGroupClaim
+	stats   *consumerStats
+	pending []*sarama.ConsumerMessage
+	done    map[int64]bool
+}
+
+func newOffsetTracker(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, stats *consumerStats) *offsetTracker {
+	return &offsetTracker{session: session, claim: claim, stats: stats, done: make(map[int64]bool)}
+}
+
+// start must be called in partition order, before the message is handed to a lane.
+func (t *offsetTracker) start(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending = append(t.pending, message)
+}
+
+func (t *offsetTracker) complete(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.done[message.Offset] = true
+	for len(t.pending) > 0 && t.done[t.pending[0].Offset] {
+		head := t.pending[0]
+		t.session.MarkMessage(head, "")
+		t.stats.processed(head.Topic, head.Partition, head.Offset, t.claim.HighWaterMarkOffset())
+		delete(t.done, head.Offset)
+		t.pending = t.pending[1:]
+	}
+}
+
+// consumeConcurrently handles the claim with one goroutine per lane. After
+// the first error or abandoned message every lane finishes the message it is
+// on and skips the rest; skipped messages stay unmarked and are redelivered.
+// The error ends the session.
+func (h *consumerGroupHandler) consumeConcurrently(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, lanes int) error {
+	tracker := newOffsetTracker(session, claim, h.broker.stats)
+	stopped := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+
+	stop := func(err error) {
+		stopOnce.Do(func() {
+			firstErr = err
+			close(stopped)
+		})
+	}
+
+	queues := make([]chan *sarama.ConsumerMessage, lanes)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *sarama.ConsumerMessage, 1)
+		wg.Add(1)
+		go func(queue <-chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for message := range queue {
+				select {
+				case <-stopped:
+					continue
+				default:
+				}
+
+				done, err := h.process(session, message)
+				if err != nil {
+					stop(err)
+					continue
+				}
+				if !done {
+					stop(nil)
+					continue
+				}
+				tracker.complete(message)
+			}
+		}(queues[i])
+	}
+
+dispatch:
+	for {
+		select {
+		case <-stopped:
+			break dispatch
+		case message, ok := <-claim.Messages():
+			if !ok {
+				break dispatch
+			}
+			tracker.start(message)
+			select {
+			case queues[partitionFor(message.Key, lanes)] <- message:
+			case <-stopped:
+				break dispatch
+			}
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// fakeClaim feeds messages to a consumer like one claimed partition.
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+	hwm      int64
+}
+
+func (c *fakeClaim) Topic() string                            { return "orders" }
+func (c *fakeClaim) Partition() int32                         { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return c.hwm }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestOffsetTracker(t *testing.T) {
+	tests := []struct {
+		name       string
+		started    int
+		completed  []int64
+		wantMarked []int64
+	}{
+		{name: "in order", started: 3, completed: []int64{0, 1, 2}, wantMarked: []int64{0, 1, 2}},
+		{name: "later offset waits for the earlier one", started: 3, completed: []int64{2, 1}, wantMarked: nil},
+		{name: "earlier offset releases the later ones", started: 3, completed: []int64{2, 1, 0}, wantMarked: []int64{0, 1, 2}},
+		{name: "gap stops marking", started: 4, completed: []int64{0, 2, 3}, wantMarked: []int64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession(context.Background())
+			tracker := newOffsetTracker(session, &fakeClaim{hwm: int64(tt.started)}, newConsumerStats("group"))
+
+			messages := make([]*sarama.ConsumerMessage, tt.started)
+			for i := range messages {
+				messages[i] = &sarama.ConsumerMessage{Topic: "orders", Offset: int64(i)}
+				tracker.start(messages[i])
+			}
+			for _, offset := range tt.completed {
+				tracker.complete(messages[offset])
+			}
+
+			if got := session.markedOffsets(); !reflect.DeepEqual(got, tt.wantMarked) {
+				t.Errorf("marked %v, want %v", got, tt.wantMarked)
+			}
+		})
+	}
+}
+
+func TestConsumeConcurrentlyKeepsKeyOrder(t *testing.T) {
+	b := NewKafkaBroker(nil, nil, "group", discard)
+
+	var mu sync.Mutex
+	got := make(map[string][]string)
+	err := b.Subscribe("orders", HandlerFunc(func(ctx context.Context, m Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		got[m.Key] = append(got[m.Key], string(m.Value))
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	const perKey = 20
+	claim := &fakeClaim{messages: make(chan *sarama.ConsumerMessage, len(keys)*perKey), hwm: int64(len(keys) * perKey)}
+	var offset int64
+	for i := 0; i < perKey; i++ {
+		for _, key := range keys {
+			claim.messages <- &sarama.ConsumerMessage{Topic: "orders", Key: []byte(key), Value: []byte(fmt.Sprint(i)), Offset: offset}
+			offset++
+		}
+	}
+	close(claim.messages)
+
+	session := newFakeSession(context.Background())
+	handler := &consumerGroupHandler{broker: b}
+	err = handler.consumeConcurrently(session, claim, 4)
+	if err != nil {
+		t.Fatalf("consume: %v", err)
+	}
+
+	for _, key := range keys {
+		var want []string
+		for i := 0; i < perKey; i++ {
+			want = append(want, fmt.Sprint(i))
+		}
+		if !reflect.DeepEqual(got[key], want) {
+			t.Errorf("key %s handled %v, want %v", key, got[key], want)
+		}
+	}
+
+	marked := session.markedOffsets()
+	if len(marked) != int(offset) {
+		t.Fatalf("marked %d offsets, want %d", len(marked), offset)
+	}
+	for i, o := range marked {
+		if o != int64(i) {
+			t.Fatalf("offset %d marked at position %d, offsets are marked out of order", o, i)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	HeaderMessageType   = "message-type"
+	HeaderMessageID     = "message-id"
+	HeaderCorrelationID = "correlation-id"
+	HeaderCausationID   = "causation-id"
+	HeaderTraceParent   = "traceparent"
+	HeaderSchemaVersion = "schema-version"
+	HeaderProducedAt    = "produced-at"
+	// HeaderAggregateID and HeaderSequence let consumers check that the
+	// messages of an aggregate on a topic arrive in order, see Sequence.
+	HeaderAggregateID = "aggregate-id"
+	HeaderSequence    = "aggregate-sequence"
+
+	SchemaVersion = "1"
+)
+
+// Headers travel as Kafka record headers next to the value, so consumers can
+// route and trace a message without unmarshalling it.
+type Headers map[string]string
+
+// NewHeaders returns the envelope for a new message. correlationID groups all
+// messages of one business flow (the saga id), causationID is the id of the
+// message that caused this one and is empty for the first message of a flow.
+func NewHeaders(messageType, messageID, correlationID, causationID string) Headers {
+	h := Headers{
+		HeaderMessageType:   messageType,
+		HeaderMessageID:     messageID,
+		HeaderSchemaVersion: SchemaVersion,
+		HeaderProducedAt:    time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if correlationID != "" {
+		h[HeaderCorrelationID] = correlationID
+	}
+	if causationID != "" {
+		h[HeaderCausationID] = causationID
+	}
+
+	return h
+}
+
+// Get is safe on nil headers.
+func (h Headers) Get(key string) string {
+	if h == nil {
+		return ""
+	}
+	return h[key]
+}
+
+// WithTrace copies the trace context of parent into h.
+func (h Headers) WithTrace(parent Headers) Headers {
+	if tp := parent.Get(HeaderTraceParent); tp != "" {
+		h[HeaderTraceParent] = tp
+	}
+	return h
+}
+
+func (h Headers) Clone() Headers {
+	if h == nil {
+		return nil
+	}
+	c := make(Headers, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	return c
+}
+
+// NewTraceParent starts a W3C trace context for a flow that enters the system.
+func NewTraceParent() string {
+	var traceID [16]byte
+	var spanID [8]byte
+	_, _ = rand.Read(traceID[:])
+	_, _ = rand.Read(spanID[:])
+
+	return "00-" + hex.EncodeToString(traceID[:]) + "-" + hex.EncodeToString(spanID[:]) + "-01"
+}
+
+type headersKey struct{}
+
+// WithHeaders stores the headers of the message being handled, so code deeper
+// in the call can set causation and trace on the messages it produces.
+func WithHeaders(ctx context.Context, h Headers) context.Context {
+	return context.WithValue(ctx, headersKey{}, h)
+}
+
+func HeadersFromContext(ctx context.Context) Headers {
+	h, _ := ctx.Value(headersKey{}).(Headers)
+	return h
+}
@@ -2,10 +2,10 @@ package broker
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"log"
 	"shop/pkg/inbox"
+	"strconv"
 	"sync"
 
 	"github.com/IBM/sarama"
@@ -16,50 +16,78 @@ type KafkaBroker struct {
 	consumer sarama.ConsumerGroup
 	inbox    inbox.Inbox
 	logger   *log.Logger
-	subs     map[string]Handler
+	subs     map[string]subscription
 	mu       sync.Mutex
+	// txMu serializes producer transactions, the outbox worker and
+	// dead-lettering share one transactional producer.
+	txMu        sync.Mutex
+	concurrency int
+	stats       *consumerStats
 }
 
-func NewKafkaBroker(producer sarama.SyncProducer, consumer sarama.ConsumerGroup, logger *log.Logger) *KafkaBroker {
-	return &KafkaBroker{producer: producer, consumer: consumer, logger: logger, subs: make(map[string]Handler)}
+func NewKafkaBroker(producer sarama.SyncProducer, consumer sarama.ConsumerGroup, group string, logger *log.Logger) *KafkaBroker {
+	return &KafkaBroker{
+		producer: producer,
+		consumer: consumer,
+		logger:   logger,
+		subs:     make(map[string]subscription),
+		stats:    newConsumerStats(group),
+	}
+}
+
+// Stats reports lag and progress of the partitions claimed in the current
+// session.
+func (b *KafkaBroker) Stats() ConsumerStats {
+	return b.stats.snapshot()
 }
 
 func (b *KafkaBroker) Publish(message Message) error {
-	msg, err := json.Marshal(message)
+	partition, offset, err := b.producer.SendMessage(producerMessage(message))
 	if err != nil {
+		b.logger.Printf("Failed to send message: %v", err)
 		return err
 	}
 
-	m := &sarama.ProducerMessage{
-		Key:   sarama.StringEncoder(message.Key),
-		Topic: message.Topic,
-		Value: sarama.StringEncoder(msg),
-	}
+	b.logger.Printf("Message sent to topic %s, partition %d, offset %d\n", message.Topic, partition, offset)
 
-	partition, offset, err := b.producer.SendMessage(m)
-	if err != nil {
-		b.logger.Fatalf("Failed to send message: %v", err)
+	return nil
+}
+
+func producerMessage(message Message) *sarama.ProducerMessage {
+	var headers []sarama.RecordHeader
+	for k, v := range message.Headers {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
 	}
 
-	b.logger.Printf("Message sent to topic %s, partition %d, offset %d\n", message.Topic, partition, offset)
+	return &sarama.ProducerMessage{
+		Topic:   message.Topic,
+		Key:     sarama.StringEncoder(message.Key),
+		Value:   sarama.ByteEncoder(message.Value),
+		Headers: headers,
+	}
+}
 
-	return nil
+func consumerHeaders(message *sarama.ConsumerMessage) Headers {
+	headers := make(Headers, len(message.Headers))
+	for _, h := range message.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	return headers
 }
 
 func (b *KafkaBroker) PublishBatch(messages []Message) error {
+	b.txMu.Lock()
+	defer b.txMu.Unlock()
+
 	err := b.producer.BeginTxn()
 	if err != nil {
-		b.logger.Fatalf("Failed to begin transaction: %v", err)
+		b.logger.Printf("Failed to begin transaction: %v", err)
 		return err
 	}
 
 	var saramaMessages []*sarama.ProducerMessage
 	for _, msg := range messages {
-		saramaMessages = append(saramaMessages, &sarama.ProducerMessage{
-			Topic: msg.Topic,
-			Key:   sarama.StringEncoder(msg.Key),
-			Value: sarama.StringEncoder(msg.Value),
-		})
+		saramaMessages = append(saramaMessages, producerMessage(msg))
 	}
 
 	err = b.producer.SendMessages(saramaMessages)
@@ -85,6 +113,13 @@ func (b *KafkaBroker) PublishBatch(messages []Message) error {
 }
 
 func (b *KafkaBroker) Subscribe(topic string, handler Handler) error {
+	return b.SubscribeWithRetry(topic, handler, DefaultRetryPolicy)
+}
+
+// SubscribeWithRetry subscribes handler with its own retry policy. A message
+// that still fails after the last attempt is moved to the topic's dead-letter
+// topic, and consumption continues with the next message.
+func (b *KafkaBroker) SubscribeWithRetry(topic string, handler Handler, policy RetryPolicy) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -92,24 +127,75 @@ func (b *KafkaBroker) Subscribe(topic string, handler Handler) error {
 		return errors.New("already subscribed")
 	}
 
-	b.subs[topic] = handler
+	b.subs[topic] = subscription{handler: handler, policy: policy}
 
 	return nil
 }
 
-func (b *KafkaBroker) StartConsume(topics []string) {
+// SetConcurrency turns on concurrent processing inside a partition: messages
+// are spread over n lanes by key, so messages with the same key are still
+// handled in order. Offsets are only marked once every earlier message in
+// the partition has finished. n <= 1 keeps strictly sequential processing.
+// Call it before StartConsume.
+func (b *KafkaBroker) SetConcurrency(n int) {
+	b.concurrency = n
+}
+
+func (b *KafkaBroker) deadLetter(message *sarama.ConsumerMessage, cause error, attempts int) error {
+	if b.producer == nil {
+		return errors.New("no producer for dead-letter topic")
+	}
+
+	b.txMu.Lock()
+	defer b.txMu.Unlock()
+
+	err := b.producer.BeginTxn()
+	if err != nil {
+		return err
+	}
+
+	headers := consumerHeaders(message)
+	headers[HeaderDeadLetterError] = cause.Error()
+	headers[HeaderDeadLetterAttempts] = strconv.Itoa(attempts)
+	headers[HeaderDeadLetterTopic] = message.Topic
+	headers[HeaderDeadLetterPartition] = strconv.FormatInt(int64(message.Partition), 10)
+	headers[HeaderDeadLetterOffset] = strconv.FormatInt(message.Offset, 10)
+
+	_, _, err = b.producer.SendMessage(producerMessage(Message{
+		Topic:   DeadLetterTopic(message.Topic),
+		Key:     string(message.Key),
+		Value:   message.Value,
+		Headers: headers,
+	}))
+	if err != nil {
+		if abortErr := b.producer.AbortTxn(); abortErr != nil {
+			b.logger.Printf("Failed to abort transaction: %v", abortErr)
+		}
+		return err
+	}
+
+	return b.producer.CommitTxn()
+}
+
+// StartConsume consumes topics until ctx is cancelled. On cancellation the
+// message in flight is finished and its offset marked before the session
+// ends, so nothing is lost or handled twice.
+func (b *KafkaBroker) StartConsume(ctx context.Context, topics []string) error {
 	b.logger.Println("Start consume kafka")
 
 	for {
 		err := b.consumer.Consume(
-			context.Background(),
+			ctx,
 			topics,
 			&consumerGroupHandler{broker: b},
 		)
+		if ctx.Err() != nil || errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			b.logger.Println("Stop consume kafka")
+			return nil
+		}
 		if err != nil {
 			b.logger.Printf("Error while consuming: %v", err)
-			b.consumer.Close()
-			break
+			return err
 		}
 	}
 }
@@ -118,39 +204,40 @@ type consumerGroupHandler struct {
 	broker *KafkaBroker
 }
 
-func (h *consumerGroupHandler) Setup(sarama.ConsumerGroupSession) error {
-	h.broker.logger.Println("Setup kafka consumer")
+func (h *consumerGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	h.broker.logger.Printf("Setup kafka consumer, generation %d, claims %v", session.GenerationID(), session.Claims())
+	h.broker.stats.sessionStarted()
 	return nil
 }
 
 func (h *consumerGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
 	h.broker.logger.Println("Cleanup kafka consumer")
+	h.broker.stats.sessionEnded()
 	return nil
 }
 
 func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		h.broker.logger.Printf("Message claimed: value = %s, topic = %s, partition = %d, offset = %d", message.Value, message.Topic, message.Partition, message.Offset)
-		msg := Message{
-			Topic: message.Topic,
-			Key:   string(message.Key),
-			Value: message.Value,
-		}
+	// the initial offset is negative when the group has not committed yet
+	if claim.InitialOffset() >= 0 {
+		h.broker.stats.position(claim.Topic(), claim.Partition(), claim.InitialOffset(), claim.HighWaterMarkOffset())
+	}
 
-		handler, ok := h.broker.subs[message.Topic]
-		if !ok {
-			h.broker.logger.Printf("Cannot find handler for topic %s\n", message.Topic)
-			return errors.New("not subscribed")
-		}
+	if h.broker.concurrency > 1 {
+		return h.consumeConcurrently(session, claim, h.broker.concurrency)
+	}
 
-		err := handler.Handle(msg)
+	for message := range claim.Messages() {
+		done, err := h.process(session, message)
 		if err != nil {
-			h.broker.logger.Printf("Error handling message: %v", err)
 			return err
 		}
+		if !done {
+			return nil
+		}
 
 		h.broker.logger.Printf("Marking message as processed for topic %s\n", message.Topic)
 		session.MarkMessage(message, "")
+		h.broker.stats.processed(message.Topic, message.Partition, message.Offset, claim.HighWaterMarkOffset())
 		h.broker.logger.Printf("Message marked as processed for topic %s\n", message.Topic)
 
 		// manual commit (slow) (very slow?)
@@ -158,3 +245,44 @@ func (h *consumerGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession,
 	}
 	return nil
 }
+
+// process handles one message, retrying it and moving it to the dead-letter
+// topic if needed. It reports false when the session ended before the message
+// was done; such a message must not be marked.
+func (h *consumerGroupHandler) process(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) (bool, error) {
+	h.broker.logger.Printf("Message claimed: value = %s, topic = %s, partition = %d, offset = %d", message.Value, message.Topic, message.Partition, message.Offset)
+	msg := Message{
+		Topic:   message.Topic,
+		Key:     string(message.Key),
+		Value:   message.Value,
+		Headers: consumerHeaders(message),
+	}
+
+	h.broker.mu.Lock()
+	sub, ok := h.broker.subs[message.Topic]
+	h.broker.mu.Unlock()
+	if !ok {
+		h.broker.logger.Printf("Cannot find handler for topic %s\n", message.Topic)
+		return false, errors.New("not subscribed")
+	}
+
+	attempts, err := handleWithRetry(session.Context(), h.broker.logger, sub, msg)
+	if err != nil && session.Context().Err() != nil {
+		// rebalance or shutdown, the message will be redelivered
+		return false, nil
+	}
+	h.broker.stats.handled(attempts, err)
+	if err == nil {
+		return true, nil
+	}
+
+	h.broker.logger.Printf("Moving message to %s after %d attempts: %v", DeadLetterTopic(message.Topic), attempts, err)
+	err = h.broker.deadLetter(message, err, attempts)
+	if err != nil {
+		h.broker.logger.Printf("Failed to send message to dead-letter topic: %v", err)
+		return false, err
+	}
+	h.broker.stats.deadLetter()
+
+	return true, nil
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// fakeConsumerGroup returns the errors of results from Consume in turn, then
+// blocks until the context is cancelled, as sarama does.
+type fakeConsumerGroup struct {
+	sarama.ConsumerGroup
+	mu      sync.Mutex
+	results []error
+	calls   int
+}
+
+func (g *fakeConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.mu.Lock()
+	g.calls++
+	if len(g.results) > 0 {
+		err := g.results[0]
+		g.results = g.results[1:]
+		g.mu.Unlock()
+		return err
+	}
+	g.mu.Unlock()
+
+	<-ctx.Done()
+	return nil
+}
+
+func TestStartConsumeReturnsOnCancel(t *testing.T) {
+	// the first session ends with a rebalance, the next one runs until cancel
+	consumer := &fakeConsumerGroup{results: []error{nil}}
+	b := NewKafkaBroker(nil, consumer, "orders-group", discard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- b.StartConsume(ctx, []string{"orders"})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("StartConsume() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("StartConsume did not return after cancel")
+	}
+	if consumer.calls != 2 {
+		t.Errorf("Consume called %d times, want 2", consumer.calls)
+	}
+}
+
+func TestStartConsumeReturnsWhenClosed(t *testing.T) {
+	boom := errors.New("boom")
+
+	tests := []struct {
+		name   string
+		result error
+		want   error
+	}{
+		{name: "closed", result: sarama.ErrClosedConsumerGroup},
+		{name: "failed", result: boom, want: boom},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewKafkaBroker(nil, &fakeConsumerGroup{results: []error{tt.result}}, "orders-group", discard)
+
+			err := b.StartConsume(context.Background(), []string{"orders"})
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("StartConsume() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultMemoryRetryInterval is how long StartConsume waits before it hands
+// a failed message to its handler again.
+const defaultMemoryRetryInterval = 100 * time.Millisecond
+
+var (
+	_ Client = (*MemoryBroker)(nil)
+	_ Client = (*MemoryGroup)(nil)
+)
+
+// MemoryBroker keeps a Kafka-like log in memory: topics split into partitions
+// by message key, and consumer groups with their own offsets. Nothing is
+// delivered until Step, Drain, Run or StartConsume is called, so tests decide
+// exactly when each message is handled.
+type MemoryBroker struct {
+	mu            sync.Mutex
+	partitions    int
+	log           map[string][][]Message
+	groups        []*MemoryGroup
+	cursor        int
+	failNext      error
+	published     chan struct{}
+	retryInterval time.Duration
+	logger        *log.Logger
+	*MemoryGroup
+}
+
+// MemoryGroup is one consumer group on a MemoryBroker. Give each service its
+// own group, as each service has its own Kafka consumer group. A group is a
+// Client, so a service can be wired to it instead of Kafka.
+type MemoryGroup struct {
+	broker  *MemoryBroker
+	name    string
+	subs    map[string]Handler
+	offsets map[string][]int
+	stats   *consumerStats
+}
+
+type memoryClaim struct {
+	group     *MemoryGroup
+	topic     string
+	partition int
+}
+
+func NewMemoryBroker(partitions int, logger *log.Logger) *MemoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	b := &MemoryBroker{
+		partitions:    partitions,
+		log:           make(map[string][][]Message),
+		published:     make(chan struct{}),
+		retryInterval: defaultMemoryRetryInterval,
+		logger:        logger,
+	}
+	b.MemoryGroup = b.Group("default")
+
+	return b
+}
+
+// Group returns the consumer group with the given name, creating it on first use.
+func (b *MemoryBroker) Group(name string) *MemoryGroup {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, g := range b.groups {
+		if g.name == name {
+			return g
+		}
+	}
+
+	g := &MemoryGroup{
+		broker:  b,
+		name:    name,
+		subs:    make(map[string]Handler),
+		offsets: make(map[string][]int),
+		stats:   newConsumerStats(name),
+	}
+	b.groups = append(b.groups, g)
+
+	return g
+}
+
+// SetRetryInterval sets how long StartConsume waits before it retries a
+// failed message.
+func (b *MemoryBroker) SetRetryInterval(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.retryInterval = d
+}
+
+// FailNextPublish makes the next Publish or PublishBatch return err without
+// storing anything.
+func (b *MemoryBroker) FailNextPublish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failNext = err
+}
+
+func (b *MemoryBroker) publish(messages []Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failNext != nil {
+		err := b.failNext
+		b.failNext = nil
+		return err
+	}
+
+	for _, m := range messages {
+		if m.Topic == "" {
+			return errors.New("message topic is empty")
+		}
+	}
+
+	for _, m := range messages {
+		if _, ok := b.log[m.Topic]; !ok {
+			b.log[m.Topic] = make([][]Message, b.partitions)
+		}
+		p := partitionFor([]byte(m.Key), b.partitions)
+		m.Headers = m.Headers.Clone()
+		b.log[m.Topic][p] = append(b.log[m.Topic][p], m)
+	}
+
+	// wake every waiting consumer
+	close(b.published)
+	b.published = make(chan struct{})
+
+	return nil
+}
+
+// wait returns a channel that is closed by the next publish.
+func (b *MemoryBroker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.published
+}
+
+// Pending returns how many messages subscribed groups have not consumed yet.
+func (b *MemoryBroker) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, c := range b.claims() {
+		n += len(b.messages(c.topic, c.partition)) - c.group.offset(c.topic, c.partition)
+	}
+
+	return n
+}
+
+// messages returns the log of a partition, nil for a topic nobody published to.
+func (b *MemoryBroker) messages(topic string, partition int) []Message {
+	partitions, ok := b.log[topic]
+	if !ok {
+		return nil
+	}
+	return partitions[partition]
+}
+
+// claims lists every subscribed group, topic and partition in a stable order.
+func (b *MemoryBroker) claims() []memoryClaim {
+	var claims []memoryClaim
+	for _, g := range b.groups {
+		var topics []string
+		for topic := range g.subs {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+
+		for _, topic := range topics {
+			for p := 0; p < b.partitions; p++ {
+				claims = append(claims, memoryClaim{group: g, topic: topic, partition: p})
+			}
+		}
+	}
+
+	return claims
+}
+
+// Step delivers one message and reports whether there was one. Claims are
+// visited round robin, and within a partition messages are delivered in
+// publish order. A handler error leaves the message at the head of its
+// partition, like an uncommitted Kafka offset.
+func (b *MemoryBroker) Step() (bool, error) {
+	return b.step(func(memoryClaim) bool { return true })
+}
+
+// step is Step restricted to the claims accepted by owns.
+func (b *MemoryBroker) step(owns func(c memoryClaim) bool) (bool, error) {
+	b.mu.Lock()
+
+	claims := b.claims()
+	for i := 0; i < len(claims); i++ {
+		idx := (b.cursor + i) % len(claims)
+		c := claims[idx]
+		if !owns(c) {
+			continue
+		}
+
+		offset := c.group.offset(c.topic, c.partition)
+		messages := b.messages(c.topic, c.partition)
+		if offset >= len(messages) {
+			continue
+		}
+
+		b.cursor = idx + 1
+		message := messages[offset]
+		handler := c.group.subs[c.topic]
+		b.mu.Unlock()
+
+		err := handler.Handle(message)
+		c.group.stats.handled(1, err)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if err != nil {
+			return true, fmt.Errorf("group %s, topic %s, partition %d, offset %d: %w", c.group.name, c.topic, c.partition, offset, err)
+		}
+		c.group.offsets[c.topic][c.partition] = offset + 1
+		c.group.stats.processed(c.topic, int32(c.partition), int64(offset), int64(len(b.messages(c.topic, c.partition))))
+
+		return true, nil
+	}
+
+	b.mu.Unlock()
+
+	return false, nil
+}
+
+// Drain steps until no subscribed message is left, the first handler error,
+// or maxSteps deliveries.
+func (b *MemoryBroker) Drain(maxSteps int) error {
+	for i := 0; i < maxSteps; i++ {
+		delivered, err := b.Step()
+		if err != nil {
+			return err
+		}
+		if !delivered {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("broker not drained after %d steps", maxSteps)
+}
+
+// Run consumes for all groups until ctx is cancelled. A failed message is
+// retried after retryInterval.
+func (b *MemoryBroker) Run(ctx context.Context, retryInterval time.Duration) {
+	b.consume(ctx, func(memoryClaim) bool { return true }, retryInterval)
+}
+
+func (b *MemoryBroker) consume(ctx context.Context, owns func(c memoryClaim) bool, retryInterval time.Duration) {
+	for ctx.Err() == nil {
+		published := b.wait()
+		delivered, err := b.step(owns)
+		if err != nil {
+			if b.logger != nil {
+				b.logger.Printf("Error handling message: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+		if delivered {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-published:
+		}
+	}
+}
+
+func (g *MemoryGroup) Publish(message Message) error {
+	return g.broker.publish([]Message{message})
+}
+
+// PublishBatch stores all messages or none of them.
+func (g *MemoryGroup) PublishBatch(messages []Message) error {
+	return g.broker.publish(messages)
+}
+
+func (g *MemoryGroup) Subscribe(topic string, handler Handler) error {
+	g.broker.mu.Lock()
+	defer g.broker.mu.Unlock()
+
+	if _, ok := g.subs[topic]; ok {
+		return errors.New("already subscribed")
+	}
+
+	g.subs[topic] = handler
+	g.offsets[topic] = make([]int, g.broker.partitions)
+
+	return nil
+}
+
+// StartConsume consumes the subscribed topics of the group until ctx is
+// cancelled, like the Kafka consumer group of a service. Other groups are
+// not driven, so every service of a test can start its own.
+func (g *MemoryGroup) StartConsume(ctx context.Context, topics []string) error {
+	b := g.broker
+
+	b.mu.Lock()
+	owned := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if _, ok := g.subs[topic]; !ok {
+			b.mu.Unlock()
+			return fmt.Errorf("no handler subscribed to topic %s", topic)
+		}
+		owned[topic] = true
+	}
+	retryInterval := b.retryInterval
+	b.mu.Unlock()
+
+	g.stats.sessionStarted()
+	defer g.stats.sessionEnded()
+
+	b.consume(ctx, func(c memoryClaim) bool { return c.group == g && owned[c.topic] }, retryInterval)
+
+	return nil
+}
+
+func (g *MemoryGroup) Stats() ConsumerStats {
+	return g.stats.snapshot()
+}
+
+func (g *MemoryGroup) offset(topic string, partition int) int {
+	offsets, ok := g.offsets[topic]
+	if !ok {
+		return 0
+	}
+	return offsets[partition]
+}
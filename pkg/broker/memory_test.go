@@ -0,0 +1,313 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a handler that remembers the values it was given and fails
+// while fail returns an error.
+type recorder struct {
+	mu     sync.Mutex
+	values []string
+	fail   func(m Message) error
+}
+
+func (r *recorder) Handle(m Message) error {
+	if r.fail != nil {
+		if err := r.fail(m); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values = append(r.values, string(m.Value))
+	return nil
+}
+
+func (r *recorder) got() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.values...)
+}
+
+// byKey groups values of the form "key:n" by key, keeping their order.
+func byKey(values []string) map[string][]string {
+	keys := make(map[string][]string)
+	for _, v := range values {
+		key, _, _ := strings.Cut(v, ":")
+		keys[key] = append(keys[key], v)
+	}
+	return keys
+}
+
+func TestMemoryBrokerPartitionOrder(t *testing.T) {
+	b := NewMemoryBroker(3, nil)
+	r := &recorder{}
+	if err := b.Subscribe("orders", r); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	var messages []Message
+	for i := 0; i < 5; i++ {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			v := key + ":" + string(rune('0'+i))
+			messages = append(messages, Message{Topic: "orders", Key: key, Value: []byte(v)})
+		}
+	}
+	for _, m := range messages {
+		if err := b.Publish(m); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	if err := b.Drain(100); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+
+	got := byKey(r.got())
+	for _, key := range []string{"a", "b", "c", "d"} {
+		want := []string{key + ":0", key + ":1", key + ":2", key + ":3", key + ":4"}
+		if !reflect.DeepEqual(got[key], want) {
+			t.Errorf("key %s delivered %v, want %v", key, got[key], want)
+		}
+	}
+	if n := b.Pending(); n != 0 {
+		t.Errorf("pending = %d, want 0", n)
+	}
+}
+
+func TestMemoryBrokerStep(t *testing.T) {
+	b := NewMemoryBroker(1, nil)
+
+	delivered, err := b.Step()
+	if delivered || err != nil {
+		t.Fatalf("step without subscriptions = %v, %v, want false, nil", delivered, err)
+	}
+
+	failing := true
+	r := &recorder{fail: func(m Message) error {
+		if failing {
+			return errors.New("handler failed")
+		}
+		return nil
+	}}
+	if err = b.Subscribe("orders", r); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	for _, v := range []string{"first", "second"} {
+		if err = b.Publish(Message{Topic: "orders", Key: "k", Value: []byte(v)}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	delivered, err = b.Step()
+	if !delivered || err == nil {
+		t.Fatalf("failing step = %v, %v, want true and an error", delivered, err)
+	}
+	if n := b.Pending(); n != 2 {
+		t.Fatalf("pending after failure = %d, want 2", n)
+	}
+
+	failing = false
+	for _, want := range []int{1, 0} {
+		delivered, err = b.Step()
+		if !delivered || err != nil {
+			t.Fatalf("step = %v, %v, want true, nil", delivered, err)
+		}
+		if n := b.Pending(); n != want {
+			t.Errorf("pending = %d, want %d", n, want)
+		}
+	}
+	if got := r.got(); !reflect.DeepEqual(got, []string{"first", "second"}) {
+		t.Errorf("delivered %v, want the failed message first", got)
+	}
+
+	delivered, err = b.Step()
+	if delivered || err != nil {
+		t.Errorf("step on empty log = %v, %v, want false, nil", delivered, err)
+	}
+}
+
+func TestMemoryBrokerDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		fail     bool
+		messages int
+		maxSteps int
+		wantErr  string
+	}{
+		{name: "drains every message", messages: 3, maxSteps: 10},
+		{name: "stops at the step limit", messages: 3, maxSteps: 2, wantErr: "not drained after 2 steps"},
+		{name: "stops at the first handler error", fail: true, messages: 3, maxSteps: 10, wantErr: "handler failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemoryBroker(1, nil)
+			r := &recorder{}
+			if tt.fail {
+				r.fail = func(Message) error { return errors.New("handler failed") }
+			}
+			if err := b.Subscribe("orders", r); err != nil {
+				t.Fatalf("subscribe: %v", err)
+			}
+			for i := 0; i < tt.messages; i++ {
+				if err := b.Publish(Message{Topic: "orders", Key: "k", Value: []byte("v")}); err != nil {
+					t.Fatalf("publish: %v", err)
+				}
+			}
+
+			err := b.Drain(tt.maxSteps)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("drain: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("drain error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerFailNextPublish(t *testing.T) {
+	b := NewMemoryBroker(2, nil)
+	r := &recorder{}
+	if err := b.Subscribe("orders", r); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	batch := []Message{
+		{Topic: "orders", Key: "a", Value: []byte("a:0")},
+		{Topic: "orders", Key: "b", Value: []byte("b:0")},
+	}
+	failure := errors.New("broker down")
+	b.FailNextPublish(failure)
+	if err := b.PublishBatch(batch); !errors.Is(err, failure) {
+		t.Fatalf("publish batch = %v, want %v", err, failure)
+	}
+	if n := b.Pending(); n != 0 {
+		t.Fatalf("pending after failed batch = %d, want 0", n)
+	}
+
+	// a batch with an invalid message is not stored either
+	invalid := append([]Message{{Topic: "orders", Key: "c", Value: []byte("c:0")}}, Message{Key: "d"})
+	if err := b.PublishBatch(invalid); err == nil {
+		t.Fatal("publish batch with an empty topic succeeded")
+	}
+	if n := b.Pending(); n != 0 {
+		t.Fatalf("pending after invalid batch = %d, want 0", n)
+	}
+
+	// the failure is used up by one publish
+	if err := b.PublishBatch(batch); err != nil {
+		t.Fatalf("publish batch: %v", err)
+	}
+	if err := b.Drain(10); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if got := len(r.got()); got != 2 {
+		t.Errorf("delivered %d messages, want 2", got)
+	}
+}
+
+func TestMemoryGroupsHaveOwnOffsets(t *testing.T) {
+	b := NewMemoryBroker(1, nil)
+	gateway, history := &recorder{}, &recorder{}
+	if err := b.Group("gateway").Subscribe("orders", gateway); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := b.Group("history").Subscribe("orders", history); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if b.Group("gateway") != b.Group("gateway") {
+		t.Fatal("Group returned a new group for a known name")
+	}
+
+	if err := b.Publish(Message{Topic: "orders", Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := b.Drain(10); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+
+	if len(gateway.got()) != 1 || len(history.got()) != 1 {
+		t.Errorf("gateway got %v and history got %v, want the message once each", gateway.got(), history.got())
+	}
+}
+
+func TestMemoryGroupStartConsume(t *testing.T) {
+	b := NewMemoryBroker(2, nil)
+	b.SetRetryInterval(time.Millisecond)
+	g := b.Group("service")
+
+	if err := g.StartConsume(context.Background(), []string{"orders"}); err == nil {
+		t.Fatal("start consume of a topic without handler succeeded")
+	}
+
+	attempts := 0
+	done := make(chan struct{})
+	r := &recorder{fail: func(m Message) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("first attempt fails")
+		}
+		return nil
+	}}
+	var once sync.Once
+	handler := HandlerFunc(func(ctx context.Context, m Message) error {
+		err := r.Handle(m)
+		if err == nil {
+			once.Do(func() { close(done) })
+		}
+		return err
+	})
+	if err := g.Subscribe("orders", handler); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	other := &recorder{}
+	if err := b.Group("other").Subscribe("orders", other); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- g.StartConsume(ctx, []string{"orders"})
+	}()
+
+	if err := b.Publish(Message{Topic: "orders", Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not consumed")
+	}
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Fatalf("start consume: %v", err)
+	}
+
+	stats := g.Stats()
+	if stats.Group != "service" || stats.Attempts != 2 || stats.Failed != 1 {
+		t.Errorf("stats = %+v, want 2 attempts and 1 failure of group service", stats)
+	}
+	if !stats.Rebalancing {
+		t.Error("stats of a stopped consumer are not rebalancing")
+	}
+	if len(other.got()) != 0 {
+		t.Errorf("StartConsume drove another group: %v", other.got())
+	}
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics counts handled messages per topic and message type.
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[[2]string]*HandlerStats
+}
+
+type HandlerStats struct {
+	Topic    string        `json:"topic"`
+	Type     string        `json:"type"`
+	Handled  int64         `json:"handled"`
+	Failed   int64         `json:"failed"`
+	Duration time.Duration `json:"duration"`
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[[2]string]*HandlerStats)}
+}
+
+func (m *Metrics) observe(topic, messageType string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{topic, messageType}
+	s, ok := m.stats[key]
+	if !ok {
+		s = &HandlerStats{Topic: topic, Type: messageType}
+		m.stats[key] = s
+	}
+	s.Handled++
+	if err != nil {
+		s.Failed++
+	}
+	s.Duration += d
+}
+
+// Stats returns a copy of the counters sorted by topic and type.
+func (m *Metrics) Stats() []HandlerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make([]HandlerStats, 0, len(m.stats))
+	for _, s := range m.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Topic != stats[j].Topic {
+			return stats[i].Topic < stats[j].Topic
+		}
+		return stats[i].Type < stats[j].Type
+	})
+
+	return stats
+}
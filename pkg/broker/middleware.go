@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"shop/pkg/inbox"
+	"time"
+)
+
+// HandlerFunc is a Handler that takes a context, so middlewares can pass the
+// transaction and the message headers down to the handler.
+type HandlerFunc func(ctx context.Context, message Message) error
+
+func (f HandlerFunc) Handle(message Message) error {
+	return f(context.Background(), message)
+}
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Chain wraps h with middlewares, the first one being the outermost.
+func Chain(h HandlerFunc, middlewares ...Middleware) HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Recover turns a panic in the handler into an error, so the consumer keeps
+// running and the retry policy decides what happens to the message.
+func Recover(logger *log.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, message Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Printf("Panic handling message %s from %s: %v\n%s", message.Key, message.Topic, r, debug.Stack())
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return next(ctx, message)
+		}
+	}
+}
+
+func Logging(logger *log.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, message Message) error {
+			messageType, messageID := MessageType(message), MessageID(message)
+			logger.Printf("Handling message %s from %s: type = %s, id = %s", message.Key, message.Topic, messageType, messageID)
+
+			start := time.Now()
+			err := next(ctx, message)
+			if err != nil {
+				logger.Printf("Failed message %s (%s) in %s: %v", messageID, messageType, time.Since(start), err)
+				return err
+			}
+
+			logger.Printf("Handled message %s (%s) in %s", messageID, messageType, time.Since(start))
+			return nil
+		}
+	}
+}
+
+func Measure(metrics *Metrics) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, message Message) error {
+			start := time.Now()
+			err := next(ctx, message)
+			metrics.observe(message.Topic, MessageType(message), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Trace puts the message headers in the context, starting a trace when the
+// message has none. Messages published while handling it become its children.
+func Trace() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, message Message) error {
+			headers := message.Headers.Clone()
+			if headers == nil {
+				headers = Headers{}
+			}
+			if headers.Get(HeaderMessageID) == "" {
+				headers[HeaderMessageID] = MessageID(message)
+			}
+			if headers.Get(HeaderTraceParent) == "" {
+				headers[HeaderTraceParent] = NewTraceParent()
+			}
+			return next(WithHeaders(ctx, headers), message)
+		}
+	}
+}
+
+// Idempotent handles each message once through the inbox: the inbox row and
+// the handler's work commit in one transaction, duplicates are skipped. The
+// handler and the repositories it calls find the transaction in ctx. The
+// inbox owns the retries: a failure recorded in the inbox, a message that
+// arrives out of order among them, is acknowledged, and the inbox worker
+// handles it again or parks it. Only messages that never reach the inbox are
+// retried by the broker and dead-lettered.
+func Idempotent(processor *inbox.Processor) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, message Message) error {
+			m, err := InboxMessage(message)
+			if err != nil {
+				return Permanent(err)
+			}
+
+			err = processor.Process(ctx, m, func(ctx context.Context) error {
+				return next(ctx, message)
+			})
+			if inbox.IsRecorded(err) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// InboxMessage returns the inbox row for message.
+func InboxMessage(message Message) (inbox.Message, error) {
+	messageID := MessageID(message)
+	if messageID == "" {
+		return inbox.Message{}, errors.New("message has no id")
+	}
+	aggregateID, sequence, err := Sequence(message)
+	if err != nil {
+		return inbox.Message{}, err
+	}
+
+	return inbox.Message{
+		MessageID:   messageID,
+		MessageType: MessageType(message),
+		Topic:       message.Topic,
+		Key:         message.Key,
+		Payload:     message.Value,
+		Headers:     message.Headers,
+		AggregateID: aggregateID,
+		Sequence:    sequence,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// InboxHandler lets the inbox worker run h on stored messages. h must contain
+// Idempotent, so the message is marked completed or its failure recorded.
+func InboxHandler(h Handler) inbox.Handler {
+	return func(ctx context.Context, m inbox.Message) error {
+		message := Message{
+			Topic:   m.Topic,
+			Key:     m.Key,
+			Value:   m.Payload,
+			Headers: Headers(m.Headers),
+		}
+		if f, ok := h.(HandlerFunc); ok {
+			return f(ctx, message)
+		}
+		return h.Handle(message)
+	}
+}
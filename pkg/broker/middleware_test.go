@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"reflect"
+	"shop/pkg/inbox"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/IBM/sarama"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, m Message) error {
+				calls = append(calls, name+" before")
+				err := next(ctx, m)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	h := Chain(func(ctx context.Context, m Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}, record("outer"), record("inner"))
+
+	if err := h.Handle(Message{}); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := Chain(func(ctx context.Context, m Message) error {
+		panic("boom")
+	}, Recover(discard))
+
+	err := h.Handle(Message{Topic: "orders"})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("err = %v, want the panic as an error", err)
+	}
+	if IsPermanent(err) {
+		t.Error("a panic is permanent, want it retried")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers Headers
+	}{
+		{name: "starts a trace", headers: nil},
+		{name: "keeps the trace", headers: Headers{HeaderMessageID: "message-1", HeaderTraceParent: "00-trace-span-01"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Headers
+			h := Chain(func(ctx context.Context, m Message) error {
+				got = HeadersFromContext(ctx)
+				return nil
+			}, Trace())
+
+			message := Message{Value: []byte(`{"event_id":"event-1"}`), Headers: tt.headers}
+			if err := h.Handle(message); err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+
+			if got.Get(HeaderTraceParent) == "" {
+				t.Error("no traceparent in the context")
+			}
+			if tt.headers != nil {
+				if !reflect.DeepEqual(got, tt.headers) {
+					t.Errorf("headers = %v, want %v", got, tt.headers)
+				}
+				return
+			}
+			if got.Get(HeaderMessageID) != "event-1" {
+				t.Errorf("message id = %q, want the id from the payload", got.Get(HeaderMessageID))
+			}
+			if message.Headers != nil {
+				t.Error("Trace changed the headers of the message")
+			}
+		})
+	}
+}
+
+func TestChainPassesErrors(t *testing.T) {
+	failure := errors.New("handler failed")
+	h := Chain(func(ctx context.Context, m Message) error {
+		return failure
+	}, Recover(discard), Logging(discard), Trace())
+
+	if err := h.Handle(Message{}); !errors.Is(err, failure) {
+		t.Errorf("err = %v, want %v", err, failure)
+	}
+}
+
+func TestIdempotentLeavesRecordedFailuresToTheInbox(t *testing.T) {
+	failure := errors.New("cannot handle")
+	tests := []struct {
+		name    string
+		record  func(mock sqlmock.Sqlmock)
+		wantErr bool
+	}{
+		{
+			name: "recorded failure is acknowledged",
+			record: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO inbox`).WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(1))
+				mock.ExpectExec(`UPDATE inbox SET status`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "unrecorded failure goes back to the broker",
+			record: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin().WillReturnError(errors.New("database is gone"))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectExec(`INSERT INTO inbox`).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectRollback()
+			tt.record(mock)
+
+			handler := Chain(func(context.Context, Message) error { return failure },
+				Idempotent(inbox.NewProcessor(db, inbox.NewPostgresInbox(), discard)))
+			err = handler(context.Background(), Message{Topic: "orders", Value: []byte(`{}`), Headers: NewHeaders("create_order", "message-1", "saga-1", "")})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handler = %v, want error %v", err, tt.wantErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestHeadersRoundTrip follows the headers of a message through Kafka, the
+// inbox table and the inbox worker back to a handler.
+func TestHeadersRoundTrip(t *testing.T) {
+	headers := NewHeaders("OrderCreated", "message-1", "saga-1", "command-1")
+	headers[HeaderTraceParent] = NewTraceParent()
+	headers[HeaderAggregateID] = "order-1"
+	headers[HeaderSequence] = "3"
+	sent := Message{Topic: "order-events", Key: "saga-1", Value: []byte(`{}`), Headers: headers}
+
+	produced := producerMessage(sent)
+	consumed := &sarama.ConsumerMessage{Topic: produced.Topic, Key: []byte(sent.Key), Value: sent.Value}
+	for i := range produced.Headers {
+		consumed.Headers = append(consumed.Headers, &produced.Headers[i])
+	}
+	received := Message{Topic: consumed.Topic, Key: string(consumed.Key), Value: consumed.Value, Headers: consumerHeaders(consumed)}
+
+	m, err := InboxMessage(received)
+	if err != nil {
+		t.Fatalf("InboxMessage: %v", err)
+	}
+	if m.MessageID != "message-1" || m.MessageType != "OrderCreated" || m.AggregateID != "order-1" || m.Sequence != 3 {
+		t.Errorf("inbox message = %+v, want id, type and sequence from the headers", m)
+	}
+
+	// the inbox stores the headers as json
+	data, err := json.Marshal(m.Headers)
+	if err != nil {
+		t.Fatalf("marshal headers: %v", err)
+	}
+	stored := inbox.Message{Topic: m.Topic, Key: m.Key, Payload: m.Payload}
+	err = json.Unmarshal(data, &stored.Headers)
+	if err != nil {
+		t.Fatalf("unmarshal headers: %v", err)
+	}
+
+	var handled Message
+	h := InboxHandler(HandlerFunc(func(ctx context.Context, message Message) error {
+		handled = message
+		return nil
+	}))
+	err = h(context.Background(), stored)
+	if err != nil {
+		t.Fatalf("InboxHandler: %v", err)
+	}
+	if !maps.Equal(handled.Headers, headers) {
+		t.Errorf("handled headers = %v, want %v", handled.Headers, headers)
+	}
+	if handled.Topic != sent.Topic || handled.Key != sent.Key {
+		t.Errorf("handled %s/%s, want %s/%s", handled.Topic, handled.Key, sent.Topic, sent.Key)
+	}
+}
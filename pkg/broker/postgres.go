@@ -0,0 +1,393 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"shop/pkg/pgnotify"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const postgresChannel = "broker_messages"
+
+// DefaultPostgresLease is how long a member keeps a partition while it
+// handles one message, retries included. A member that dies with a message
+// in flight blocks the partition for this long.
+const DefaultPostgresLease = 1 * time.Minute
+
+// ErrLeaseLost means the lease on a partition expired while its message was
+// handled and the offset was left for the member that holds it now.
+var ErrLeaseLost = errors.New("partition lease lost")
+
+// PostgresBroker keeps topics in a shared Postgres database for installs
+// without Kafka. Keys are hashed to partitions like in Kafka; a partition is
+// consumed by one member of a consumer group at a time and in order, with the
+// group's position stored next to the messages. LISTEN/NOTIFY wakes
+// consumers up, polling covers lost notifications.
+type PostgresBroker struct {
+	db           *sql.DB
+	group        string
+	id           string
+	lease        time.Duration
+	partitions   int
+	pollInterval time.Duration
+	logger       *log.Logger
+	subs         map[string]subscription
+	mu           sync.Mutex
+	wakeup       chan struct{}
+	stats        *consumerStats
+}
+
+func NewPostgresBroker(db *sql.DB, group string, partitions int, pollInterval time.Duration, logger *log.Logger) *PostgresBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &PostgresBroker{
+		db:           db,
+		group:        group,
+		id:           fmt.Sprintf("%s-%s", hostname, uuid.New().String()),
+		lease:        DefaultPostgresLease,
+		partitions:   partitions,
+		pollInterval: pollInterval,
+		logger:       logger,
+		subs:         make(map[string]subscription),
+		wakeup:       make(chan struct{}, 1),
+		stats:        newConsumerStats(group),
+	}
+}
+
+// SetLease changes how long a partition is left to this member while it
+// handles a message. It must exceed the longest handling including retries,
+// see RetryPolicy. Call it before StartConsume.
+func (b *PostgresBroker) SetLease(lease time.Duration) {
+	b.lease = lease
+}
+
+// Stats reports lag and progress of the partitions this member consumed on
+// its last pass. Partitions held by another member of the group are left out.
+func (b *PostgresBroker) Stats() ConsumerStats {
+	return b.stats.snapshot()
+}
+
+func (b *PostgresBroker) Publish(message Message) error {
+	return b.PublishBatch([]Message{message})
+}
+
+// PublishBatch stores all messages or none of them.
+func (b *PostgresBroker) PublishBatch(messages []Message) error {
+	ctx := context.Background()
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = b.insert(ctx, tx, messages)
+	if err != nil {
+		b.logger.Printf("Failed to send messages: %v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type placedMessage struct {
+	message   Message
+	partition int
+}
+
+// insert appends messages to their partitions. Taking the partition rows in
+// a fixed order avoids deadlocks between batches; the row lock is held until
+// commit, so sequence numbers become visible in order.
+func (b *PostgresBroker) insert(ctx context.Context, tx *sql.Tx, messages []Message) error {
+	placed := make([]placedMessage, 0, len(messages))
+	for _, m := range messages {
+		if m.Topic == "" {
+			return errors.New("message topic is empty")
+		}
+		placed = append(placed, placedMessage{message: m, partition: partitionFor([]byte(m.Key), b.partitions)})
+	}
+	sort.SliceStable(placed, func(i, j int) bool {
+		if placed[i].message.Topic != placed[j].message.Topic {
+			return placed[i].message.Topic < placed[j].message.Topic
+		}
+		return placed[i].partition < placed[j].partition
+	})
+
+	topics := make(map[string]bool)
+	for _, p := range placed {
+		var seq int64
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO broker_partitions (topic, partition, last_seq) VALUES ($1, $2, 1)
+			ON CONFLICT (topic, partition) DO UPDATE SET last_seq = broker_partitions.last_seq + 1
+			RETURNING last_seq`,
+			p.message.Topic, p.partition,
+		).Scan(&seq)
+		if err != nil {
+			return err
+		}
+
+		headers := p.message.Headers
+		if headers == nil {
+			headers = Headers{}
+		}
+		jsonHeaders, err := json.Marshal(headers)
+		if err != nil {
+			return err
+		}
+
+		query := "INSERT INTO broker_messages (topic, partition, seq, key, value, headers, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+		_, err = tx.ExecContext(ctx, query, p.message.Topic, p.partition, seq, p.message.Key, p.message.Value, jsonHeaders, time.Now())
+		if err != nil {
+			return err
+		}
+		topics[p.message.Topic] = true
+	}
+
+	// delivered on commit
+	for topic := range topics {
+		_, err := tx.ExecContext(ctx, "SELECT pg_notify($1, $2)", postgresChannel, topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *PostgresBroker) Subscribe(topic string, handler Handler) error {
+	return b.SubscribeWithRetry(topic, handler, DefaultRetryPolicy)
+}
+
+// SubscribeWithRetry works as KafkaBroker.SubscribeWithRetry.
+func (b *PostgresBroker) SubscribeWithRetry(topic string, handler Handler, policy RetryPolicy) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[topic]; ok {
+		return errors.New("already subscribed")
+	}
+
+	b.subs[topic] = subscription{handler: handler, policy: policy}
+
+	return nil
+}
+
+// StartConsume consumes topics until ctx is cancelled. The message in flight
+// is finished and its offset stored before it returns.
+func (b *PostgresBroker) StartConsume(ctx context.Context, topics []string) error {
+	b.logger.Println("Start consume postgres")
+
+	for _, topic := range topics {
+		for p := 0; p < b.partitions; p++ {
+			query := "INSERT INTO broker_offsets (consumer_group, topic, partition) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+			_, err := b.db.ExecContext(ctx, query, b.group, topic, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	go pgnotify.Listen(ctx, b.db, postgresChannel, b.wakeup, b.pollInterval, b.logger)
+
+	b.stats.sessionStarted()
+	defer b.stats.sessionEnded()
+
+	for {
+		if ctx.Err() != nil {
+			b.logger.Println("Stop consume postgres")
+			return nil
+		}
+
+		handled := 0
+		for _, topic := range topics {
+			for p := 0; p < b.partitions; p++ {
+				ok, err := b.consumeOne(ctx, topic, p)
+				if err != nil {
+					b.logger.Printf("Error while consuming %s/%d: %v", topic, p, err)
+					continue
+				}
+				if ok {
+					handled++
+				}
+			}
+		}
+		if handled > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-b.wakeup:
+		case <-time.After(b.pollInterval):
+		}
+	}
+}
+
+// consumeOne handles the next message of a partition unless another member of
+// the group holds its lease. The lease is taken in its own statement, so no
+// transaction or row lock is open while the handler and its retries run. The
+// offset moves in the same transaction that dead-letters a failed message and
+// only while the lease is still ours, so the message is never moved twice.
+func (b *PostgresBroker) consumeOne(ctx context.Context, topic string, partition int) (bool, error) {
+	// finish the message in flight even when ctx is cancelled
+	dbCtx := context.WithoutCancel(ctx)
+
+	lastSeq, ok, err := b.acquire(dbCtx, topic, partition)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		b.stats.release(topic, int32(partition))
+		return false, nil
+	}
+
+	var head int64
+	query := "SELECT COALESCE((SELECT last_seq FROM broker_partitions WHERE topic = $1 AND partition = $2), 0)"
+	err = b.db.QueryRowContext(dbCtx, query, topic, partition).Scan(&head)
+	if err != nil {
+		return false, b.releaseAfter(dbCtx, topic, partition, err)
+	}
+	b.stats.position(topic, int32(partition), lastSeq+1, head+1)
+
+	var seq int64
+	var jsonHeaders []byte
+	message := Message{Topic: topic}
+	query = "SELECT seq, key, value, headers FROM broker_messages WHERE topic = $1 AND partition = $2 AND seq > $3 ORDER BY seq LIMIT 1"
+	err = b.db.QueryRowContext(dbCtx, query, topic, partition, lastSeq).Scan(&seq, &message.Key, &message.Value, &jsonHeaders)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, b.releaseAfter(dbCtx, topic, partition, nil)
+	}
+	if err != nil {
+		return false, b.releaseAfter(dbCtx, topic, partition, err)
+	}
+	err = json.Unmarshal(jsonHeaders, &message.Headers)
+	if err != nil {
+		return false, b.releaseAfter(dbCtx, topic, partition, err)
+	}
+
+	b.mu.Lock()
+	sub, ok := b.subs[topic]
+	b.mu.Unlock()
+	if !ok {
+		return false, b.releaseAfter(dbCtx, topic, partition, errors.New("not subscribed"))
+	}
+
+	attempts, err := handleWithRetry(ctx, b.logger, sub, message)
+	if err != nil && ctx.Err() != nil {
+		// stopped while retrying, the message stays for the next start
+		return false, b.releaseAfter(dbCtx, topic, partition, nil)
+	}
+	b.stats.handled(attempts, err)
+
+	deadLettered := err != nil
+	err = b.commit(dbCtx, topic, partition, seq, message, err, attempts)
+	if err != nil {
+		return false, err
+	}
+	b.stats.processed(topic, int32(partition), seq, head+1)
+	if deadLettered {
+		b.stats.deadLetter()
+	}
+
+	return true, nil
+}
+
+// acquire takes or renews the lease of this member on a partition and returns
+// the group's position in it. It reports false while another member holds an
+// unexpired lease.
+func (b *PostgresBroker) acquire(ctx context.Context, topic string, partition int) (int64, bool, error) {
+	now := time.Now()
+
+	var lastSeq int64
+	query := `UPDATE broker_offsets SET locked_by = $4, locked_until = $5
+		WHERE consumer_group = $1 AND topic = $2 AND partition = $3
+		AND (locked_by IS NULL OR locked_by = $4 OR locked_until < $6)
+		RETURNING last_seq`
+	err := b.db.QueryRowContext(ctx, query, b.group, topic, partition, b.id, now.Add(b.lease), now).Scan(&lastSeq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return lastSeq, true, nil
+}
+
+// releaseAfter gives the lease of a partition back, so another member can
+// take the partition right away, and returns cause.
+func (b *PostgresBroker) releaseAfter(ctx context.Context, topic string, partition int, cause error) error {
+	query := `UPDATE broker_offsets SET locked_by = NULL, locked_until = NULL
+		WHERE consumer_group = $1 AND topic = $2 AND partition = $3 AND locked_by = $4`
+	_, err := b.db.ExecContext(ctx, query, b.group, topic, partition, b.id)
+	if err != nil {
+		b.logger.Printf("Failed to release %s/%d: %v", topic, partition, err)
+	}
+
+	return cause
+}
+
+// commit moves the group past seq and gives the lease back. A message that
+// failed is dead-lettered in the same transaction. When the lease expired
+// while the handler ran, another member may have handled the message too;
+// nothing is written and ErrLeaseLost is returned.
+func (b *PostgresBroker) commit(ctx context.Context, topic string, partition int, seq int64, message Message, cause error, attempts int) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE broker_offsets SET last_seq = $4, updated_at = now(), locked_by = NULL, locked_until = NULL
+		WHERE consumer_group = $1 AND topic = $2 AND partition = $3 AND locked_by = $5 AND last_seq < $4`
+	res, err := tx.ExecContext(ctx, query, b.group, topic, partition, seq, b.id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s/%d at %d: %w", topic, partition, seq, ErrLeaseLost)
+	}
+
+	if cause != nil {
+		b.logger.Printf("Moving message to %s after %d attempts: %v", DeadLetterTopic(topic), attempts, cause)
+		headers := message.Headers.Clone()
+		if headers == nil {
+			headers = Headers{}
+		}
+		headers[HeaderDeadLetterError] = cause.Error()
+		headers[HeaderDeadLetterAttempts] = strconv.Itoa(attempts)
+		headers[HeaderDeadLetterTopic] = topic
+		headers[HeaderDeadLetterPartition] = strconv.Itoa(partition)
+		headers[HeaderDeadLetterOffset] = strconv.FormatInt(seq, 10)
+
+		err = b.insert(ctx, tx, []Message{{
+			Topic:   DeadLetterTopic(topic),
+			Key:     message.Key,
+			Value:   message.Value,
+			Headers: headers,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
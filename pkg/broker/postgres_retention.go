@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// RetentionConfig says which messages the Postgres broker retention job
+// removes. Only messages every consumer group of their partition is past are
+// removed, a group that lags behind keeps its messages however old they are.
+type RetentionConfig struct {
+	// MaxAge is how long consumed messages are kept, as the topics keep
+	// them in Kafka.
+	MaxAge time.Duration
+	// BatchSize rows are removed per transaction, so the job never holds
+	// many locks or a long transaction.
+	BatchSize int
+	Interval  time.Duration
+}
+
+var DefaultPostgresRetention = RetentionConfig{
+	MaxAge:    7 * 24 * time.Hour,
+	BatchSize: 500,
+	Interval:  1 * time.Hour,
+}
+
+// PostgresRetention removes consumed messages from broker_messages.
+// Partitions no group consumes, dead-letter topics among them, are kept.
+type PostgresRetention struct {
+	db     *sql.DB
+	config RetentionConfig
+	logger *log.Logger
+}
+
+func NewPostgresRetention(db *sql.DB, config RetentionConfig, logger *log.Logger) *PostgresRetention {
+	if config.BatchSize < 1 {
+		config.BatchSize = DefaultPostgresRetention.BatchSize
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultPostgresRetention.Interval
+	}
+
+	return &PostgresRetention{db: db, config: config, logger: logger}
+}
+
+// Start purges the broker now and every interval until ctx is cancelled.
+func (r *PostgresRetention) Start(ctx context.Context) {
+	for {
+		n, err := r.Purge(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.logger.Printf("broker retention failed after removing %d messages: %v", n, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.config.Interval):
+		}
+	}
+}
+
+// Purge removes consumed messages older than MaxAge batch by batch and
+// returns how many it removed.
+func (r *PostgresRetention) Purge(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-r.config.MaxAge)
+
+	var total int64
+	for {
+		n, err := r.purgeBatch(ctx, cutoff)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < int64(r.config.BatchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		r.logger.Printf("broker retention deleted %d consumed messages created before %s", total, cutoff.Format(time.RFC3339))
+	}
+
+	return total, nil
+}
+
+// purgeBatch deletes messages at or below the lowest position of the groups
+// consuming their partition.
+func (r *PostgresRetention) purgeBatch(ctx context.Context, cutoff time.Time) (int64, error) {
+	query := `DELETE FROM broker_messages WHERE (topic, partition, seq) IN (
+			SELECT m.topic, m.partition, m.seq FROM broker_messages m
+			JOIN (SELECT topic, partition, MIN(last_seq) AS last_seq FROM broker_offsets GROUP BY topic, partition) o
+			ON o.topic = m.topic AND o.partition = m.partition
+			WHERE m.seq <= o.last_seq AND m.created_at < $1
+			ORDER BY m.topic, m.partition, m.seq LIMIT $2)`
+
+	res, err := r.db.ExecContext(ctx, query, cutoff, r.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newMockBroker(t *testing.T) (*PostgresBroker, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewPostgresBroker(db, "orders-group", 1, time.Second, discard), mock
+}
+
+// expectMessage expects the lease to be taken at position lastSeq and the
+// message after it to be read, outside any transaction.
+func expectMessage(mock sqlmock.Sqlmock, b *PostgresBroker, lastSeq, seq int64) {
+	mock.ExpectQuery(`UPDATE broker_offsets SET locked_by = \$4, locked_until = \$5`).
+		WithArgs("orders-group", "orders", 0, b.id, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"last_seq"}).AddRow(lastSeq))
+	mock.ExpectQuery(`SELECT COALESCE\(\(SELECT last_seq FROM broker_partitions`).
+		WithArgs("orders", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"last_seq"}).AddRow(seq + 1))
+	mock.ExpectQuery(`SELECT seq, key, value, headers FROM broker_messages`).
+		WithArgs("orders", 0, lastSeq).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "key", "value", "headers"}).
+			AddRow(seq, "order-1", []byte(`{}`), []byte(`{"message-id":"message-1"}`)))
+}
+
+func TestPostgresConsumeOne(t *testing.T) {
+	failure := errors.New("cannot handle")
+	tests := []struct {
+		name             string
+		handlerErr       error
+		moved            int64
+		wantErr          error
+		wantDone         bool
+		wantDeadLettered int64
+	}{
+		{name: "handled message moves the offset", moved: 1, wantDone: true},
+		{name: "failed message is dead-lettered with the offset", handlerErr: Permanent(failure), moved: 1, wantDone: true, wantDeadLettered: 1},
+		{name: "expired lease leaves the offset alone", moved: 0, wantErr: ErrLeaseLost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, mock := newMockBroker(t)
+			var handled []string
+			err := b.Subscribe("orders", HandlerFunc(func(ctx context.Context, m Message) error {
+				handled = append(handled, m.Headers.Get(HeaderMessageID))
+				return tt.handlerErr
+			}))
+			if err != nil {
+				t.Fatalf("subscribe: %v", err)
+			}
+
+			expectMessage(mock, b, 4, 5)
+			// the transaction starts only after the handler returned
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE broker_offsets SET last_seq = \$4, updated_at = now\(\), locked_by = NULL, locked_until = NULL`).
+				WithArgs("orders-group", "orders", 0, int64(5), b.id).
+				WillReturnResult(sqlmock.NewResult(0, tt.moved))
+			if tt.wantDeadLettered > 0 {
+				mock.ExpectQuery(`INSERT INTO broker_partitions`).
+					WithArgs("orders.dlq", 0).
+					WillReturnRows(sqlmock.NewRows([]string{"last_seq"}).AddRow(1))
+				mock.ExpectExec(`INSERT INTO broker_messages`).
+					WithArgs("orders.dlq", 0, int64(1), "order-1", []byte(`{}`), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`SELECT pg_notify`).
+					WithArgs(postgresChannel, "orders.dlq").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			if tt.wantErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			done, err := b.consumeOne(context.Background(), "orders", 0)
+			if done != tt.wantDone || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("consumeOne = %v, %v, want %v, %v", done, err, tt.wantDone, tt.wantErr)
+			}
+			if len(handled) != 1 || handled[0] != "message-1" {
+				t.Errorf("handled %v, want message-1 once", handled)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if got := b.Stats().DeadLettered; got != tt.wantDeadLettered {
+				t.Errorf("dead lettered = %d, want %d", got, tt.wantDeadLettered)
+			}
+		})
+	}
+}
+
+func TestPostgresConsumeOneLeasedByAnotherMember(t *testing.T) {
+	b, mock := newMockBroker(t)
+	err := b.Subscribe("orders", HandlerFunc(func(ctx context.Context, m Message) error {
+		t.Error("handler called for a partition another member holds")
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	mock.ExpectQuery(`UPDATE broker_offsets SET locked_by`).
+		WillReturnRows(sqlmock.NewRows([]string{"last_seq"}))
+
+	done, err := b.consumeOne(context.Background(), "orders", 0)
+	if done || err != nil {
+		t.Fatalf("consumeOne = %v, %v, want false, nil", done, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresConsumeOneReleasesIdlePartition(t *testing.T) {
+	b, mock := newMockBroker(t)
+	if err := b.Subscribe("orders", HandlerFunc(func(context.Context, Message) error { return nil })); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	mock.ExpectQuery(`UPDATE broker_offsets SET locked_by`).
+		WillReturnRows(sqlmock.NewRows([]string{"last_seq"}).AddRow(5))
+	mock.ExpectQuery(`SELECT COALESCE`).
+		WillReturnRows(sqlmock.NewRows([]string{"last_seq"}).AddRow(5))
+	mock.ExpectQuery(`SELECT seq, key, value, headers FROM broker_messages`).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "key", "value", "headers"}))
+	mock.ExpectExec(`UPDATE broker_offsets SET locked_by = NULL, locked_until = NULL`).
+		WithArgs("orders-group", "orders", 0, b.id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	done, err := b.consumeOne(context.Background(), "orders", 0)
+	if done || err != nil {
+		t.Fatalf("consumeOne = %v, %v, want false, nil", done, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresRetentionPurge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	r := NewPostgresRetention(db, RetentionConfig{MaxAge: time.Hour, BatchSize: 2}, discard)
+	query := `DELETE FROM broker_messages WHERE \(topic, partition, seq\) IN \(.*MIN\(last_seq\).*m.seq <= o.last_seq AND m.created_at < \$1`
+	mock.ExpectExec(query).WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(query).WithArgs(sqlmock.AnyArg(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := r.Purge(context.Background())
+	if n != 3 || err != nil {
+		t.Errorf("Purge = %d, %v, want 3, nil", n, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
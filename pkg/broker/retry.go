@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	DeadLetterSuffix = ".dlq"
+
+	HeaderDeadLetterError     = "x-dlq-error"
+	HeaderDeadLetterAttempts  = "x-dlq-attempts"
+	HeaderDeadLetterTopic     = "x-dlq-original-topic"
+	HeaderDeadLetterPartition = "x-dlq-original-partition"
+	HeaderDeadLetterOffset    = "x-dlq-original-offset"
+)
+
+// RetryPolicy says how many times a handler is called for one message and how
+// long to wait between calls before the message goes to the dead-letter topic.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+}
+
+// Backoff returns the delay after the given failed attempt, starting from 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		d = time.Duration(float64(d) * p.Multiplier)
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+
+	return d
+}
+
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func DeadLetterTopic(topic string) string {
+	return topic + DeadLetterSuffix
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent lets packages that cannot import broker, such as inbox, tell
+// permanent errors apart.
+func (e *permanentError) Permanent() bool {
+	return true
+}
+
+// Permanent marks err as one that retrying cannot fix, such as a message that
+// does not unmarshal. The message goes straight to the dead-letter topic.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+type subscription struct {
+	handler Handler
+	policy  RetryPolicy
+}
+
+// handleWithRetry calls the handler until it succeeds, returns a permanent
+// error, runs out of attempts or ctx ends.
+func handleWithRetry(ctx context.Context, logger *log.Logger, sub subscription, msg Message) (int, error) {
+	var err error
+	attempts := sub.policy.attempts()
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = sub.handler.Handle(msg)
+		if err == nil {
+			return attempt, nil
+		}
+
+		logger.Printf("Error handling message (attempt %d/%d): %v", attempt, attempts, err)
+		if IsPermanent(err) {
+			return attempt, err
+		}
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, fmt.Errorf("consumer stopped: %w", err)
+		case <-time.After(sub.policy.Backoff(attempt)):
+		}
+	}
+
+	return attempts, err
+}
@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+)
+
+var discard = log.New(io.Discard, "", 0)
+
+// fakeSession is the part of a consumer group session the consumer uses.
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
+}
+
+func newFakeSession(ctx context.Context) *fakeSession {
+	return &fakeSession{ctx: ctx}
+}
+
+func (s *fakeSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeSession) MarkMessage(message *sarama.ConsumerMessage, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.marked = append(s.marked, message.Offset)
+}
+
+func (s *fakeSession) markedOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int64(nil), s.marked...)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 3}
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 100 * time.Millisecond},
+		{attempt: 2, want: 300 * time.Millisecond},
+		{attempt: 3, want: 900 * time.Millisecond},
+		{attempt: 4, want: time.Second},
+		{attempt: 10, want: time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := policy.Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestHandleWithRetry(t *testing.T) {
+	failure := errors.New("handler failed")
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		failures     int
+		err          error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "first attempt succeeds", maxAttempts: 3, wantAttempts: 1},
+		{name: "succeeds after retries", maxAttempts: 3, failures: 2, err: failure, wantAttempts: 3},
+		{name: "runs out of attempts", maxAttempts: 3, failures: 5, err: failure, wantAttempts: 3, wantErr: true},
+		{name: "permanent error is not retried", maxAttempts: 3, failures: 5, err: Permanent(failure), wantAttempts: 1, wantErr: true},
+		{name: "no attempts configured still calls once", maxAttempts: 0, failures: 5, err: failure, wantAttempts: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			handler := HandlerFunc(func(ctx context.Context, m Message) error {
+				calls++
+				if calls <= tt.failures {
+					return tt.err
+				}
+				return nil
+			})
+			sub := subscription{handler: handler, policy: RetryPolicy{MaxAttempts: tt.maxAttempts, InitialBackoff: time.Millisecond, Multiplier: 1}}
+
+			attempts, err := handleWithRetry(context.Background(), discard, sub, Message{Topic: "orders"})
+			if attempts != tt.wantAttempts || calls != tt.wantAttempts {
+				t.Errorf("attempts = %d with %d calls, want %d", attempts, calls, tt.wantAttempts)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, failure) {
+				t.Errorf("err = %v, want it to wrap %v", err, failure)
+			}
+		})
+	}
+}
+
+func TestHandleWithRetryStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := HandlerFunc(func(context.Context, Message) error {
+		cancel()
+		return errors.New("handler failed")
+	})
+	sub := subscription{handler: handler, policy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}}
+
+	attempts, err := handleWithRetry(ctx, discard, sub, Message{})
+	if attempts != 1 || err == nil || !strings.Contains(err.Error(), "consumer stopped") {
+		t.Errorf("handleWithRetry = %d, %v, want 1 attempt and consumer stopped", attempts, err)
+	}
+}
+
+func TestDeadLetterHeaders(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	defer producer.Close()
+
+	b := NewKafkaBroker(producer, nil, "orders-group", discard)
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	err := b.SubscribeWithRetry("orders", HandlerFunc(func(context.Context, Message) error {
+		return errors.New("cannot handle")
+	}), policy)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	want := map[string]string{
+		HeaderMessageID:           "message-1",
+		HeaderDeadLetterError:     "cannot handle",
+		HeaderDeadLetterAttempts:  "2",
+		HeaderDeadLetterTopic:     "orders",
+		HeaderDeadLetterPartition: "4",
+		HeaderDeadLetterOffset:    "17",
+	}
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		if m.Topic != "orders.dlq" {
+			return errors.New("dead letter sent to " + m.Topic)
+		}
+		got := make(map[string]string)
+		for _, h := range m.Headers {
+			got[string(h.Key)] = string(h.Value)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				return errors.New("header " + k + " = " + got[k] + ", want " + v)
+			}
+		}
+		return nil
+	})
+
+	message := &sarama.ConsumerMessage{
+		Topic:     "orders",
+		Partition: 4,
+		Offset:    17,
+		Key:       []byte("order-1"),
+		Value:     []byte(`{}`),
+		Headers:   []*sarama.RecordHeader{{Key: []byte(HeaderMessageID), Value: []byte("message-1")}},
+	}
+	handler := &consumerGroupHandler{broker: b}
+	done, err := handler.process(newFakeSession(context.Background()), message)
+	if !done || err != nil {
+		t.Fatalf("process = %v, %v, want the message done", done, err)
+	}
+
+	stats := b.Stats()
+	if stats.Attempts != 2 || stats.Failed != 2 || stats.DeadLettered != 1 {
+		t.Errorf("stats = %+v, want 2 failed attempts and 1 dead letter", stats)
+	}
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// UnknownPolicy says what a Router does with a message no handler subscribed to.
+type UnknownPolicy int
+
+const (
+	// RejectUnknown returns an error, so the message is retried and then dead-lettered.
+	RejectUnknown UnknownPolicy = iota
+	// SkipUnknown acknowledges the message without handling it.
+	SkipUnknown
+	// DeadLetterUnknown moves the message to the dead-letter topic without retrying.
+	DeadLetterUnknown
+)
+
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// Router dispatches a message to every handler subscribed to its topic and
+// type. Handlers run one after another in registration order and share the
+// context, so with Transaction in the chain they commit or roll back together.
+// Register all routes before consuming starts.
+type Router struct {
+	routes  map[string][]route
+	unknown UnknownPolicy
+	logger  *log.Logger
+}
+
+type route struct {
+	types   map[string]bool
+	handler HandlerFunc
+}
+
+func NewRouter(unknown UnknownPolicy, logger *log.Logger) *Router {
+	return &Router{
+		routes:  make(map[string][]route),
+		unknown: unknown,
+		logger:  logger,
+	}
+}
+
+// Handle subscribes h to the given message types on topic. With no types h
+// receives every message of the topic.
+func (r *Router) Handle(topic string, h HandlerFunc, messageTypes ...string) {
+	var types map[string]bool
+	if len(messageTypes) > 0 {
+		types = make(map[string]bool, len(messageTypes))
+		for _, t := range messageTypes {
+			types[t] = true
+		}
+	}
+
+	r.routes[topic] = append(r.routes[topic], route{types: types, handler: h})
+}
+
+// Topics returns the routed topics in a stable order.
+func (r *Router) Topics() []string {
+	topics := make([]string, 0, len(r.routes))
+	for topic := range r.routes {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+func (r *Router) HandleMessage(ctx context.Context, message Message) error {
+	messageType := MessageType(message)
+
+	handled := false
+	for _, rt := range r.routes[message.Topic] {
+		if rt.types != nil && !rt.types[messageType] {
+			continue
+		}
+		handled = true
+
+		err := rt.handler(ctx, message)
+		if err != nil {
+			return err
+		}
+	}
+	if handled {
+		return nil
+	}
+
+	err := fmt.Errorf("%w %q on %s", ErrUnknownMessageType, messageType, message.Topic)
+	switch r.unknown {
+	case SkipUnknown:
+		r.logger.Printf("Ignore message type %q on %s", messageType, message.Topic)
+		return nil
+	case DeadLetterUnknown:
+		return Permanent(err)
+	default:
+		return err
+	}
+}
+
+// SubscribeAll subscribes h, normally the router wrapped in middleware, to
+// every routed topic of b.
+func (r *Router) SubscribeAll(b Broker, h Handler) error {
+	for _, topic := range r.Topics() {
+		err := b.Subscribe(topic, h)
+		if err != nil {
+			return fmt.Errorf("subscribe to %s: %w", topic, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	var calls []string
+	record := func(name string) HandlerFunc {
+		return func(ctx context.Context, m Message) error {
+			calls = append(calls, name)
+			return nil
+		}
+	}
+
+	r := NewRouter(RejectUnknown, discard)
+	r.Handle("orders", record("created"), "OrderCreated")
+	r.Handle("orders", record("all"))
+	r.Handle("orders", record("created or completed"), "OrderCreated", "OrderCompleted")
+	r.Handle("payments", record("payments"), "OrderCreated")
+
+	tests := []struct {
+		name        string
+		topic       string
+		messageType string
+		want        []string
+	}{
+		{name: "every matching handler in registration order", topic: "orders", messageType: "OrderCreated", want: []string{"created", "all", "created or completed"}},
+		{name: "handlers of other types are skipped", topic: "orders", messageType: "OrderCompleted", want: []string{"all", "created or completed"}},
+		{name: "a handler without types takes everything", topic: "orders", messageType: "OrderCancelled", want: []string{"all"}},
+		{name: "routes are per topic", topic: "payments", messageType: "OrderCreated", want: []string{"payments"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			err := r.HandleMessage(context.Background(), Message{Topic: tt.topic, Headers: Headers{HeaderMessageType: tt.messageType}})
+			if err != nil {
+				t.Fatalf("handle: %v", err)
+			}
+			if !reflect.DeepEqual(calls, tt.want) {
+				t.Errorf("calls = %v, want %v", calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterUnknownPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        UnknownPolicy
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "reject", policy: RejectUnknown, wantErr: true},
+		{name: "skip", policy: SkipUnknown},
+		{name: "dead letter", policy: DeadLetterUnknown, wantErr: true, wantPermanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.policy, discard)
+			r.Handle("orders", func(ctx context.Context, m Message) error {
+				t.Error("handler called for an unknown type")
+				return nil
+			}, "OrderCreated")
+
+			err := r.HandleMessage(context.Background(), Message{Topic: "orders", Headers: Headers{HeaderMessageType: "Unknown"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnknownMessageType) {
+				t.Errorf("err = %v, want ErrUnknownMessageType", err)
+			}
+			if IsPermanent(err) != tt.wantPermanent {
+				t.Errorf("permanent = %v, want %v", IsPermanent(err), tt.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestRouterStopsAtFirstError(t *testing.T) {
+	failure := errors.New("handler failed")
+	second := false
+	r := NewRouter(RejectUnknown, discard)
+	r.Handle("orders", func(ctx context.Context, m Message) error { return failure })
+	r.Handle("orders", func(ctx context.Context, m Message) error {
+		second = true
+		return nil
+	})
+
+	err := r.HandleMessage(context.Background(), Message{Topic: "orders"})
+	if !errors.Is(err, failure) || second {
+		t.Errorf("err = %v, second handler called = %v, want the first error and no second call", err, second)
+	}
+}
+
+func TestRouterSubscribeAll(t *testing.T) {
+	b := NewMemoryBroker(1, nil)
+	r := NewRouter(SkipUnknown, discard)
+	r.Handle("payments", func(ctx context.Context, m Message) error { return nil })
+	r.Handle("orders", func(ctx context.Context, m Message) error { return nil })
+
+	if got := r.Topics(); !reflect.DeepEqual(got, []string{"orders", "payments"}) {
+		t.Errorf("topics = %v, want them sorted", got)
+	}
+	if err := r.SubscribeAll(b, HandlerFunc(r.HandleMessage)); err != nil {
+		t.Fatalf("subscribe all: %v", err)
+	}
+	if err := r.SubscribeAll(b, HandlerFunc(r.HandleMessage)); err == nil {
+		t.Error("subscribing the topics twice succeeded")
+	}
+}
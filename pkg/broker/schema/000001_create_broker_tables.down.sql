@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS broker_offsets;
+DROP TABLE IF EXISTS broker_messages;
+DROP TABLE IF EXISTS broker_partitions;
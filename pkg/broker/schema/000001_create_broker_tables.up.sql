@@ -0,0 +1,31 @@
+-- last sequence number given out per partition, the row lock orders writers
+CREATE TABLE broker_partitions
+(
+    topic     VARCHAR(255) NOT NULL,
+    partition INTEGER      NOT NULL,
+    last_seq  BIGINT       NOT NULL,
+    PRIMARY KEY (topic, partition)
+);
+
+CREATE TABLE broker_messages
+(
+    topic      VARCHAR(255) NOT NULL,
+    partition  INTEGER      NOT NULL,
+    seq        BIGINT       NOT NULL,
+    key        VARCHAR(255) NOT NULL,
+    value      BYTEA        NOT NULL,
+    headers    JSONB        NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP    NOT NULL,
+    PRIMARY KEY (topic, partition, seq)
+);
+
+-- last sequence number each consumer group has processed per partition
+CREATE TABLE broker_offsets
+(
+    consumer_group VARCHAR(255) NOT NULL,
+    topic          VARCHAR(255) NOT NULL,
+    partition      INTEGER      NOT NULL,
+    last_seq       BIGINT       NOT NULL DEFAULT 0,
+    updated_at     TIMESTAMP    NOT NULL DEFAULT now(),
+    PRIMARY KEY (consumer_group, topic, partition)
+);
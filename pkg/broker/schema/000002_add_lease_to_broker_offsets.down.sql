@@ -0,0 +1,2 @@
+ALTER TABLE broker_offsets DROP COLUMN locked_until;
+ALTER TABLE broker_offsets DROP COLUMN locked_by;
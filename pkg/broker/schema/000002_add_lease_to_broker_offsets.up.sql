@@ -0,0 +1,3 @@
+-- the member of the group that handles the partition and until when
+ALTER TABLE broker_offsets ADD COLUMN locked_by VARCHAR(255);
+ALTER TABLE broker_offsets ADD COLUMN locked_until TIMESTAMP;
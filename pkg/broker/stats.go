@@ -0,0 +1,176 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConsumerStats is a snapshot of how far a consumer got.
+type ConsumerStats struct {
+	Group string `json:"group"`
+	// Rebalancing is true while the consumer holds no session: before it
+	// joined the group, during a rebalance and after it stopped.
+	Rebalancing bool             `json:"rebalancing"`
+	Rebalances  int64            `json:"rebalances"`
+	Partitions  []PartitionStats `json:"partitions"`
+	// Attempts counts handler calls including retries, Failed the calls that
+	// returned an error.
+	Attempts     int64 `json:"attempts"`
+	Failed       int64 `json:"failed"`
+	DeadLettered int64 `json:"dead_lettered"`
+}
+
+type PartitionStats struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	// LastOffset is the last processed offset, -1 before the first message.
+	LastOffset      int64     `json:"last_offset"`
+	LastProcessedAt time.Time `json:"last_processed_at"`
+	Lag             int64     `json:"lag"`
+}
+
+// MaxLag is the lag of the partition furthest behind.
+func (s ConsumerStats) MaxLag() int64 {
+	var lag int64
+	for _, p := range s.Partitions {
+		lag = max(lag, p.Lag)
+	}
+	return lag
+}
+
+// ErrorRate is the share of failed handler calls.
+func (s ConsumerStats) ErrorRate() float64 {
+	if s.Attempts == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Attempts)
+}
+
+// StatsReporter is implemented by brokers that report consumer progress.
+type StatsReporter interface {
+	Stats() ConsumerStats
+}
+
+// consumerStats collects ConsumerStats while consuming.
+type consumerStats struct {
+	mu           sync.Mutex
+	group        string
+	active       bool
+	rebalances   int64
+	partitions   map[partitionKey]*PartitionStats
+	attempts     int64
+	failed       int64
+	deadLettered int64
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+func newConsumerStats(group string) *consumerStats {
+	return &consumerStats{group: group, partitions: make(map[partitionKey]*PartitionStats)}
+}
+
+// sessionStarted forgets the previous assignment, partitions are added again
+// as they are claimed.
+func (s *consumerStats) sessionStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = true
+	s.rebalances++
+	s.partitions = make(map[partitionKey]*PartitionStats)
+}
+
+func (s *consumerStats) sessionEnded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = false
+}
+
+// position records that next is the next offset to process and end the
+// offset after the newest message of the partition.
+func (s *consumerStats) position(topic string, partition int32, next, end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.partition(topic, partition)
+	p.Lag = max(end-next, 0)
+}
+
+// processed records that offset is done, end as in position.
+func (s *consumerStats) processed(topic string, partition int32, offset, end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.partition(topic, partition)
+	p.LastOffset = offset
+	p.LastProcessedAt = time.Now()
+	p.Lag = max(end-offset-1, 0)
+}
+
+// release forgets a partition the consumer no longer owns.
+func (s *consumerStats) release(topic string, partition int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.partitions, partitionKey{topic, partition})
+}
+
+// handled records the result of handleWithRetry.
+func (s *consumerStats) handled(attempts int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts += int64(attempts)
+	s.failed += int64(attempts - 1)
+	if err != nil {
+		s.failed++
+	}
+}
+
+func (s *consumerStats) deadLetter() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadLettered++
+}
+
+func (s *consumerStats) partition(topic string, partition int32) *PartitionStats {
+	key := partitionKey{topic, partition}
+	p, ok := s.partitions[key]
+	if !ok {
+		p = &PartitionStats{Topic: topic, Partition: partition, LastOffset: -1}
+		s.partitions[key] = p
+	}
+	return p
+}
+
+func (s *consumerStats) snapshot() ConsumerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := ConsumerStats{
+		Group:        s.group,
+		Rebalancing:  !s.active,
+		Rebalances:   s.rebalances,
+		Partitions:   make([]PartitionStats, 0, len(s.partitions)),
+		Attempts:     s.attempts,
+		Failed:       s.failed,
+		DeadLettered: s.deadLettered,
+	}
+	for _, p := range s.partitions {
+		stats.Partitions = append(stats.Partitions, *p)
+	}
+	sort.Slice(stats.Partitions, func(i, j int) bool {
+		if stats.Partitions[i].Topic != stats.Partitions[j].Topic {
+			return stats.Partitions[i].Topic < stats.Partitions[j].Topic
+		}
+		return stats.Partitions[i].Partition < stats.Partitions[j].Partition
+	})
+
+	return stats
+}
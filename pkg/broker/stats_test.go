@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMaxLag(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions []PartitionStats
+		want       int64
+	}{
+		{name: "no partitions", want: 0},
+		{name: "caught up", partitions: []PartitionStats{{Lag: 0}, {Lag: 0}}, want: 0},
+		{name: "furthest behind", partitions: []PartitionStats{{Lag: 3}, {Lag: 12}, {Lag: 5}}, want: 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := ConsumerStats{Partitions: tt.partitions}
+			if got := stats.MaxLag(); got != tt.want {
+				t.Errorf("MaxLag() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	if got := (ConsumerStats{}).ErrorRate(); got != 0 {
+		t.Errorf("ErrorRate() without attempts = %v, want 0", got)
+	}
+	if got := (ConsumerStats{Attempts: 4, Failed: 1}).ErrorRate(); got != 0.25 {
+		t.Errorf("ErrorRate() = %v, want 0.25", got)
+	}
+}
+
+func TestConsumerStatsRebalancing(t *testing.T) {
+	s := newConsumerStats("group")
+
+	if !s.snapshot().Rebalancing {
+		t.Error("Rebalancing = false before the first session, want true")
+	}
+
+	s.sessionStarted()
+	s.position("orders", 0, 5, 10)
+	stats := s.snapshot()
+	if stats.Rebalancing || stats.Rebalances != 1 {
+		t.Errorf("Rebalancing = %v, Rebalances = %d in a session, want false, 1", stats.Rebalancing, stats.Rebalances)
+	}
+
+	s.sessionEnded()
+	if !s.snapshot().Rebalancing {
+		t.Error("Rebalancing = false after the session ended, want true")
+	}
+
+	// a new session forgets the partitions of the previous assignment
+	s.sessionStarted()
+	stats = s.snapshot()
+	if stats.Rebalancing || stats.Rebalances != 2 || len(stats.Partitions) != 0 {
+		t.Errorf("got Rebalancing = %v, Rebalances = %d, %d partitions, want false, 2, 0", stats.Rebalancing, stats.Rebalances, len(stats.Partitions))
+	}
+}
+
+func TestConsumerStatsLag(t *testing.T) {
+	s := newConsumerStats("group")
+	s.sessionStarted()
+
+	s.position("orders", 1, 3, 10)
+	s.position("orders", 0, 0, 4)
+	s.processed("orders", 0, 1, 4)
+	s.position("payments", 0, 8, 6)
+
+	stats := s.snapshot()
+	want := []PartitionStats{
+		{Topic: "orders", Partition: 0, LastOffset: 1, Lag: 2},
+		{Topic: "orders", Partition: 1, LastOffset: -1, Lag: 7},
+		// the end offset may lag behind the position, lag never goes negative
+		{Topic: "payments", Partition: 0, LastOffset: -1, Lag: 0},
+	}
+	if len(stats.Partitions) != len(want) {
+		t.Fatalf("got %d partitions, want %d", len(stats.Partitions), len(want))
+	}
+	for i, p := range stats.Partitions {
+		p.LastProcessedAt = want[i].LastProcessedAt
+		if p != want[i] {
+			t.Errorf("partition %d = %+v, want %+v", i, p, want[i])
+		}
+	}
+	if got := stats.MaxLag(); got != 7 {
+		t.Errorf("MaxLag() = %d, want 7", got)
+	}
+
+	s.release("orders", 1)
+	if got := s.snapshot().MaxLag(); got != 2 {
+		t.Errorf("MaxLag() after release = %d, want 2", got)
+	}
+}
+
+func TestConsumerStatsHandled(t *testing.T) {
+	s := newConsumerStats("group")
+
+	s.handled(1, nil)
+	s.handled(3, nil)
+	s.handled(2, errors.New("boom"))
+	s.deadLetter()
+
+	stats := s.snapshot()
+	if stats.Attempts != 6 || stats.Failed != 4 || stats.DeadLettered != 1 {
+		t.Errorf("Attempts = %d, Failed = %d, DeadLettered = %d, want 6, 4, 1", stats.Attempts, stats.Failed, stats.DeadLettered)
+	}
+}
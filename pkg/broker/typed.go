@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"strconv"
+)
+
+// envelope holds the id and type of both commands and events, for messages
+// produced before headers existed.
+type envelope struct {
+	CommandID   string `json:"command_id"`
+	CommandType string `json:"command_type"`
+	EventID     string `json:"event_id"`
+	EventType   string `json:"event_type"`
+}
+
+func decodeEnvelope(message Message) envelope {
+	var e envelope
+	_ = json.Unmarshal(message.Value, &e)
+	return e
+}
+
+// MessageType reads the type from the headers, falling back to the payload.
+func MessageType(message Message) string {
+	if t := message.Headers.Get(HeaderMessageType); t != "" {
+		return t
+	}
+	e := decodeEnvelope(message)
+	if e.CommandType != "" {
+		return e.CommandType
+	}
+	return e.EventType
+}
+
+// MessageID reads the command or event id from the headers, falling back to the payload.
+func MessageID(message Message) string {
+	if id := message.Headers.Get(HeaderMessageID); id != "" {
+		return id
+	}
+	e := decodeEnvelope(message)
+	if e.CommandID != "" {
+		return e.CommandID
+	}
+	return e.EventID
+}
+
+// Sequence reads the aggregate and the number the outbox gave the message
+// within it. Messages without a number return 0.
+func Sequence(message Message) (string, int64, error) {
+	aggregateID := message.Headers.Get(HeaderAggregateID)
+	value := message.Headers.Get(HeaderSequence)
+	if aggregateID == "" || value == "" {
+		return "", 0, nil
+	}
+	sequence, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || sequence < 1 {
+		return "", 0, fmt.Errorf("invalid %s header %q", HeaderSequence, value)
+	}
+	return aggregateID, sequence, nil
+}
+
+// Command adapts a handler of one command type. An undecodable command or
+// payload is a permanent error.
+func Command[P any](fn func(ctx context.Context, cmd command.Command, payload P) error) HandlerFunc {
+	return func(ctx context.Context, message Message) error {
+		var cmd command.Command
+		err := json.Unmarshal(message.Value, &cmd)
+		if err != nil {
+			return Permanent(fmt.Errorf("unmarshal command: %w", err))
+		}
+
+		var payload P
+		if len(cmd.Payload) > 0 {
+			err = json.Unmarshal(cmd.Payload, &payload)
+			if err != nil {
+				return Permanent(fmt.Errorf("unmarshal %s payload: %w", cmd.Type, err))
+			}
+		}
+
+		return fn(ctx, cmd, payload)
+	}
+}
+
+// Event adapts a handler of one event type. An undecodable event or payload
+// is a permanent error.
+func Event[P any](fn func(ctx context.Context, e event.Event, payload P) error) HandlerFunc {
+	return func(ctx context.Context, message Message) error {
+		var e event.Event
+		err := json.Unmarshal(message.Value, &e)
+		if err != nil {
+			return Permanent(fmt.Errorf("unmarshal event: %w", err))
+		}
+
+		var payload P
+		if len(e.Payload) > 0 {
+			err = json.Unmarshal(e.Payload, &payload)
+			if err != nil {
+				return Permanent(fmt.Errorf("unmarshal %s payload: %w", e.Type, err))
+			}
+		}
+
+		return fn(ctx, e, payload)
+	}
+}
@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"testing"
+)
+
+type testPayload struct {
+	OrderID string `json:"order_id"`
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		wantOrderID   string
+		wantPermanent bool
+	}{
+		{name: "decodes command and payload", value: `{"command_id":"c-1","command_type":"CreateOrder","payload":{"order_id":"o-1"}}`, wantOrderID: "o-1"},
+		{name: "empty payload", value: `{"command_id":"c-1","command_type":"CreateOrder"}`},
+		{name: "invalid command", value: `not json`, wantPermanent: true},
+		{name: "invalid payload", value: `{"command_id":"c-1","command_type":"CreateOrder","payload":{"order_id":1}}`, wantPermanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := Command(func(ctx context.Context, cmd command.Command, payload testPayload) error {
+				called = true
+				if cmd.ID != "c-1" || cmd.Type != "CreateOrder" {
+					t.Errorf("command = %+v", cmd)
+				}
+				if payload.OrderID != tt.wantOrderID {
+					t.Errorf("order id = %q, want %q", payload.OrderID, tt.wantOrderID)
+				}
+				return nil
+			})
+
+			err := h.Handle(Message{Value: []byte(tt.value)})
+			if tt.wantPermanent {
+				if !IsPermanent(err) || called {
+					t.Errorf("err = %v, called = %v, want a permanent error without calling the handler", err, called)
+				}
+				return
+			}
+			if err != nil || !called {
+				t.Errorf("err = %v, called = %v, want the handler called", err, called)
+			}
+		})
+	}
+}
+
+func TestEvent(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		wantOrderID   string
+		wantPermanent bool
+	}{
+		{name: "decodes event and payload", value: `{"event_id":"e-1","event_type":"OrderCreated","payload":{"order_id":"o-1"}}`, wantOrderID: "o-1"},
+		{name: "empty payload", value: `{"event_id":"e-1","event_type":"OrderCreated"}`},
+		{name: "invalid event", value: `[]`, wantPermanent: true},
+		{name: "invalid payload", value: `{"event_id":"e-1","event_type":"OrderCreated","payload":"o-1"}`, wantPermanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := Event(func(ctx context.Context, e event.Event, payload testPayload) error {
+				called = true
+				if e.ID != "e-1" || e.Type != "OrderCreated" {
+					t.Errorf("event = %+v", e)
+				}
+				if payload.OrderID != tt.wantOrderID {
+					t.Errorf("order id = %q, want %q", payload.OrderID, tt.wantOrderID)
+				}
+				return nil
+			})
+
+			err := h.Handle(Message{Value: []byte(tt.value)})
+			if tt.wantPermanent {
+				if !IsPermanent(err) || called {
+					t.Errorf("err = %v, called = %v, want a permanent error without calling the handler", err, called)
+				}
+				return
+			}
+			if err != nil || !called {
+				t.Errorf("err = %v, called = %v, want the handler called", err, called)
+			}
+		})
+	}
+}
+
+func TestRawPayload(t *testing.T) {
+	var got json.RawMessage
+	h := Event(func(ctx context.Context, e event.Event, payload json.RawMessage) error {
+		got = payload
+		return nil
+	})
+
+	if err := h.Handle(Message{Value: []byte(`{"event_id":"e-1","payload":{"a":1}}`)}); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if string(got) != `{"a":1}` {
+		t.Errorf("payload = %s, want it untouched", got)
+	}
+}
+
+func TestMessageTypeAndID(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  Message
+		wantType string
+		wantID   string
+	}{
+		{
+			name:     "headers win",
+			message:  Message{Value: []byte(`{"event_id":"e-1","event_type":"OrderCreated"}`), Headers: Headers{HeaderMessageType: "OrderCompleted", HeaderMessageID: "e-2"}},
+			wantType: "OrderCompleted",
+			wantID:   "e-2",
+		},
+		{name: "command envelope", message: Message{Value: []byte(`{"command_id":"c-1","command_type":"CreateOrder"}`)}, wantType: "CreateOrder", wantID: "c-1"},
+		{name: "event envelope", message: Message{Value: []byte(`{"event_id":"e-1","event_type":"OrderCreated"}`)}, wantType: "OrderCreated", wantID: "e-1"},
+		{name: "neither", message: Message{Value: []byte(`nope`)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MessageType(tt.message); got != tt.wantType {
+				t.Errorf("MessageType = %q, want %q", got, tt.wantType)
+			}
+			if got := MessageID(tt.message); got != tt.wantID {
+				t.Errorf("MessageID = %q, want %q", got, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestSequence(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       Headers
+		wantAggregate string
+		wantSequence  int64
+		wantErr       bool
+	}{
+		{name: "numbered message", headers: Headers{HeaderAggregateID: "saga-1", HeaderSequence: "3"}, wantAggregate: "saga-1", wantSequence: 3},
+		{name: "unnumbered message", headers: Headers{}},
+		{name: "number without aggregate", headers: Headers{HeaderSequence: "3"}},
+		{name: "not a number", headers: Headers{HeaderAggregateID: "saga-1", HeaderSequence: "three"}, wantErr: true},
+		{name: "number below 1", headers: Headers{HeaderAggregateID: "saga-1", HeaderSequence: "0"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aggregateID, sequence, err := Sequence(Message{Headers: tt.headers})
+			if aggregateID != tt.wantAggregate || sequence != tt.wantSequence || (err != nil) != tt.wantErr {
+				t.Errorf("Sequence = %q, %d, %v, want %q, %d, error %v", aggregateID, sequence, err, tt.wantAggregate, tt.wantSequence, tt.wantErr)
+			}
+		})
+	}
+}
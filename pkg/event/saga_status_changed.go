@@ -0,0 +1,21 @@
+package event
+
+import "time"
+
+const SagaStatusChanged Type = "SagaStatusChanged"
+
+type SagaStatusChangedPayload struct {
+	SagaID        string `json:"saga_id"`
+	UserID        string `json:"user_id"`
+	OrderID       string `json:"order_id"`
+	Status        string `json:"status"`
+	CurrentStep   int    `json:"current_step"`
+	Step          string `json:"step"`
+	Compensating  bool   `json:"compensating"`
+	FailureReason string `json:"failure_reason"`
+	// Revision grows with every change of the saga. Consumers keep the status
+	// with the highest revision, UpdatedAt is the saga host's clock and only
+	// informational.
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,194 @@
+// Package health serves liveness, readiness and metrics endpoints.
+package health
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"shop/pkg/broker"
+	"sync"
+	"time"
+)
+
+// Check returns an error when a dependency is not ready.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health collects readiness checks and metrics of a service:
+//
+//	GET /health   the process is up
+//	GET /ready    200 when every check passes, 503 otherwise
+//	GET /metrics  broker consumer stats and handler counters as JSON
+type Health struct {
+	logger  *log.Logger
+	mu      sync.Mutex
+	checks  []namedCheck
+	brokers []broker.StatsReporter
+	metrics *broker.Metrics
+}
+
+func New(logger *log.Logger) *Health {
+	return &Health{logger: logger}
+}
+
+func (h *Health) AddCheck(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// AddBroker reports the broker's consumer stats on /metrics and makes the
+// service unready while its consumer rebalances or lags more than maxLag
+// messages on a partition.
+func (h *Health) AddBroker(b broker.StatsReporter, maxLag int64) {
+	h.mu.Lock()
+	h.brokers = append(h.brokers, b)
+	h.mu.Unlock()
+
+	h.AddCheck("broker", Consumer(b, maxLag))
+}
+
+// SetMetrics reports the handler counters on /metrics.
+func (h *Health) SetMetrics(metrics *broker.Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.metrics = metrics
+}
+
+// Register adds the endpoints to mux.
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /health", h.live)
+	mux.HandleFunc("GET /ready", h.ready)
+	mux.HandleFunc("GET /metrics", h.stats)
+}
+
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	h.Register(mux)
+	return mux
+}
+
+// Serve listens on addr until ctx is cancelled.
+func (h *Health) Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: h.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	h.logger.Printf("Health server is listening on %s", addr)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (h *Health) live(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("OK"))
+}
+
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func (h *Health) ready(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	checks := append([]namedCheck(nil), h.checks...)
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	status := http.StatusOK
+	results := make([]checkResult, 0, len(checks))
+	for _, c := range checks {
+		result := checkResult{Name: c.name, OK: true}
+		if err := c.check(ctx); err != nil {
+			result.OK = false
+			result.Error = err.Error()
+			status = http.StatusServiceUnavailable
+		}
+		results = append(results, result)
+	}
+
+	writeJSON(w, status, results)
+}
+
+type metricsResponse struct {
+	Consumers []consumerMetrics     `json:"consumers"`
+	Handlers  []broker.HandlerStats `json:"handlers"`
+}
+
+type consumerMetrics struct {
+	broker.ConsumerStats
+	MaxLag    int64   `json:"max_lag"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+func (h *Health) stats(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	brokers := append([]broker.StatsReporter(nil), h.brokers...)
+	metrics := h.metrics
+	h.mu.Unlock()
+
+	resp := metricsResponse{Consumers: []consumerMetrics{}}
+	for _, b := range brokers {
+		stats := b.Stats()
+		resp.Consumers = append(resp.Consumers, consumerMetrics{
+			ConsumerStats: stats,
+			MaxLag:        stats.MaxLag(),
+			ErrorRate:     stats.ErrorRate(),
+		})
+	}
+	if metrics != nil {
+		resp.Handlers = metrics.Stats()
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Database checks that db answers.
+func Database(db *sql.DB) Check {
+	return func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	}
+}
+
+// Consumer fails while the consumer holds no session, see
+// broker.ConsumerStats.Rebalancing, or falls more than maxLag messages behind
+// on one of its partitions. A session without partitions is ready: a group
+// with more members than partitions leaves some of them idle.
+func Consumer(b broker.StatsReporter, maxLag int64) Check {
+	return func(ctx context.Context) error {
+		stats := b.Stats()
+		if stats.Rebalancing {
+			return errors.New("consumer group is rebalancing")
+		}
+		if lag := stats.MaxLag(); lag > maxLag {
+			return fmt.Errorf("consumer lag %d exceeds %d", lag, maxLag)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,120 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"shop/pkg/broker"
+	"testing"
+)
+
+type staticStats broker.ConsumerStats
+
+func (s staticStats) Stats() broker.ConsumerStats {
+	return broker.ConsumerStats(s)
+}
+
+func get(t *testing.T, h *Health, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestLive(t *testing.T) {
+	h := New(log.New(io.Discard, "", 0))
+	h.AddCheck("database", func(ctx context.Context) error { return errors.New("down") })
+
+	if rec := get(t, h, "/health"); rec.Code != http.StatusOK {
+		t.Errorf("GET /health = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		stats    broker.ConsumerStats
+		database error
+		want     int
+	}{
+		{
+			name:  "ready",
+			stats: broker.ConsumerStats{Partitions: []broker.PartitionStats{{Lag: 10}}},
+			want:  http.StatusOK,
+		},
+		{
+			// a member of a group with more members than partitions
+			name: "session without partitions",
+			want: http.StatusOK,
+		},
+		{
+			name:  "rebalancing",
+			stats: broker.ConsumerStats{Rebalancing: true},
+			want:  http.StatusServiceUnavailable,
+		},
+		{
+			name:  "lagging",
+			stats: broker.ConsumerStats{Partitions: []broker.PartitionStats{{Lag: 3}, {Lag: 11}}},
+			want:  http.StatusServiceUnavailable,
+		},
+		{
+			name:     "database down",
+			database: errors.New("connection refused"),
+			want:     http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(log.New(io.Discard, "", 0))
+			h.AddCheck("database", func(ctx context.Context) error { return tt.database })
+			h.AddBroker(staticStats(tt.stats), 10)
+
+			rec := get(t, h, "/ready")
+			if rec.Code != tt.want {
+				t.Errorf("GET /ready = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			var results []checkResult
+			err := json.NewDecoder(rec.Body).Decode(&results)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if len(results) != 2 || results[0].Name != "database" || results[1].Name != "broker" {
+				t.Errorf("results = %+v, want database and broker", results)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := New(log.New(io.Discard, "", 0))
+	h.AddBroker(staticStats{Group: "order-group", Attempts: 4, Failed: 1, Partitions: []broker.PartitionStats{{Topic: "orders", Lag: 5}}}, 10)
+
+	metrics := broker.NewMetrics()
+	handle := broker.Measure(metrics)(func(ctx context.Context, message broker.Message) error { return nil })
+	handle(context.Background(), broker.Message{Topic: "orders", Headers: broker.Headers{broker.HeaderMessageType: "CreateOrder"}})
+	h.SetMetrics(metrics)
+
+	rec := get(t, h, "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var resp metricsResponse
+	err := json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(resp.Consumers) != 1 || resp.Consumers[0].MaxLag != 5 || resp.Consumers[0].ErrorRate != 0.25 {
+		t.Errorf("consumers = %+v, want one with max lag 5 and error rate 0.25", resp.Consumers)
+	}
+	if len(resp.Handlers) != 1 || resp.Handlers[0].Type != "CreateOrder" || resp.Handlers[0].Handled != 1 {
+		t.Errorf("handlers = %+v, want CreateOrder handled once", resp.Handlers)
+	}
+}
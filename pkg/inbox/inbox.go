@@ -3,6 +3,8 @@ package inbox
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 )
 
@@ -11,22 +13,149 @@ const (
 	StatusPending   MessageStatus = "pending"
 	StatusCompleted MessageStatus = "completed"
 	StatusError     MessageStatus = "error"
+	// StatusParked messages failed too often and wait for an operator to
+	// replay them.
+	StatusParked MessageStatus = "parked"
+	// StatusHeld messages wait for the message before them in their
+	// aggregate. Waiting is no failed attempt, a held message is never
+	// parked for it.
+	StatusHeld MessageStatus = "held"
 )
 
 type MessageStatus string
 
 type Message struct {
-	MessageID   string          `json:"message_id"`
-	MessageType string          `json:"message_type"`
-	Topic       string          `json:"topic"`
-	Key         string          `json:"key"`
-	Payload     json.RawMessage `json:"payload"`
-	Status      MessageStatus   `json:"status"`
-	CreatedAt   time.Time       `json:"created_at"`
+	MessageID   string            `json:"message_id"`
+	MessageType string            `json:"message_type"`
+	Topic       string            `json:"topic"`
+	Key         string            `json:"key"`
+	Payload     json.RawMessage   `json:"payload"`
+	Headers     map[string]string `json:"headers"`
+	Status      MessageStatus     `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	// Attempts counts failed attempts, LastError is the error of the last one.
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	// Sequence numbers the messages of AggregateID on the topic, 0 when the
+	// producer did not number the message.
+	AggregateID string `json:"aggregate_id"`
+	Sequence    int64  `json:"sequence"`
+}
+
+var (
+	// ErrSequenceGap means an earlier message of the aggregate has not been
+	// handled yet. The message is held in the inbox until it has, or until
+	// an operator skips the gap, see Inbox.SkipGap.
+	ErrSequenceGap = errors.New("earlier message of the aggregate not handled yet")
+	// ErrStaleSequence means a later message of the aggregate was handled
+	// already. The message is parked without being handled.
+	ErrStaleSequence = errors.New("later message of the aggregate handled already")
+)
+
+// recordedError is a failure the processor recorded in the inbox.
+type recordedError struct {
+	err error
+}
+
+func (e *recordedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *recordedError) Unwrap() error {
+	return e.err
+}
+
+// IsRecorded reports whether the processor recorded the failure in the inbox.
+// The inbox worker retries or parks the message then, so the broker must
+// acknowledge it instead of retrying or dead-lettering it.
+func IsRecorded(err error) bool {
+	var r *recordedError
+	return errors.As(err, &r)
+}
+
+// isPermanent reports whether err is marked as one that retrying cannot fix,
+// see broker.Permanent.
+func isPermanent(err error) bool {
+	var p interface{ Permanent() bool }
+	return errors.As(err, &p) && p.Permanent()
+}
+
+// checkSequence says whether sequence may be handled after last, the
+// number handled last of the aggregate.
+func checkSequence(aggregateID string, last int64, sequence int64) error {
+	switch {
+	case sequence == last+1 || sequence == 1:
+		return nil
+	case sequence > last+1:
+		return fmt.Errorf("%w: got %d of %s, expected %d", ErrSequenceGap, sequence, aggregateID, last+1)
+	default:
+		return fmt.Errorf("%w: got %d of %s, handled %d", ErrStaleSequence, sequence, aggregateID, last)
+	}
+}
+
+// park parks message in the transaction ctx carries. A numbered message
+// counts as handled for its aggregate, the messages after it would wait for
+// it forever otherwise.
+func park(ctx context.Context, in Inbox, message Message) error {
+	err := in.Schedule(ctx, message.MessageID, nil)
+	if err != nil {
+		return err
+	}
+	if message.Sequence == 0 {
+		return nil
+	}
+
+	err = in.Advance(ctx, message)
+	if IsOutOfOrder(err) {
+		// a held or stale message leaves its aggregate where it is
+		return nil
+	}
+	return err
+}
+
+// IsOutOfOrder reports whether the processor held or parked the message
+// instead of handling it, so it must not be delivered again.
+func IsOutOfOrder(err error) bool {
+	return errors.Is(err, ErrSequenceGap) || errors.Is(err, ErrStaleSequence)
 }
 
 type Inbox interface {
 	Store(ctx context.Context, message Message) error
+	// TryStore stores message unless a message with its id is completed
+	// already and reports whether it stored it. A message that failed before
+	// is taken over.
+	TryStore(ctx context.Context, message Message) (bool, error)
+	// RecordFailure stores a failed attempt at message for the inbox worker
+	// and returns how many attempts failed so far.
+	RecordFailure(ctx context.Context, message Message, cause string) (int, error)
+	// Schedule sets when a failed message is handled again, or parks it when
+	// retryAt is nil.
+	Schedule(ctx context.Context, messageID string, retryAt *time.Time) error
+	// ClaimRetryable returns up to limit failed messages that are due and
+	// messages pending longer than stuckAfter, and hides them from other
+	// workers for lease.
+	ClaimRetryable(ctx context.Context, stuckAfter time.Duration, lease time.Duration, limit int) ([]Message, error)
+	// Advance records that the numbered message is handled, in the
+	// transaction that handles it. It returns ErrSequenceGap or
+	// ErrStaleSequence when the message is not the next one of its
+	// aggregate. Number 1 starts the aggregate over, the producer forgets
+	// aggregates that were idle longer than its retention. The first message
+	// of an aggregate the inbox knows nothing of starts it at its number, so
+	// a consumer that starts late does not wait for messages it never gets.
+	// The next message, when it is held already, is handled without waiting.
+	Advance(ctx context.Context, message Message) error
+	// Hold stores message as held until retryAt or until the message before
+	// it is handled, without counting a failed attempt.
+	Hold(ctx context.Context, message Message, cause string, retryAt time.Time) error
+	// SkipGap treats the messages of the aggregate on topic up to sequence as
+	// handled, for messages that never reach the inbox, and returns whether
+	// it moved the aggregate forward. The next message is handled without
+	// waiting.
+	SkipGap(ctx context.Context, topic string, aggregateID string, sequence int64) (bool, error)
+	// Replay hands parked messages to the inbox worker again, all of them
+	// when ids is empty. Replayed messages are handled whatever their
+	// number, parking moved their aggregate past them already.
+	Replay(ctx context.Context, ids []string) (int64, error)
 	Exists(ctx context.Context, messageID string) (bool, error)
 	MarkAsPending(ctx context.Context, messageID string) error
 	MarkAsCompleted(ctx context.Context, messageID string) error
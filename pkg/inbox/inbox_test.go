@@ -0,0 +1,73 @@
+package inbox
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckSequence(t *testing.T) {
+	tests := []struct {
+		name     string
+		last     int64
+		sequence int64
+		want     error
+	}{
+		{name: "next number", last: 4, sequence: 5},
+		{name: "first number", last: 0, sequence: 1},
+		{name: "number 1 starts the aggregate over", last: 7, sequence: 1},
+		{name: "dropped intermediate number", last: 1, sequence: 3, want: ErrSequenceGap},
+		{name: "handled number", last: 4, sequence: 4, want: ErrStaleSequence},
+		{name: "earlier number", last: 4, sequence: 2, want: ErrStaleSequence},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSequence("saga-1", tt.last, tt.sequence)
+			if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+				t.Errorf("checkSequence(%d, %d) = %v, want %v", tt.last, tt.sequence, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParkMovesTheAggregatePastTheMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence int64
+		last     int64
+		wantMove bool
+	}{
+		{name: "unnumbered message", sequence: 0},
+		{name: "next message", sequence: 3, last: 2, wantMove: true},
+		{name: "late message", sequence: 2, last: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mock := withMockTx(t)
+			m := testMessage()
+			m.AggregateID = "saga-1"
+			m.Sequence = tt.sequence
+
+			mock.ExpectExec(`UPDATE inbox SET status = \$1, next_attempt_at = \$2`).
+				WithArgs(StatusParked, nil, m.MessageID, StatusError, StatusHeld).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			if tt.sequence > 0 {
+				expectPosition(mock, m, tt.last)
+			}
+			if tt.wantMove {
+				expectAdvance(mock, m)
+			}
+
+			err := park(ctx, NewPostgresInbox(), m)
+			if err != nil {
+				t.Fatalf("park: %v", err)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -2,10 +2,11 @@ package inbox
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"log"
+	"shop/pkg/tx"
+	"time"
 )
 
 type PostgresInbox struct{}
@@ -15,9 +16,9 @@ func NewPostgresInbox() *PostgresInbox {
 }
 
 func (o *PostgresInbox) Store(ctx context.Context, message Message) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
 	}
 	jsonPayload, err := json.Marshal(message.Payload)
 	if err != nil {
@@ -25,7 +26,7 @@ func (o *PostgresInbox) Store(ctx context.Context, message Message) error {
 	}
 
 	query := "INSERT INTO inbox (message_id, message_type, topic, key, payload, status, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
-	_, err = tx.ExecContext(ctx, query, message.MessageID, message.MessageType, message.Topic, message.Key, jsonPayload, message.Status, message.CreatedAt)
+	_, err = conn.ExecContext(ctx, query, message.MessageID, message.MessageType, message.Topic, message.Key, jsonPayload, message.Status, message.CreatedAt)
 	if err != nil {
 		return err
 	}
@@ -33,15 +34,242 @@ func (o *PostgresInbox) Store(ctx context.Context, message Message) error {
 	return nil
 }
 
+func (o *PostgresInbox) TryStore(ctx context.Context, message Message) (bool, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return false, err
+	}
+	jsonPayload, jsonHeaders, err := marshalMessage(message)
+	if err != nil {
+		return false, err
+	}
+
+	// the update waits for a concurrent insert of the same message to finish
+	query := `INSERT INTO inbox (message_id, message_type, topic, key, payload, headers, status, created_at, aggregate_id, sequence) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($10, ''), NULLIF($11, 0))
+		ON CONFLICT (message_id) DO UPDATE SET status = EXCLUDED.status WHERE inbox.status <> $9`
+	r, err := conn.ExecContext(ctx, query, message.MessageID, message.MessageType, message.Topic, message.Key, jsonPayload, jsonHeaders, message.Status, message.CreatedAt, StatusCompleted, message.AggregateID, message.Sequence)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (o *PostgresInbox) RecordFailure(ctx context.Context, message Message, cause string) (int, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return 0, err
+	}
+	jsonPayload, jsonHeaders, err := marshalMessage(message)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO inbox (message_id, message_type, topic, key, payload, headers, status, created_at, attempts, last_error, aggregate_id, sequence) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 1, $9, NULLIF($10, ''), NULLIF($11, 0))
+		ON CONFLICT (message_id) DO UPDATE SET status = EXCLUDED.status, attempts = inbox.attempts + 1, last_error = EXCLUDED.last_error
+		RETURNING attempts`
+	var attempts int
+	err = conn.QueryRowContext(ctx, query, message.MessageID, message.MessageType, message.Topic, message.Key, jsonPayload, jsonHeaders, StatusError, message.CreatedAt, cause, message.AggregateID, message.Sequence).Scan(&attempts)
+	if err != nil {
+		return 0, err
+	}
+
+	return attempts, nil
+}
+
+func (o *PostgresInbox) Schedule(ctx context.Context, messageID string, retryAt *time.Time) error {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
+	}
+	status := StatusError
+	if retryAt == nil {
+		status = StatusParked
+	}
+
+	query := "UPDATE inbox SET status = $1, next_attempt_at = $2 WHERE message_id = $3 AND status IN ($4, $5)"
+	_, err = conn.ExecContext(ctx, query, status, retryAt, messageID, StatusError, StatusHeld)
+	return err
+}
+
+func (o *PostgresInbox) Hold(ctx context.Context, message Message, cause string, retryAt time.Time) error {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
+	}
+	jsonPayload, jsonHeaders, err := marshalMessage(message)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO inbox (message_id, message_type, topic, key, payload, headers, status, created_at, last_error, next_attempt_at, aggregate_id, sequence) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, 0))
+		ON CONFLICT (message_id) DO UPDATE SET status = EXCLUDED.status, last_error = EXCLUDED.last_error, next_attempt_at = EXCLUDED.next_attempt_at`
+	_, err = conn.ExecContext(ctx, query, message.MessageID, message.MessageType, message.Topic, message.Key, jsonPayload, jsonHeaders, StatusHeld, message.CreatedAt, cause, retryAt, message.AggregateID, message.Sequence)
+	return err
+}
+
+func (o *PostgresInbox) ClaimRetryable(ctx context.Context, stuckAfter time.Duration, lease time.Duration, limit int) ([]Message, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	// held messages stay held, a stuck pending one counts as failed
+	query := `UPDATE inbox SET status = CASE WHEN status = $4 THEN $1 ELSE status END, next_attempt_at = $2 WHERE message_id IN (
+			SELECT message_id FROM inbox
+			WHERE (status IN ($1, $7) AND next_attempt_at <= $3) OR (status = $4 AND created_at < $5)
+			ORDER BY created_at LIMIT $6
+			FOR UPDATE SKIP LOCKED)
+		RETURNING message_id, message_type, topic, key, payload, headers, status, created_at, attempts, COALESCE(last_error, ''), COALESCE(aggregate_id, ''), COALESCE(sequence, 0)`
+	rows, err := conn.QueryContext(ctx, query, StatusError, now.Add(lease), now, StatusPending, now.Add(-stuckAfter), limit, StatusHeld)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for rows.Next() {
+		var message Message
+		var jsonPayload, jsonHeaders []byte
+		err = rows.Scan(&message.MessageID, &message.MessageType, &message.Topic, &message.Key, &jsonPayload, &jsonHeaders, &message.Status, &message.CreatedAt, &message.Attempts, &message.LastError, &message.AggregateID, &message.Sequence)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		message.Payload = jsonPayload
+		err = json.Unmarshal(jsonHeaders, &message.Headers)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (o *PostgresInbox) Advance(ctx context.Context, message Message) error {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	// An unknown aggregate starts before its lowest unfinished message, which
+	// may be this one. The row lock makes messages of one aggregate advance
+	// one at a time.
+	query := `INSERT INTO inbox_sequences (topic, aggregate_id, sequence, updated_at)
+		SELECT $1, $2, LEAST(COALESCE(MIN(sequence), $3), $3) - 1, $4 FROM inbox WHERE topic = $1 AND aggregate_id = $2 AND status <> $5
+		ON CONFLICT (topic, aggregate_id) DO NOTHING`
+	_, err = conn.ExecContext(ctx, query, message.Topic, message.AggregateID, message.Sequence, now, StatusCompleted)
+	if err != nil {
+		return err
+	}
+	var last int64
+	query = "SELECT sequence FROM inbox_sequences WHERE topic = $1 AND aggregate_id = $2 FOR UPDATE"
+	err = conn.QueryRowContext(ctx, query, message.Topic, message.AggregateID).Scan(&last)
+	if err != nil {
+		return err
+	}
+
+	err = checkSequence(message.AggregateID, last, message.Sequence)
+	if err != nil {
+		return err
+	}
+
+	query = "UPDATE inbox_sequences SET sequence = $1, updated_at = $2 WHERE topic = $3 AND aggregate_id = $4"
+	_, err = conn.ExecContext(ctx, query, message.Sequence, now, message.Topic, message.AggregateID)
+	if err != nil {
+		return err
+	}
+
+	return o.wakeNext(ctx, message.Topic, message.AggregateID, message.Sequence, now)
+}
+
+func (o *PostgresInbox) SkipGap(ctx context.Context, topic string, aggregateID string, sequence int64) (bool, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+
+	query := `INSERT INTO inbox_sequences (topic, aggregate_id, sequence, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (topic, aggregate_id) DO UPDATE SET sequence = EXCLUDED.sequence, updated_at = EXCLUDED.updated_at
+		WHERE inbox_sequences.sequence < EXCLUDED.sequence`
+	r, err := conn.ExecContext(ctx, query, topic, aggregateID, sequence, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	return true, o.wakeNext(ctx, topic, aggregateID, sequence, now)
+}
+
+// wakeNext makes the message after sequence due, when it waits already.
+func (o *PostgresInbox) wakeNext(ctx context.Context, topic string, aggregateID string, sequence int64, now time.Time) error {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE inbox SET next_attempt_at = $1 WHERE status IN ($2, $3) AND topic = $4 AND aggregate_id = $5 AND sequence = $6"
+	_, err = conn.ExecContext(ctx, query, now, StatusHeld, StatusError, topic, aggregateID, sequence+1)
+	return err
+}
+
+func (o *PostgresInbox) Replay(ctx context.Context, ids []string) (int64, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+
+	query := "UPDATE inbox SET status = $1, attempts = 0, next_attempt_at = $2, sequence = NULL WHERE status = $3 AND (cardinality($4::text[]) = 0 OR message_id = ANY($4))"
+	r, err := conn.ExecContext(ctx, query, StatusError, time.Now(), StatusParked, ids)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+func marshalMessage(message Message) ([]byte, []byte, error) {
+	jsonPayload, err := json.Marshal(message.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers := message.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	jsonHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonPayload, jsonHeaders, nil
+}
+
 func (o *PostgresInbox) Exists(ctx context.Context, messageID string) (bool, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return false, errors.New("transaction not found in context")
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return false, err
 	}
 
 	query := `SELECT 1 from inbox WHERE message_id = $1`
 	var result int
-	err := tx.QueryRowContext(ctx, query, messageID).Scan(
+	err = conn.QueryRowContext(ctx, query, messageID).Scan(
 		&result,
 	)
 	if err != nil {
@@ -64,13 +292,13 @@ func (o *PostgresInbox) MarkAsError(ctx context.Context, messageID string) error
 }
 
 func (o *PostgresInbox) updateStatus(ctx context.Context, messageID string, from MessageStatus, to MessageStatus) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
 	}
 
 	query := "UPDATE inbox SET status = $1 WHERE message_id = $2 AND status = $3"
-	r, err := tx.ExecContext(ctx, query, to, messageID, from)
+	r, err := conn.ExecContext(ctx, query, to, messageID, from)
 	if err != nil {
 		log.Println("failed to update status value", "error", err)
 		return err
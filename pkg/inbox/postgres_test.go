@@ -0,0 +1,183 @@
+package inbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"shop/pkg/tx"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// arrayConverter passes slices through to the expectations, as pgx takes
+// them for ANY($n).
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	if v != nil && reflect.TypeOf(v).Kind() == reflect.Slice && reflect.TypeOf(v).Elem().Kind() != reflect.Uint8 {
+		return v, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+func withMockTx(t *testing.T) (context.Context, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mock.ExpectBegin()
+	sqlTx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	t.Cleanup(func() { sqlTx.Rollback() })
+
+	return tx.With(context.Background(), sqlTx), mock
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string
+		wantIDs []string
+	}{
+		{name: "all parked messages", wantIDs: []string{}},
+		{name: "given messages", ids: []string{"message-1", "message-2"}, wantIDs: []string{"message-1", "message-2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mock := withMockTx(t)
+			mock.ExpectExec(`UPDATE inbox SET status = \$1, attempts = 0, next_attempt_at = \$2, sequence = NULL WHERE status = \$3 AND \(cardinality\(\$4::text\[\]\) = 0 OR message_id = ANY\(\$4\)\)`).
+				WithArgs(StatusError, sqlmock.AnyArg(), StatusParked, tt.wantIDs).
+				WillReturnResult(sqlmock.NewResult(0, 2))
+
+			n, err := NewPostgresInbox().Replay(ctx, tt.ids)
+			if n != 2 || err != nil {
+				t.Errorf("Replay = %d, %v, want 2, nil", n, err)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// expectPosition expects Advance to read the position of the aggregate of m,
+// last being the number handled last.
+func expectPosition(mock sqlmock.Sqlmock, m Message, last int64) {
+	mock.ExpectExec(`INSERT INTO inbox_sequences \(topic, aggregate_id, sequence, updated_at\)\s+SELECT \$1, \$2, LEAST\(COALESCE\(MIN\(sequence\), \$3\), \$3\) - 1, \$4 FROM inbox WHERE topic = \$1 AND aggregate_id = \$2 AND status <> \$5\s+ON CONFLICT \(topic, aggregate_id\) DO NOTHING`).
+		WithArgs(m.Topic, m.AggregateID, m.Sequence, sqlmock.AnyArg(), StatusCompleted).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT sequence FROM inbox_sequences WHERE topic = \$1 AND aggregate_id = \$2 FOR UPDATE`).
+		WithArgs(m.Topic, m.AggregateID).
+		WillReturnRows(sqlmock.NewRows([]string{"sequence"}).AddRow(last))
+}
+
+// expectAdvance expects the aggregate of m to move to its number and the
+// message after it to be woken.
+func expectAdvance(mock sqlmock.Sqlmock, m Message) {
+	mock.ExpectExec(`UPDATE inbox_sequences SET sequence = \$1, updated_at = \$2 WHERE topic = \$3 AND aggregate_id = \$4`).
+		WithArgs(m.Sequence, sqlmock.AnyArg(), m.Topic, m.AggregateID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE inbox SET next_attempt_at = \$1 WHERE status IN \(\$2, \$3\) AND topic = \$4 AND aggregate_id = \$5 AND sequence = \$6`).
+		WithArgs(sqlmock.AnyArg(), StatusHeld, StatusError, m.Topic, m.AggregateID, m.Sequence+1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestAdvance(t *testing.T) {
+	tests := []struct {
+		name     string
+		last     int64
+		sequence int64
+		wantErr  error
+	}{
+		{name: "next message", last: 1, sequence: 2},
+		{name: "number 1 resets the aggregate", last: 9, sequence: 1},
+		{name: "unknown aggregate starts at the message", last: 6, sequence: 7},
+		{name: "dropped intermediate message holds the next", last: 1, sequence: 3, wantErr: ErrSequenceGap},
+		{name: "late message", last: 3, sequence: 2, wantErr: ErrStaleSequence},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mock := withMockTx(t)
+			m := testMessage()
+			m.AggregateID = "saga-1"
+			m.Sequence = tt.sequence
+
+			expectPosition(mock, m, tt.last)
+			if tt.wantErr == nil {
+				expectAdvance(mock, m)
+			}
+
+			err := NewPostgresInbox().Advance(ctx, m)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("Advance = %v, want %v", err, tt.wantErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSkipGap(t *testing.T) {
+	tests := []struct {
+		name      string
+		moved     int64
+		wantMoved bool
+	}{
+		{name: "aggregate moves past the gap", moved: 1, wantMoved: true},
+		{name: "aggregate is past the gap already", moved: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mock := withMockTx(t)
+			mock.ExpectExec(`INSERT INTO inbox_sequences .* ON CONFLICT \(topic, aggregate_id\) DO UPDATE SET sequence = EXCLUDED.sequence, updated_at = EXCLUDED.updated_at\s+WHERE inbox_sequences.sequence < EXCLUDED.sequence`).
+				WithArgs("order-events", "saga-1", int64(2), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tt.moved))
+			if tt.wantMoved {
+				mock.ExpectExec(`UPDATE inbox SET next_attempt_at = \$1 WHERE status IN \(\$2, \$3\)`).
+					WithArgs(sqlmock.AnyArg(), StatusHeld, StatusError, "order-events", "saga-1", int64(3)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			moved, err := NewPostgresInbox().SkipGap(ctx, "order-events", "saga-1", 2)
+			if moved != tt.wantMoved || err != nil {
+				t.Errorf("SkipGap = %v, %v, want %v, nil", moved, err, tt.wantMoved)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestClaimRetryableClaimsHeldMessages(t *testing.T) {
+	ctx, mock := withMockTx(t)
+	columns := []string{"message_id", "message_type", "topic", "key", "payload", "headers", "status", "created_at", "attempts", "last_error", "aggregate_id", "sequence"}
+	mock.ExpectQuery(`UPDATE inbox SET status = CASE WHEN status = \$4 THEN \$1 ELSE status END, next_attempt_at = \$2 .* WHERE \(status IN \(\$1, \$7\) AND next_attempt_at <= \$3\) OR \(status = \$4 AND created_at < \$5\)`).
+		WithArgs(StatusError, sqlmock.AnyArg(), sqlmock.AnyArg(), StatusPending, sqlmock.AnyArg(), 10, StatusHeld).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("message-2", "order.created", "order-events", "saga-1", []byte(`{}`), []byte(`{}`), StatusHeld, time.Now(), 0, "gap", "saga-1", 2))
+
+	messages, err := NewPostgresInbox().ClaimRetryable(ctx, time.Minute, time.Minute, 10)
+	if err != nil {
+		t.Fatalf("ClaimRetryable: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Status != StatusHeld || messages[0].Attempts != 0 {
+		t.Errorf("claimed %+v, want the held message without attempts", messages)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,177 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"shop/pkg/tx"
+	"time"
+)
+
+// RetryPolicy says how often the inbox worker handles a failed message again
+// before it is parked. The first delivery counts as an attempt.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 10 * time.Second,
+	MaxBackoff:     10 * time.Minute,
+}
+
+// Backoff returns the delay after the given failed attempt, starting from 1.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+
+	return d
+}
+
+// DefaultHoldInterval is how often a held message is checked again. Handling
+// the message before it wakes it at once, the interval is a fallback.
+const DefaultHoldInterval = 1 * time.Minute
+
+// Processor handles each message at most once. The inbox row and the work
+// done for the message commit in one transaction, so a crash either loses
+// both, and the redelivered message is handled, or neither.
+type Processor struct {
+	db           *sql.DB
+	inbox        Inbox
+	logger       *log.Logger
+	policy       RetryPolicy
+	holdInterval time.Duration
+}
+
+func NewProcessor(db *sql.DB, inbox Inbox, logger *log.Logger) *Processor {
+	return &Processor{db: db, inbox: inbox, logger: logger, policy: DefaultRetryPolicy, holdInterval: DefaultHoldInterval}
+}
+
+func (p *Processor) SetRetryPolicy(policy RetryPolicy) {
+	p.policy = policy
+}
+
+func (p *Processor) SetHoldInterval(interval time.Duration) {
+	p.holdInterval = interval
+}
+
+// Process stores message as completed and runs fn in the same transaction,
+// which fn finds in ctx, see package tx. A completed message is skipped without
+// calling fn. When fn fails its work is rolled back, the failure is recorded
+// for the inbox worker and returned, see IsRecorded. Only when recording fails
+// too is the plain error returned, and the broker delivers the message again.
+// A numbered message that is not the next one of its aggregate is held for
+// the inbox worker, or parked when it comes too late, without calling fn;
+// see IsOutOfOrder. Parking a numbered message moves its aggregate past it.
+func (p *Processor) Process(ctx context.Context, message Message, fn func(ctx context.Context) error) error {
+	t, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	ctxWithTx := tx.With(ctx, t)
+
+	message.Status = StatusCompleted
+	stored, err := p.inbox.TryStore(ctxWithTx, message)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		p.logger.Printf("Ignore existing message %s", message.MessageID)
+		return nil
+	}
+
+	if message.Sequence > 0 {
+		err = p.inbox.Advance(ctxWithTx, message)
+		if errors.Is(err, ErrSequenceGap) {
+			return p.hold(ctx, t, message, err)
+		}
+		if err != nil {
+			return p.fail(ctx, t, message, err)
+		}
+	}
+
+	err = fn(ctxWithTx)
+	if err != nil {
+		return p.fail(ctx, t, message, err)
+	}
+
+	return t.Commit()
+}
+
+// hold rolls back t and holds the message until the one before it is
+// handled. The gap is returned.
+func (p *Processor) hold(ctx context.Context, t *sql.Tx, message Message, gap error) error {
+	t.Rollback()
+	p.logger.Printf("Hold message %s: %v", message.MessageID, gap)
+
+	err := p.withTx(ctx, func(ctx context.Context) error {
+		return p.inbox.Hold(ctx, message, gap.Error(), time.Now().Add(p.holdInterval))
+	})
+	if err != nil {
+		p.logger.Printf("Failed to hold message %s: %v", message.MessageID, err)
+		return gap
+	}
+	return &recordedError{err: gap}
+}
+
+// fail rolls back t and records the failure, which is returned.
+func (p *Processor) fail(ctx context.Context, t *sql.Tx, message Message, cause error) error {
+	t.Rollback()
+	err := p.recordFailure(ctx, message, cause)
+	if err != nil {
+		p.logger.Printf("Failed to record failure of message %s: %v", message.MessageID, err)
+		return cause
+	}
+	return &recordedError{err: cause}
+}
+
+func (p *Processor) recordFailure(ctx context.Context, message Message, cause error) error {
+	return p.withTx(ctx, func(ctx context.Context) error {
+		attempts, err := p.inbox.RecordFailure(ctx, message, cause.Error())
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case errors.Is(cause, ErrStaleSequence):
+			p.logger.Printf("Message %s came too late, parking it: %v", message.MessageID, cause)
+		case isPermanent(cause):
+			p.logger.Printf("Message %s cannot be handled, parking it: %v", message.MessageID, cause)
+		case attempts < max(p.policy.MaxAttempts, 1):
+			retryAt := time.Now().Add(p.policy.Backoff(attempts))
+			return p.inbox.Schedule(ctx, message.MessageID, &retryAt)
+		default:
+			p.logger.Printf("Message %s failed %d times, parking it: %v", message.MessageID, attempts, cause)
+		}
+
+		return park(ctx, p.inbox, message)
+	})
+}
+
+// withTx runs fn in a transaction of its own, which outlives ctx, so a
+// failure is recorded even when the consumer is stopping.
+func (p *Processor) withTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx = context.WithoutCancel(ctx)
+	t, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	err = fn(tx.With(ctx, t))
+	if err != nil {
+		return err
+	}
+
+	return t.Commit()
+}
@@ -0,0 +1,255 @@
+package inbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"shop/pkg/tx"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var discard = log.New(io.Discard, "", 0)
+
+func newMockProcessor(t *testing.T) (*Processor, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewProcessor(db, NewPostgresInbox(), discard), mock
+}
+
+func testMessage() Message {
+	return Message{
+		MessageID:   "message-1",
+		MessageType: "order.created",
+		Topic:       "order-events",
+		Key:         "saga-1",
+		Payload:     []byte(`{}`),
+		CreatedAt:   time.Now(),
+	}
+}
+
+// expectTryStore expects the message to be stored as completed, stored says
+// whether no completed row with its id existed yet.
+func expectTryStore(mock sqlmock.Sqlmock, m Message, stored bool) {
+	var n int64
+	if stored {
+		n = 1
+	}
+	mock.ExpectExec(`INSERT INTO inbox .* ON CONFLICT \(message_id\) DO UPDATE SET status = EXCLUDED.status WHERE inbox.status <> \$9`).
+		WithArgs(m.MessageID, m.MessageType, m.Topic, m.Key, sqlmock.AnyArg(), []byte(`{}`), StatusCompleted, m.CreatedAt, StatusCompleted, m.AggregateID, m.Sequence).
+		WillReturnResult(sqlmock.NewResult(0, n))
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name       string
+		stored     bool
+		wantCalled bool
+	}{
+		{name: "new message is handled in the transaction", stored: true, wantCalled: true},
+		{name: "completed message is skipped", stored: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMockProcessor(t)
+			m := testMessage()
+
+			mock.ExpectBegin()
+			expectTryStore(mock, m, tt.stored)
+			if tt.stored {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			called := false
+			err := p.Process(context.Background(), m, func(ctx context.Context) error {
+				called = true
+				if _, err := tx.From(ctx); err != nil {
+					t.Errorf("handler runs without the transaction: %v", err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Process: %v", err)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("handler called = %v, want %v", called, tt.wantCalled)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestProcessRollsBackFailedHandler(t *testing.T) {
+	p, mock := newMockProcessor(t)
+	m := testMessage()
+	failure := errors.New("cannot handle")
+
+	mock.ExpectBegin()
+	expectTryStore(mock, m, true)
+	mock.ExpectExec(`INSERT INTO orders`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	// the failure is recorded in a transaction of its own
+	mock.ExpectBegin().WillReturnError(errors.New("database is gone"))
+
+	err := p.Process(context.Background(), m, func(ctx context.Context) error {
+		conn, err := tx.From(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, "INSERT INTO orders (id) VALUES ($1)", "order-1"); err != nil {
+			return err
+		}
+		return failure
+	})
+	// unrecorded, the broker must deliver the message again
+	if !errors.Is(err, failure) || IsRecorded(err) {
+		t.Fatalf("Process = %v, want the unrecorded %v", err, failure)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// permanentError is marked as broker.Permanent marks errors.
+type permanentError struct{ error }
+
+func (permanentError) Permanent() bool { return true }
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// scheduled matches the retry time argument: nil when the message is parked.
+type scheduled struct{ parked bool }
+
+func (s scheduled) Match(v driver.Value) bool {
+	if s.parked {
+		return v == nil
+	}
+	at, ok := v.(time.Time)
+	return ok && at.After(time.Now())
+}
+
+func TestProcessRecordsFailure(t *testing.T) {
+	failure := errors.New("cannot handle")
+	tests := []struct {
+		name       string
+		cause      error
+		attempts   int
+		wantParked bool
+	}{
+		{name: "failure is retried with backoff", cause: failure, attempts: 1},
+		{name: "last attempt parks the message", cause: failure, attempts: 3, wantParked: true},
+		{name: "permanent failure parks the message at once", cause: permanentError{failure}, attempts: 1, wantParked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, mock := newMockProcessor(t)
+			p.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute})
+			m := testMessage()
+
+			mock.ExpectBegin()
+			expectTryStore(mock, m, true)
+			mock.ExpectRollback()
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO inbox .* attempts = inbox.attempts \+ 1, last_error = EXCLUDED.last_error\s+RETURNING attempts`).
+				WithArgs(m.MessageID, m.MessageType, m.Topic, m.Key, sqlmock.AnyArg(), []byte(`{}`), StatusError, m.CreatedAt, "cannot handle", "", int64(0)).
+				WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(tt.attempts))
+			status := StatusError
+			if tt.wantParked {
+				status = StatusParked
+			}
+			mock.ExpectExec(`UPDATE inbox SET status = \$1, next_attempt_at = \$2 WHERE message_id = \$3 AND status IN \(\$4, \$5\)`).
+				WithArgs(status, scheduled{parked: tt.wantParked}, m.MessageID, StatusError, StatusHeld).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			err := p.Process(context.Background(), m, func(context.Context) error { return tt.cause })
+			if !IsRecorded(err) || !errors.Is(err, failure) {
+				t.Fatalf("Process = %v, want the recorded %v", err, failure)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestProcessHoldsMessageAfterGap(t *testing.T) {
+	p, mock := newMockProcessor(t)
+	p.SetHoldInterval(time.Minute)
+	m := testMessage()
+	m.AggregateID = "saga-1"
+	m.Sequence = 3
+
+	mock.ExpectBegin()
+	expectTryStore(mock, m, true)
+	// number 2 never came
+	expectPosition(mock, m, 1)
+	mock.ExpectRollback()
+	// held without counting an attempt
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO inbox .* ON CONFLICT \(message_id\) DO UPDATE SET status = EXCLUDED.status, last_error = EXCLUDED.last_error, next_attempt_at = EXCLUDED.next_attempt_at`).
+		WithArgs(m.MessageID, m.MessageType, m.Topic, m.Key, sqlmock.AnyArg(), []byte(`{}`), StatusHeld, m.CreatedAt, sqlmock.AnyArg(), scheduled{}, "saga-1", int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := p.Process(context.Background(), m, func(context.Context) error {
+		t.Error("handler called for a message after a gap")
+		return nil
+	})
+	if !IsRecorded(err) || !errors.Is(err, ErrSequenceGap) {
+		t.Fatalf("Process = %v, want the recorded gap", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProcessParkingNumberedMessageMovesItsAggregate(t *testing.T) {
+	p, mock := newMockProcessor(t)
+	m := testMessage()
+	m.AggregateID = "saga-1"
+	m.Sequence = 2
+
+	mock.ExpectBegin()
+	expectTryStore(mock, m, true)
+	expectPosition(mock, m, 1)
+	mock.ExpectExec(`UPDATE inbox_sequences SET sequence`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE inbox SET next_attempt_at`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO inbox .* RETURNING attempts`).
+		WillReturnRows(sqlmock.NewRows([]string{"attempts"}).AddRow(1))
+	mock.ExpectExec(`UPDATE inbox SET status = \$1, next_attempt_at = \$2`).
+		WithArgs(StatusParked, nil, m.MessageID, StatusError, StatusHeld).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// the rolled back position is recorded again, and number 3 is woken
+	expectPosition(mock, m, 1)
+	expectAdvance(mock, m)
+	mock.ExpectCommit()
+
+	err := p.Process(context.Background(), m, func(context.Context) error {
+		return permanentError{errors.New("payload does not unmarshal")}
+	})
+	if !IsRecorded(err) {
+		t.Fatalf("Process = %v, want a recorded failure", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
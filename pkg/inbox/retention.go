@@ -0,0 +1,145 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// RetentionConfig says which completed messages the retention job removes.
+// Errored messages are kept for investigation.
+type RetentionConfig struct {
+	// MaxAge is how long completed messages are kept. A duplicate delivered
+	// after its inbox row is gone is handled again, so MaxAge must be longer
+	// than the broker keeps messages. It must be longer than the producers'
+	// outbox MaxAge as well, so an aggregate is forgotten by its producer,
+	// which starts numbering it from 1 again, before its consumers.
+	MaxAge time.Duration
+	// BatchSize rows are removed per transaction, so the job never holds
+	// many locks or a long transaction.
+	BatchSize int
+	Interval  time.Duration
+	// Archive moves rows to inbox_archive instead of deleting them.
+	Archive bool
+}
+
+// DefaultRetention keeps messages twice as long as the topics keep them.
+var DefaultRetention = RetentionConfig{
+	MaxAge:    14 * 24 * time.Hour,
+	BatchSize: 500,
+	Interval:  1 * time.Hour,
+}
+
+type Retention struct {
+	db     *sql.DB
+	config RetentionConfig
+	logger *log.Logger
+}
+
+func NewRetention(db *sql.DB, config RetentionConfig, logger *log.Logger) *Retention {
+	if config.BatchSize < 1 {
+		config.BatchSize = DefaultRetention.BatchSize
+	}
+	if config.Interval <= 0 {
+		config.Interval = DefaultRetention.Interval
+	}
+
+	return &Retention{db: db, config: config, logger: logger}
+}
+
+// Start purges the inbox now and every interval until ctx is cancelled.
+func (r *Retention) Start(ctx context.Context) {
+	for {
+		n, err := r.Purge(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.logger.Printf("inbox retention failed after removing %d messages: %v", n, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.config.Interval):
+		}
+	}
+}
+
+// Purge removes completed messages older than MaxAge batch by batch and
+// returns how many it removed.
+func (r *Retention) Purge(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-r.config.MaxAge)
+
+	var total int64
+	for {
+		n, err := r.purgeBatch(ctx, cutoff)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < int64(r.config.BatchSize) {
+			break
+		}
+	}
+
+	forgotten, err := r.purgeSequences(ctx, cutoff)
+	if err != nil {
+		return total, err
+	}
+	if forgotten > 0 {
+		r.logger.Printf("inbox retention forgot the sequence of %d aggregates idle since %s", forgotten, cutoff.Format(time.RFC3339))
+	}
+
+	if total > 0 {
+		action := "deleted"
+		if r.config.Archive {
+			action = "archived"
+		}
+		r.logger.Printf("inbox retention %s %d messages received before %s", action, total, cutoff.Format(time.RFC3339))
+	}
+
+	return total, nil
+}
+
+func (r *Retention) purgeBatch(ctx context.Context, cutoff time.Time) (int64, error) {
+	batch := "SELECT message_id FROM inbox WHERE status = $1 AND created_at < $2 ORDER BY created_at LIMIT $3 FOR UPDATE SKIP LOCKED"
+
+	query := "DELETE FROM inbox WHERE message_id IN (" + batch + ")"
+	if r.config.Archive {
+		query = `WITH moved AS (DELETE FROM inbox WHERE message_id IN (` + batch + `)
+			RETURNING message_id, message_type, topic, key, payload, headers, status, created_at, attempts, last_error, next_attempt_at, aggregate_id, sequence)
+			INSERT INTO inbox_archive (message_id, message_type, topic, key, payload, headers, status, created_at, attempts, last_error, next_attempt_at, aggregate_id, sequence)
+			SELECT * FROM moved`
+	}
+
+	res, err := r.db.ExecContext(ctx, query, StatusCompleted, cutoff, r.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// purgeSequences forgets the sequence numbers of aggregates that were idle
+// longer than MaxAge and have no unfinished messages.
+func (r *Retention) purgeSequences(ctx context.Context, cutoff time.Time) (int64, error) {
+	query := `DELETE FROM inbox_sequences WHERE (topic, aggregate_id) IN (
+			SELECT topic, aggregate_id FROM inbox_sequences s WHERE updated_at < $1
+			AND NOT EXISTS (SELECT 1 FROM inbox m WHERE m.topic = s.topic AND m.aggregate_id = s.aggregate_id AND m.status <> $2)
+			LIMIT $3 FOR UPDATE SKIP LOCKED)`
+
+	var total int64
+	for {
+		res, err := r.db.ExecContext(ctx, query, cutoff, StatusCompleted, r.config.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < int64(r.config.BatchSize) {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package inbox
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRetentionPurge(t *testing.T) {
+	tests := []struct {
+		name      string
+		archive   bool
+		query     string
+		batches   []int64
+		wantTotal int64
+	}{
+		{name: "delete", query: `DELETE FROM inbox WHERE message_id IN \(SELECT message_id FROM inbox WHERE status = \$1 AND created_at < \$2 ORDER BY created_at LIMIT \$3 FOR UPDATE SKIP LOCKED\)`, batches: []int64{3, 1}, wantTotal: 4},
+		{name: "archive", archive: true, query: `WITH moved AS \(DELETE FROM inbox WHERE message_id IN \(SELECT message_id FROM inbox .*\) RETURNING .*\) INSERT INTO inbox_archive .* SELECT \* FROM moved`, batches: []int64{0}, wantTotal: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			r := NewRetention(db, RetentionConfig{MaxAge: time.Hour, BatchSize: 3, Archive: tt.archive}, log.New(io.Discard, "", 0))
+			for _, n := range tt.batches {
+				mock.ExpectExec(tt.query).
+					WithArgs(StatusCompleted, sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, n))
+			}
+			mock.ExpectExec(`DELETE FROM inbox_sequences`).
+				WithArgs(sqlmock.AnyArg(), StatusCompleted, 3).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			total, err := r.Purge(context.Background())
+			if total != tt.wantTotal || err != nil {
+				t.Errorf("Purge = %d, %v, want %d, nil", total, err, tt.wantTotal)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -1,3 +1,142 @@
 package inbox
 
-// TODO retry pending messages ?
+import (
+	"context"
+	"database/sql"
+	"log"
+	"shop/pkg/tx"
+	"sync"
+	"time"
+)
+
+// Handler handles a stored message again. It must go through a Processor,
+// which marks the message completed or records the next failure.
+type Handler func(ctx context.Context, message Message) error
+
+const (
+	// DefaultStuckAfter is how long a message may stay pending before the
+	// worker treats it as failed. Only the old two transaction flow left
+	// messages pending.
+	DefaultStuckAfter = 5 * time.Minute
+	// DefaultLease hides a claimed message from other workers while it is
+	// handled.
+	DefaultLease = 1 * time.Minute
+)
+
+// Worker handles failed messages again once their backoff has passed, and
+// held messages once the message before them is handled, using the payload
+// stored in the inbox.
+type Worker struct {
+	db         *sql.DB
+	inbox      Inbox
+	logger     *log.Logger
+	batchSize  int
+	interval   time.Duration
+	stuckAfter time.Duration
+	lease      time.Duration
+	mu         sync.Mutex
+	handlers   map[string]Handler
+}
+
+func NewWorker(db *sql.DB, inbox Inbox, logger *log.Logger, batchSize int, interval time.Duration) *Worker {
+	return &Worker{
+		db:         db,
+		inbox:      inbox,
+		logger:     logger,
+		batchSize:  batchSize,
+		interval:   interval,
+		stuckAfter: DefaultStuckAfter,
+		lease:      DefaultLease,
+		handlers:   make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler for messages received from topic.
+func (w *Worker) Handle(topic string, handler Handler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.handlers[topic] = handler
+}
+
+// Start handles due messages until ctx is cancelled.
+func (w *Worker) Start(ctx context.Context) {
+	w.logger.Println("starting inbox worker")
+
+	for {
+		n, err := w.processInbox(ctx)
+		if err != nil && ctx.Err() == nil {
+			w.logger.Printf("failed to process inbox: %v", err)
+		}
+		if n == w.batchSize && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			w.logger.Println("stopping inbox worker")
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+func (w *Worker) processInbox(ctx context.Context) (int, error) {
+	t, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer t.Rollback()
+
+	messages, err := w.inbox.ClaimRetryable(tx.With(ctx, t), w.stuckAfter, w.lease, w.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range messages {
+		if ctx.Err() != nil {
+			// the rest is claimed again after the lease
+			return len(messages), nil
+		}
+
+		w.mu.Lock()
+		handler, ok := w.handlers[m.Topic]
+		w.mu.Unlock()
+		if !ok {
+			w.logger.Printf("no handler for topic %s, parking message %s", m.Topic, m.MessageID)
+			err = w.park(ctx, m)
+			if err != nil {
+				return len(messages), err
+			}
+			continue
+		}
+
+		w.logger.Printf("handling message %s again, %d attempts failed: %s", m.MessageID, m.Attempts, m.LastError)
+		err = handler(ctx, m)
+		if err != nil {
+			w.logger.Printf("message %s failed again: %v", m.MessageID, err)
+		}
+	}
+
+	return len(messages), nil
+}
+
+func (w *Worker) park(ctx context.Context, message Message) error {
+	t, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	err = park(tx.With(ctx, t), w.inbox, message)
+	if err != nil {
+		return err
+	}
+
+	return t.Commit()
+}
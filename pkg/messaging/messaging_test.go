@@ -0,0 +1,31 @@
+package messaging
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("BROKER_DRIVER", "")
+	t.Setenv("KAFKA_BROKERS", "")
+	t.Setenv("BROKER_DSN", "")
+	t.Setenv("BROKER_CONCURRENCY", "")
+
+	cfg := ConfigFromEnv()
+	if cfg.Driver != DriverKafka || cfg.Concurrency != 0 || cfg.Retention {
+		t.Errorf("defaults = %+v, want kafka without concurrency and retention", cfg)
+	}
+
+	t.Setenv("BROKER_DRIVER", DriverPostgres)
+	t.Setenv("KAFKA_BROKERS", "kafka-1:9092,kafka-2:9092")
+	t.Setenv("BROKER_DSN", "postgres://broker@db/broker")
+	t.Setenv("BROKER_CONCURRENCY", "4")
+
+	cfg = ConfigFromEnv()
+	if cfg.Driver != DriverPostgres || cfg.PostgresDSN != "postgres://broker@db/broker" || cfg.Concurrency != 4 {
+		t.Errorf("config = %+v, want postgres with concurrency 4", cfg)
+	}
+	if !slices.Equal(cfg.KafkaBrokers, []string{"kafka-1:9092", "kafka-2:9092"}) {
+		t.Errorf("KafkaBrokers = %v", cfg.KafkaBrokers)
+	}
+}
@@ -2,6 +2,7 @@ package outbox
 
 import (
 	"context"
+	"shop/pkg/broker"
 	"time"
 )
 
@@ -15,18 +16,42 @@ const (
 type MessageStatus string
 
 type Message struct {
-	ID        string        `json:"id"`
-	Topic     string        `json:"topic"`
-	Key       string        `json:"key"`
-	Payload   any           `json:"payload"`
-	Status    MessageStatus `json:"status"`
-	CreatedAt time.Time     `json:"created_at"`
+	ID        string         `json:"id"`
+	Topic     string         `json:"topic"`
+	Key       string         `json:"key"`
+	Payload   any            `json:"payload"`
+	Headers   broker.Headers `json:"headers"`
+	Status    MessageStatus  `json:"status"`
+	CreatedAt time.Time      `json:"created_at"`
+	// Attempts counts failed sends, LastError is the error of the last one.
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	// AggregateID is the entity the message is about, the saga id for the
+	// saga flow. It is the key as well: Publish fills in whichever is empty.
+	AggregateID string `json:"aggregate_id"`
+	// Sequence numbers the messages of the aggregate on the topic 1, 2, 3...
+	// in the order they are sent. It is given when the message is claimed
+	// and is 0 before that, for messages without an aggregate and for
+	// compacted topics.
+	Sequence int64 `json:"sequence"`
 }
 
 type Outbox interface {
 	Publish(ctx context.Context, message Message) error
-	GetNotSent(ctx context.Context, limit int) ([]Message, error)
-	BatchMarkAsPending(ctx context.Context, ids []string) error
+	// Claim marks up to limit messages that are due pending for the worker
+	// lockedBy and returns them in the order they must be sent, numbering
+	// the messages of each aggregate. They stay locked until they are sent or
+	// the lock goes stale.
+	Claim(ctx context.Context, limit int, lockedBy string) ([]Message, error)
 	BatchMarkAsSent(ctx context.Context, ids []string) error
 	BatchMarkAsError(ctx context.Context, ids []string) error
+	// MarkAsFailed records a failed send of a pending message. The message is
+	// sent again after retryAt, or goes to error when retryAt is nil.
+	MarkAsFailed(ctx context.Context, id string, cause string, retryAt *time.Time) error
+	// Requeue returns errored messages to init with a fresh attempt counter,
+	// all of them when ids is empty.
+	Requeue(ctx context.Context, ids []string) (int64, error)
+	// ReclaimStale returns messages locked longer than lease ago to init, so
+	// a batch of a crashed worker is sent again.
+	ReclaimStale(ctx context.Context, lease time.Duration) (int64, error)
 }
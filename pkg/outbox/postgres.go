@@ -2,12 +2,21 @@ package outbox
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"log"
+	"shop/pkg/broker"
+	"shop/pkg/topology"
+	"shop/pkg/tx"
+	"time"
 )
 
+// NotifyChannel is notified when a transaction that published to the outbox
+// commits.
+const NotifyChannel = "outbox"
+
+var ErrKeyNotAggregate = errors.New("message key differs from its aggregate id")
+
 type PostgresOutbox struct{}
 
 func NewPostgresOutbox() *PostgresOutbox {
@@ -15,17 +24,41 @@ func NewPostgresOutbox() *PostgresOutbox {
 }
 
 func (o *PostgresOutbox) Publish(ctx context.Context, message Message) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
+	}
+	if message.AggregateID == "" {
+		message.AggregateID = message.Key
+	}
+	if message.Key == "" {
+		message.Key = message.AggregateID
+	}
+	// the key orders the messages, see Claim
+	if message.Key != message.AggregateID {
+		return ErrKeyNotAggregate
 	}
 	jsonPayload, err := json.Marshal(message.Payload)
 	if err != nil {
 		return err
 	}
+	headers := message.Headers
+	if headers == nil {
+		headers = broker.Headers{}
+	}
+	jsonHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
 
-	query := "INSERT INTO outbox (id, topic, key, payload, status, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
-	_, err = tx.ExecContext(ctx, query, message.ID, message.Topic, message.Key, jsonPayload, message.Status, message.CreatedAt)
+	query := "INSERT INTO outbox (id, topic, key, aggregate_id, payload, headers, status, created_at) VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7, $8)"
+	_, err = conn.ExecContext(ctx, query, message.ID, message.Topic, message.Key, message.AggregateID, jsonPayload, jsonHeaders, message.Status, message.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// delivered on commit, several notifications of one transaction are folded into one
+	_, err = conn.ExecContext(ctx, "SELECT pg_notify($1, '')", NotifyChannel)
 	if err != nil {
 		return err
 	}
@@ -33,48 +66,134 @@ func (o *PostgresOutbox) Publish(ctx context.Context, message Message) error {
 	return nil
 }
 
-func (o *PostgresOutbox) GetNotSent(ctx context.Context, limit int) ([]Message, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return nil, errors.New("transaction not found in context")
+// Claim locks up to limit sendable messages for the worker lockedBy and marks
+// them pending. Workers claim concurrently: rows locked by another claim are
+// skipped, and a key is claimed by one worker at a time. A message is only
+// claimed when no earlier message with its key is pending or waiting for a
+// retry, so messages of a key reach the broker in order. Must run in a
+// READ COMMITTED transaction, the checks after the key lock need to see
+// claims committed meanwhile. Messages get their sequence number here rather
+// than in Publish, so the numbers follow the order in which they are sent
+// and not the order in which the publishing transactions committed.
+func (o *PostgresOutbox) Claim(ctx context.Context, limit int, lockedBy string) ([]Message, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return nil, err
 	}
+	now := time.Now()
 
-	var messages []Message
-	query := "SELECT id, topic, key, payload, status, created_at FROM outbox WHERE status = $1 ORDER BY created_at ASC LIMIT $2"
-	rows, err := tx.QueryContext(ctx, query, StatusInit, limit)
+	query := `SELECT key FROM outbox WHERE status = $1 AND (next_attempt_at IS NULL OR next_attempt_at <= $2)
+		GROUP BY key ORDER BY min(created_at) LIMIT $3`
+	rows, err := conn.QueryContext(ctx, query, StatusInit, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, key)
+	}
+	err = rows.Close()
 	if err != nil {
 		return nil, err
 	}
 
+	// the lock is held until commit, when the claimed rows are pending
+	var keys []string
+	for _, key := range candidates {
+		var locked bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock(hashtext('outbox'), hashtext($1))", key).Scan(&locked)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	query = `SELECT id, topic, key, COALESCE(aggregate_id, ''), COALESCE(sequence, 0), payload, headers, status, created_at, attempts, COALESCE(last_error, '') FROM outbox o
+		WHERE key = ANY($1) AND status = $2
+		AND NOT EXISTS (SELECT 1 FROM outbox p WHERE p.key = o.key AND p.status = $3)
+		AND NOT EXISTS (SELECT 1 FROM outbox b WHERE b.key = o.key AND b.status = $2 AND b.next_attempt_at > $4
+			AND (b.created_at, b.id) <= (o.created_at, o.id))
+		ORDER BY created_at, id LIMIT $5
+		FOR UPDATE SKIP LOCKED`
+	rows, err = conn.QueryContext(ctx, query, keys, StatusInit, StatusPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	var ids []string
 	for rows.Next() {
 		var message Message
-		var jsonPayload []byte
-		err = rows.Scan(&message.ID, &message.Topic, &message.Key, &jsonPayload, &message.Status, &message.CreatedAt)
+		var jsonPayload, jsonHeaders []byte
+		err = rows.Scan(&message.ID, &message.Topic, &message.Key, &message.AggregateID, &message.Sequence, &jsonPayload, &jsonHeaders, &message.Status, &message.CreatedAt, &message.Attempts, &message.LastError)
 		if err != nil {
 			log.Println("failed to scan row", "error", err)
+			rows.Close()
 			return nil, err
 		}
 		err = json.Unmarshal(jsonPayload, &message.Payload)
 		if err != nil {
 			log.Println("failed to unmarshal payload", "error", err)
+			rows.Close()
 			return nil, err
 		}
+		err = json.Unmarshal(jsonHeaders, &message.Headers)
+		if err != nil {
+			log.Println("failed to unmarshal headers", "error", err)
+			rows.Close()
+			return nil, err
+		}
+		message.Status = StatusPending
 		messages = append(messages, message)
-
+		ids = append(ids, message.ID)
 	}
-	//if len(messages) == 0 {
-	//	return nil, errors.New("no messages found")
-	//}
 	err = rows.Close()
 	if err != nil {
 		return nil, err
 	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
 
-	return messages, nil
-}
+	// a message sent before keeps its number, the key lock orders the rest.
+	// Compaction leaves gaps in the numbers of a compacted topic that nobody
+	// could fill, its consumers keep the latest state by other means.
+	for i, message := range messages {
+		if message.AggregateID == "" || message.Sequence > 0 || topology.Compacted(message.Topic) {
+			continue
+		}
+		query = `INSERT INTO outbox_sequences (topic, aggregate_id, sequence, updated_at) VALUES ($1, $2, 1, $3)
+			ON CONFLICT (topic, aggregate_id) DO UPDATE SET sequence = outbox_sequences.sequence + 1, updated_at = EXCLUDED.updated_at
+			RETURNING sequence`
+		err = conn.QueryRowContext(ctx, query, message.Topic, message.AggregateID, now).Scan(&messages[i].Sequence)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.ExecContext(ctx, "UPDATE outbox SET sequence = $1 WHERE id = $2", messages[i].Sequence, message.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func (o *PostgresOutbox) BatchMarkAsPending(ctx context.Context, ids []string) error {
-	return o.batchUpdateStatus(ctx, ids, StatusInit, StatusPending)
+	query = "UPDATE outbox SET status = $1, locked_at = $2, locked_by = $3 WHERE id = ANY($4)"
+	_, err = conn.ExecContext(ctx, query, StatusPending, now, lockedBy, ids)
+	if err != nil {
+		log.Println("failed to update status value", "error", err)
+		return nil, err
+	}
+
+	return messages, nil
 }
 
 func (o *PostgresOutbox) BatchMarkAsSent(ctx context.Context, ids []string) error {
@@ -85,13 +204,67 @@ func (o *PostgresOutbox) BatchMarkAsError(ctx context.Context, ids []string) err
 	return o.batchUpdateStatus(ctx, ids, StatusPending, StatusError)
 }
 
+func (o *PostgresOutbox) MarkAsFailed(ctx context.Context, id string, cause string, retryAt *time.Time) error {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
+	}
+	status := StatusInit
+	if retryAt == nil {
+		status = StatusError
+	}
+	query := `UPDATE outbox SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3, locked_at = NULL, locked_by = NULL
+		WHERE id = $4 AND status = $5`
+	r, err := conn.ExecContext(ctx, query, status, cause, retryAt, id, StatusPending)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("failed to update status: no rows affected")
+	}
+	return nil
+}
+
+func (o *PostgresOutbox) Requeue(ctx context.Context, ids []string) (int64, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return 0, err
+	}
+	query := "UPDATE outbox SET status = $1, attempts = 0, next_attempt_at = NULL WHERE status = $2 AND (cardinality($3::text[]) = 0 OR id = ANY($3))"
+	if ids == nil {
+		ids = []string{}
+	}
+	r, err := conn.ExecContext(ctx, query, StatusInit, StatusError, ids)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+func (o *PostgresOutbox) ReclaimStale(ctx context.Context, lease time.Duration) (int64, error) {
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return 0, err
+	}
+	query := "UPDATE outbox SET status = $1, locked_at = NULL, locked_by = NULL WHERE status = $2 AND locked_at < $3"
+	r, err := conn.ExecContext(ctx, query, StatusInit, StatusPending, time.Now().Add(-lease))
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
 func (o *PostgresOutbox) batchUpdateStatus(ctx context.Context, ids []string, from MessageStatus, to MessageStatus) error {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return errors.New("transaction not found in context")
+	conn, err := tx.From(ctx)
+	if err != nil {
+		return err
 	}
 	query := "UPDATE outbox SET status = $1 WHERE id = ANY($2) AND status = $3"
-	r, err := tx.ExecContext(ctx, query, to, ids, from)
+	r, err := conn.ExecContext(ctx, query, to, ids, from)
 	if err != nil {
 		log.Println("failed to update status value", "error", err)
 		return err
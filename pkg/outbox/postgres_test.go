@@ -0,0 +1,292 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"shop/pkg/broker"
+	"shop/pkg/topology"
+	"shop/pkg/tx"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// arrayConverter passes slices through to the expectations, as pgx takes
+// them for ANY($n).
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	if v != nil && reflect.TypeOf(v).Kind() == reflect.Slice && reflect.TypeOf(v).Elem().Kind() != reflect.Uint8 {
+		return v, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+// timeNear matches a time argument within a second of want.
+type timeNear struct {
+	want time.Time
+}
+
+func near(want time.Time) timeNear {
+	return timeNear{want: want}
+}
+
+func (n timeNear) Match(v driver.Value) bool {
+	got, ok := v.(time.Time)
+	if !ok {
+		return false
+	}
+	d := got.Sub(n.want)
+	return d > -time.Second && d < time.Second
+}
+
+// withMockTx returns a context with an open transaction on a mock database.
+// The transaction is rolled back when the test ends.
+func withMockTx(t *testing.T) (context.Context, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mock.ExpectBegin()
+	sqlTx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	t.Cleanup(func() { sqlTx.Rollback() })
+
+	return tx.With(context.Background(), sqlTx), mock
+}
+
+func TestOutboxNeedsTransaction(t *testing.T) {
+	o := NewPostgresOutbox()
+
+	_, err := o.Claim(context.Background(), 10, "worker-1")
+	if !errors.Is(err, tx.ErrNoTransaction) {
+		t.Errorf("Claim without transaction = %v, want ErrNoTransaction", err)
+	}
+	err = o.Publish(context.Background(), Message{ID: "m-1", Topic: "orders", Key: "k"})
+	if !errors.Is(err, tx.ErrNoTransaction) {
+		t.Errorf("Publish without transaction = %v, want ErrNoTransaction", err)
+	}
+}
+
+func TestReclaimStale(t *testing.T) {
+	ctx, mock := withMockTx(t)
+	o := NewPostgresOutbox()
+
+	mock.ExpectExec(`UPDATE outbox SET status = \$1, locked_at = NULL, locked_by = NULL WHERE status = \$2 AND locked_at < \$3`).
+		WithArgs(StatusInit, StatusPending, near(time.Now().Add(-time.Minute))).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := o.ReclaimStale(ctx, time.Minute)
+	if n != 3 || err != nil {
+		t.Fatalf("ReclaimStale = %d, %v, want 3, nil", n, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMarkAsFailed(t *testing.T) {
+	retryAt := time.Now().Add(time.Minute)
+	tests := []struct {
+		name       string
+		retryAt    *time.Time
+		wantStatus MessageStatus
+		updated    int64
+		wantErr    bool
+	}{
+		{name: "retried later", retryAt: &retryAt, wantStatus: StatusInit, updated: 1},
+		{name: "last attempt goes to error", retryAt: nil, wantStatus: StatusError, updated: 1},
+		{name: "message no longer pending", retryAt: &retryAt, wantStatus: StatusInit, updated: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mock := withMockTx(t)
+			o := NewPostgresOutbox()
+
+			mock.ExpectExec(`UPDATE outbox SET status = \$1, attempts = attempts \+ 1, last_error = \$2, next_attempt_at = \$3, locked_at = NULL, locked_by = NULL`).
+				WithArgs(tt.wantStatus, "broker down", tt.retryAt, "m-1", StatusPending).
+				WillReturnResult(sqlmock.NewResult(0, tt.updated))
+
+			err := o.MarkAsFailed(ctx, "m-1", "broker down", tt.retryAt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MarkAsFailed = %v, want error %v", err, tt.wantErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     []string
+		wantIDs []string
+	}{
+		{name: "all errored messages", ids: nil, wantIDs: []string{}},
+		{name: "chosen messages", ids: []string{"m-1", "m-2"}, wantIDs: []string{"m-1", "m-2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, mock := withMockTx(t)
+			o := NewPostgresOutbox()
+
+			mock.ExpectExec(`UPDATE outbox SET status = \$1, attempts = 0, next_attempt_at = NULL WHERE status = \$2`).
+				WithArgs(StatusInit, StatusError, tt.wantIDs).
+				WillReturnResult(sqlmock.NewResult(0, 2))
+
+			n, err := o.Requeue(ctx, tt.ids)
+			if n != 2 || err != nil {
+				t.Errorf("Requeue = %d, %v, want 2, nil", n, err)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+var claimColumns = []string{"id", "topic", "key", "aggregate_id", "sequence", "payload", "headers", "status", "created_at", "attempts", "last_error"}
+
+// expectKeys expects the due keys to be read and each to be tried for its
+// advisory lock, locked saying which of them this claim gets.
+func expectKeys(mock sqlmock.Sqlmock, locked map[string]bool, keys ...string) {
+	rows := sqlmock.NewRows([]string{"key"})
+	for _, key := range keys {
+		rows.AddRow(key)
+	}
+	mock.ExpectQuery(`SELECT key FROM outbox WHERE status = \$1 .* GROUP BY key ORDER BY min\(created_at\) LIMIT \$3`).
+		WithArgs(StatusInit, sqlmock.AnyArg(), 10).
+		WillReturnRows(rows)
+	for _, key := range keys {
+		mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(hashtext\('outbox'\), hashtext\(\$1\)\)`).
+			WithArgs(key).
+			WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(locked[key]))
+	}
+}
+
+func TestClaimSkipsKeysLockedByOtherWorkers(t *testing.T) {
+	ctx, mock := withMockTx(t)
+	o := NewPostgresOutbox()
+
+	expectKeys(mock, map[string]bool{"a": true, "b": false, "c": true}, "a", "b", "c")
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT id, topic, key, .* FROM outbox o\s+WHERE key = ANY\(\$1\) AND status = \$2\s+AND NOT EXISTS .* ORDER BY created_at, id LIMIT \$5\s+FOR UPDATE SKIP LOCKED`).
+		WithArgs([]string{"a", "c"}, StatusInit, StatusPending, sqlmock.AnyArg(), 10).
+		WillReturnRows(sqlmock.NewRows(claimColumns).
+			AddRow("m-1", "orders", "a", "a", 2, []byte(`{}`), []byte(`{}`), StatusInit, created, 0, "").
+			AddRow("m-3", "orders", "c", "", 0, []byte(`{}`), []byte(`{}`), StatusInit, created.Add(time.Second), 0, "").
+			AddRow("m-2", "orders", "a", "a", 3, []byte(`{}`), []byte(`{}`), StatusInit, created.Add(2*time.Second), 1, "broker down"))
+	mock.ExpectExec(`UPDATE outbox SET status = \$1, locked_at = \$2, locked_by = \$3 WHERE id = ANY\(\$4\)`).
+		WithArgs(StatusPending, sqlmock.AnyArg(), "worker-1", []string{"m-1", "m-3", "m-2"}).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	messages, err := o.Claim(ctx, 10, "worker-1")
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	var ids []string
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+		if m.Status != StatusPending {
+			t.Errorf("message %s is %s, want pending", m.ID, m.Status)
+		}
+	}
+	if want := []string{"m-1", "m-3", "m-2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("claimed %v, want %v in send order", ids, want)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClaimWithoutLockedKeys(t *testing.T) {
+	ctx, mock := withMockTx(t)
+	o := NewPostgresOutbox()
+
+	expectKeys(mock, map[string]bool{"a": false}, "a")
+
+	messages, err := o.Claim(ctx, 10, "worker-1")
+	if messages != nil || err != nil {
+		t.Fatalf("Claim = %v, %v, want nothing", messages, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPublishNotifiesWorkers(t *testing.T) {
+	ctx, mock := withMockTx(t)
+	o := NewPostgresOutbox()
+
+	created := time.Now()
+	mock.ExpectExec(`INSERT INTO outbox \(id, topic, key, aggregate_id, payload, headers, status, created_at\)`).
+		WithArgs("m-1", "orders", "saga-1", "saga-1", []byte(`{"a":1}`), []byte(`{}`), StatusInit, created).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`SELECT pg_notify\(\$1, ''\)`).
+		WithArgs(NotifyChannel).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := o.Publish(ctx, Message{ID: "m-1", Topic: "orders", Key: "saga-1", Payload: map[string]int{"a": 1}, Status: StatusInit, CreatedAt: created})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClaimNumbersMessagesOfStreamTopicsOnly(t *testing.T) {
+	ctx, mock := withMockTx(t)
+	o := NewPostgresOutbox()
+
+	expectKeys(mock, map[string]bool{"saga-1": true}, "saga-1")
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT id, topic, key, .* FROM outbox o`).
+		WillReturnRows(sqlmock.NewRows(claimColumns).
+			AddRow("m-1", topology.OrderCommands, "saga-1", "saga-1", 0, []byte(`{}`), []byte(`{}`), StatusInit, created, 0, "").
+			AddRow("m-2", topology.SagaEvents, "saga-1", "saga-1", 0, []byte(`{}`), []byte(`{}`), StatusInit, created.Add(time.Second), 0, ""))
+	mock.ExpectQuery(`INSERT INTO outbox_sequences .* RETURNING sequence`).
+		WithArgs(topology.OrderCommands, "saga-1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"sequence"}).AddRow(4))
+	mock.ExpectExec(`UPDATE outbox SET sequence = \$1 WHERE id = \$2`).
+		WithArgs(int64(4), "m-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE outbox SET status = \$1`).
+		WithArgs(StatusPending, sqlmock.AnyArg(), "worker-1", []string{"m-1", "m-2"}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	messages, err := o.Claim(ctx, 10, "worker-1")
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// compaction may drop any saga status but the latest, a consumer
+	// waiting for a dropped number would wait forever
+	want := map[string]string{topology.OrderCommands: "4", topology.SagaEvents: ""}
+	for _, m := range messages {
+		message, err := BrokerMessage(m)
+		if err != nil {
+			t.Fatalf("broker message: %v", err)
+		}
+		if got := message.Headers.Get(broker.HeaderSequence); got != want[m.Topic] {
+			t.Errorf("%s sequence header = %q, want %q", m.Topic, got, want[m.Topic])
+		}
+	}
+}
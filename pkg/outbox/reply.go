@@ -0,0 +1,28 @@
+package outbox
+
+import (
+	"context"
+	"shop/pkg/broker"
+	"shop/pkg/command"
+	"shop/pkg/event"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reply returns the outbox message that answers cmd with e: keyed and
+// correlated by the saga, caused by cmd and in the trace of the message being
+// handled.
+func Reply(ctx context.Context, topic string, cmd command.Command, e event.Event) Message {
+	e.SagaID = cmd.SagaID
+
+	return Message{
+		ID:        uuid.New().String(),
+		Topic:     topic,
+		Key:       cmd.SagaID,
+		Payload:   e,
+		Headers:   broker.NewHeaders(string(e.Type), e.ID, cmd.SagaID, cmd.ID).WithTrace(broker.HeadersFromContext(ctx)),
+		Status:    StatusInit,
+		CreatedAt: time.Now(),
+	}
+}
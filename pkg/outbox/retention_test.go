@@ -0,0 +1,75 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRetentionPurge(t *testing.T) {
+	tests := []struct {
+		name      string
+		archive   bool
+		query     string
+		batches   []int64
+		wantTotal int64
+	}{
+		{name: "delete", query: `DELETE FROM outbox WHERE id IN \(SELECT id FROM outbox WHERE status = \$1 AND created_at < \$2 ORDER BY created_at LIMIT \$3 FOR UPDATE SKIP LOCKED\)`, batches: []int64{2, 2, 1}, wantTotal: 5},
+		{name: "archive", archive: true, query: `WITH moved AS \(DELETE FROM outbox WHERE id IN \(SELECT id FROM outbox .*\) RETURNING .*\) INSERT INTO outbox_archive .* SELECT \* FROM moved`, batches: []int64{2, 0}, wantTotal: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+
+			maxAge := 24 * time.Hour
+			r := NewRetention(db, RetentionConfig{MaxAge: maxAge, BatchSize: 2, Archive: tt.archive}, log.New(io.Discard, "", 0))
+			for _, n := range tt.batches {
+				mock.ExpectExec(tt.query).
+					WithArgs(StatusSent, near(time.Now().Add(-maxAge)), 2).
+					WillReturnResult(sqlmock.NewResult(0, n))
+			}
+			mock.ExpectExec(`DELETE FROM outbox_sequences`).
+				WithArgs(near(time.Now().Add(-maxAge)), StatusSent, 2).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			total, err := r.Purge(context.Background())
+			if total != tt.wantTotal || err != nil {
+				t.Errorf("Purge = %d, %v, want %d, nil", total, err, tt.wantTotal)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRetentionStopsAtError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	failure := errors.New("connection lost")
+	r := NewRetention(db, RetentionConfig{MaxAge: time.Hour, BatchSize: 2}, log.New(io.Discard, "", 0))
+	mock.ExpectExec(`DELETE FROM outbox WHERE id IN`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM outbox WHERE id IN`).WillReturnError(failure)
+
+	total, err := r.Purge(context.Background())
+	if total != 2 || !errors.Is(err, failure) {
+		t.Errorf("Purge = %d, %v, want 2 and %v", total, err, failure)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -4,21 +4,48 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"os"
 	"shop/pkg/broker"
+	"shop/pkg/pgnotify"
+	"shop/pkg/tx"
+	"strconv"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+// DefaultLease is how long a batch may stay pending before another worker
+// takes it over.
+const DefaultLease = 1 * time.Minute
+
+// DefaultRetryPolicy spaces out sends of a batch the broker rejected. After
+// the last attempt its messages go to error and wait for Requeue.
+var DefaultRetryPolicy = broker.RetryPolicy{
+	MaxAttempts:    10,
+	InitialBackoff: 1 * time.Second,
+	MaxBackoff:     5 * time.Minute,
+	Multiplier:     2,
+}
+
 type Worker struct {
-	db        *sql.DB
-	broker    broker.Broker
-	outbox    Outbox
-	logger    *log.Logger
-	batchSize int
-	interval  time.Duration
+	db          *sql.DB
+	broker      broker.Broker
+	outbox      Outbox
+	logger      *log.Logger
+	batchSize   int
+	interval    time.Duration
+	id          string
+	lease       time.Duration
+	lastReclaim time.Time
+	policy      broker.RetryPolicy
+	wakeup      chan struct{}
 }
 
 func NewWorker(db *sql.DB, broker broker.Broker, outbox Outbox, logger *log.Logger, batchSize int, interval time.Duration) *Worker {
+	hostname, _ := os.Hostname()
+
 	return &Worker{
 		db:        db,
 		broker:    broker,
@@ -26,40 +53,140 @@ func NewWorker(db *sql.DB, broker broker.Broker, outbox Outbox, logger *log.Logg
 		logger:    logger,
 		batchSize: batchSize,
 		interval:  interval,
+		id:        fmt.Sprintf("%s-%s", hostname, uuid.New().String()),
+		lease:     DefaultLease,
+		policy:    DefaultRetryPolicy,
+		wakeup:    make(chan struct{}, 1),
 	}
 }
 
+func (w *Worker) SetRetryPolicy(policy broker.RetryPolicy) {
+	w.policy = policy
+}
+
+// SetLease changes how long a pending batch is left to its worker. It must
+// be well above the time PublishBatch takes, or batches are sent twice.
+func (w *Worker) SetLease(lease time.Duration) {
+	w.lease = lease
+}
+
+// Start processes the outbox until ctx is cancelled. A batch that has
+// already been picked up is always finished, so no message is left pending.
+// An empty outbox is checked again when a publishing transaction commits,
+// or after the interval, which also picks up retries and lost notifications.
 func (w *Worker) Start(ctx context.Context) error {
 	w.logger.Println("starting outbox worker")
 
+	go pgnotify.Listen(ctx, w.db, NotifyChannel, w.wakeup, w.interval, w.logger)
+
 	for {
-		//time.Sleep(w.interval)
-		empty, err := w.processOutbox(ctx)
-		if empty {
-			w.logger.Printf("outbox is empty, sleep %f seconds", w.interval.Seconds())
-			time.Sleep(w.interval)
+		select {
+		case <-ctx.Done():
+			w.logger.Println("stopping outbox worker")
+			return nil
+		default:
 		}
+
+		if time.Since(w.lastReclaim) >= w.lease {
+			err := w.reclaim(ctx)
+			if err != nil {
+				w.logger.Printf("failed to reclaim stale messages: %v", err)
+			}
+		}
+
+		empty, err := w.processOutbox(context.WithoutCancel(ctx))
 		if err != nil {
 			w.logger.Println("failed to process outbox", "error: ", err)
 		}
+		if empty {
+			select {
+			case <-ctx.Done():
+				w.logger.Println("stopping outbox worker")
+				return nil
+			case <-w.wakeup:
+			case <-time.After(w.interval):
+			}
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				w.logger.Println("stopping outbox worker")
+				return nil
+			case <-time.After(w.interval):
+			}
+		}
+	}
+}
+
+// reclaim returns batches left pending by a worker that died between marking
+// and sending them.
+func (w *Worker) reclaim(ctx context.Context) error {
+	t, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	n, err := w.outbox.ReclaimStale(tx.With(ctx, t), w.lease)
+	if err != nil {
+		return err
+	}
+
+	err = t.Commit()
+	if err != nil {
+		return err
+	}
+
+	w.lastReclaim = time.Now()
+	if n > 0 {
+		w.logger.Printf("reclaimed %d stale pending messages", n)
+	}
+
+	return nil
+}
+
+// markAsFailed schedules the next attempt of each message of a batch the
+// broker rejected, or moves it to error after the last attempt.
+func (w *Worker) markAsFailed(ctx context.Context, messages []Message, cause error) error {
+	maxAttempts := max(w.policy.MaxAttempts, 1)
+
+	for _, m := range messages {
+		attempts := m.Attempts + 1
+
+		var retryAt *time.Time
+		if attempts < maxAttempts {
+			t := time.Now().Add(w.policy.Backoff(attempts))
+			retryAt = &t
+		} else {
+			w.logger.Printf("message %s failed %d times, moving to error: %v", m.ID, attempts, cause)
+		}
+
+		err := w.outbox.MarkAsFailed(ctx, m.ID, cause.Error(), retryAt)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
 func (w *Worker) processOutbox(ctx context.Context) (bool, error) {
 	//w.logger.Println("processing outbox")
-	tx, err := w.db.BeginTx(context.Background(), &sql.TxOptions{
-		Isolation: sql.LevelRepeatableRead,
+	// read committed: other workers claim at the same time, see Outbox.Claim
+	t, err := w.db.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
 	})
 	if err != nil {
-		w.logger.Fatal("failed to begin transaction", "error", err)
+		w.logger.Printf("failed to begin transaction: %v", err)
+		return false, err
 	}
-	defer tx.Rollback()
+	defer t.Rollback()
 
-	ctxWithTx := context.WithValue(ctx, "tx", tx)
+	ctxWithTx := tx.With(ctx, t)
 
-	messages, err := w.outbox.GetNotSent(ctxWithTx, w.batchSize)
+	messages, err := w.outbox.Claim(ctxWithTx, w.batchSize, w.id)
 	if err != nil {
-		w.logger.Printf("failed to get messages from outbox: %v", err)
+		w.logger.Printf("failed to claim messages from outbox: %v", err)
 		return false, err
 	}
 
@@ -67,20 +194,14 @@ func (w *Worker) processOutbox(ctx context.Context) (bool, error) {
 		return true, nil
 	}
 
-	w.logger.Printf("found %d messages", len(messages))
+	w.logger.Printf("claimed %d messages", len(messages))
 
 	var messageIds []string
 	for _, m := range messages {
 		messageIds = append(messageIds, m.ID)
 	}
 
-	err = w.outbox.BatchMarkAsPending(ctxWithTx, messageIds)
-	if err != nil {
-		w.logger.Printf("failed to mark messages as pending: %v", err)
-		return false, err
-	}
-
-	err = tx.Commit()
+	err = t.Commit()
 	if err != nil {
 		w.logger.Println("failed to commit transaction", "error", err)
 		return false, err
@@ -88,32 +209,38 @@ func (w *Worker) processOutbox(ctx context.Context) (bool, error) {
 
 	var brokerMessages []broker.Message
 	for _, m := range messages {
-		jsonPayload, err := json.Marshal(m.Payload)
+		brokerMessage, err := BrokerMessage(m)
 		if err != nil {
 			return false, err
 		}
-		brokerMessages = append(brokerMessages, broker.Message{
-			Topic: m.Topic,
-			Key:   m.Key,
-			Value: jsonPayload,
-		})
+		brokerMessages = append(brokerMessages, brokerMessage)
 	}
 
-	tx, err = w.db.BeginTx(context.Background(), &sql.TxOptions{
+	t, err = w.db.BeginTx(ctx, &sql.TxOptions{
 		Isolation: sql.LevelRepeatableRead,
 	})
 	if err != nil {
-		w.logger.Fatal("failed to begin transaction", "error", err)
+		w.logger.Printf("failed to begin transaction: %v", err)
+		return false, err
 	}
-	defer tx.Rollback()
+	defer t.Rollback()
 
-	ctxWithTx = context.WithValue(ctx, "tx", tx)
+	ctxWithTx = tx.With(ctx, t)
 
 	w.logger.Printf("sending messages")
 
 	// send to broker
 	err = w.broker.PublishBatch(brokerMessages)
 	if err != nil {
+		failErr := w.markAsFailed(ctxWithTx, messages, err)
+		if failErr != nil {
+			w.logger.Printf("failed to record failed send: %v", failErr)
+			return false, err
+		}
+		commitErr := t.Commit()
+		if commitErr != nil {
+			w.logger.Printf("failed to commit transaction: %v", commitErr)
+		}
 		return false, err
 	}
 	w.logger.Printf("messages sent")
@@ -126,9 +253,9 @@ func (w *Worker) processOutbox(ctx context.Context) (bool, error) {
 	}
 	w.logger.Printf("messages marked as sent")
 
-	err = tx.Commit()
+	err = t.Commit()
 	if err != nil {
-		w.logger.Printf("failed to commit transaction", "error", err)
+		w.logger.Printf("failed to commit transaction: %v", err)
 		return false, err
 	}
 
@@ -136,3 +263,29 @@ func (w *Worker) processOutbox(ctx context.Context) (bool, error) {
 
 	return false, nil
 }
+
+// BrokerMessage returns the record the worker sends for m.
+func BrokerMessage(m Message) (broker.Message, error) {
+	jsonPayload, err := json.Marshal(m.Payload)
+	if err != nil {
+		return broker.Message{}, err
+	}
+	headers := m.Headers.Clone()
+	if headers == nil {
+		headers = broker.Headers{}
+	}
+	if headers.Get(broker.HeaderProducedAt) == "" {
+		headers[broker.HeaderProducedAt] = m.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if m.Sequence > 0 {
+		headers[broker.HeaderAggregateID] = m.AggregateID
+		headers[broker.HeaderSequence] = strconv.FormatInt(m.Sequence, 10)
+	}
+
+	return broker.Message{
+		Topic:   m.Topic,
+		Key:     m.Key,
+		Value:   jsonPayload,
+		Headers: headers,
+	}, nil
+}
@@ -0,0 +1,61 @@
+// Package pgnotify turns Postgres notifications into wakeups.
+package pgnotify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Listen sends to wakeup for every notification on channel until ctx is
+// cancelled. Sends never block, a pending wakeup covers later ones. When the
+// connection breaks it listens again after retry; callers poll meanwhile.
+func Listen(ctx context.Context, db *sql.DB, channel string, wakeup chan<- struct{}, retry time.Duration, logger *log.Logger) {
+	for ctx.Err() == nil {
+		err := listen(ctx, db, channel, wakeup)
+		if err != nil && ctx.Err() == nil {
+			logger.Printf("Listen on %s failed, polling until reconnect: %v", channel, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry):
+			}
+		}
+	}
+}
+
+func listen(ctx context.Context, db *sql.DB, channel string, wakeup chan<- struct{}) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("LISTEN needs the pgx stdlib driver")
+		}
+
+		_, err := c.Conn().Exec(ctx, "LISTEN "+channel)
+		if err != nil {
+			return err
+		}
+		// the connection goes back to the pool
+		defer c.Conn().Exec(context.WithoutCancel(ctx), "UNLISTEN "+channel)
+
+		for {
+			_, err = c.Conn().WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+			select {
+			case wakeup <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
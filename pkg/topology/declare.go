@@ -0,0 +1,106 @@
+package topology
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+var ErrDrift = errors.New("topology drift")
+
+// Declare creates the missing topics and verifies the existing ones. All
+// differences are reported in one ErrDrift error.
+func Declare(admin sarama.ClusterAdmin, topics []Topic, logger *log.Logger) error {
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return fmt.Errorf("list topics: %w", err)
+	}
+
+	var drift []string
+	for _, t := range topics {
+		detail, ok := existing[t.Name]
+		if !ok {
+			err = create(admin, t)
+			if err == nil {
+				logger.Printf("Created topic %s", t.Name)
+				continue
+			}
+			if !errors.Is(err, sarama.ErrTopicAlreadyExists) {
+				return fmt.Errorf("create topic %s: %w", t.Name, err)
+			}
+			// another service created it in the meantime
+			topicsNow, err := admin.ListTopics()
+			if err != nil {
+				return fmt.Errorf("list topics: %w", err)
+			}
+			detail = topicsNow[t.Name]
+		}
+
+		diffs, err := verify(admin, t, detail)
+		if err != nil {
+			return err
+		}
+		drift = append(drift, diffs...)
+	}
+
+	if len(drift) > 0 {
+		return fmt.Errorf("%w:\n  %s", ErrDrift, strings.Join(drift, "\n  "))
+	}
+
+	logger.Printf("Topology verified: %d topics", len(topics))
+	return nil
+}
+
+// DeclareBrokers connects an admin client to brokers and declares the shop topology.
+func DeclareBrokers(brokers []string, config *sarama.Config, logger *log.Logger) error {
+	admin, err := sarama.NewClusterAdmin(brokers, config)
+	if err != nil {
+		return fmt.Errorf("create cluster admin: %w", err)
+	}
+	defer admin.Close()
+
+	return Declare(admin, Topics, logger)
+}
+
+func create(admin sarama.ClusterAdmin, t Topic) error {
+	entries := make(map[string]*string)
+	for k, v := range t.Config() {
+		v := v
+		entries[k] = &v
+	}
+
+	return admin.CreateTopic(t.Name, &sarama.TopicDetail{
+		NumPartitions:     t.Partitions,
+		ReplicationFactor: t.ReplicationFactor,
+		ConfigEntries:     entries,
+	}, false)
+}
+
+func verify(admin sarama.ClusterAdmin, t Topic, detail sarama.TopicDetail) ([]string, error) {
+	var drift []string
+	if detail.NumPartitions != t.Partitions {
+		drift = append(drift, fmt.Sprintf("%s: partitions %d, want %d", t.Name, detail.NumPartitions, t.Partitions))
+	}
+	if detail.ReplicationFactor != t.ReplicationFactor {
+		drift = append(drift, fmt.Sprintf("%s: replication factor %d, want %d", t.Name, detail.ReplicationFactor, t.ReplicationFactor))
+	}
+
+	entries, err := admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: t.Name})
+	if err != nil {
+		return nil, fmt.Errorf("describe topic %s: %w", t.Name, err)
+	}
+	actual := make(map[string]string, len(entries))
+	for _, e := range entries {
+		actual[e.Name] = e.Value
+	}
+	for k, want := range t.Config() {
+		if got := actual[k]; got != want {
+			drift = append(drift, fmt.Sprintf("%s: %s %q, want %q", t.Name, k, got, want))
+		}
+	}
+
+	return drift, nil
+}
@@ -0,0 +1,85 @@
+package topology
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+// fakeAdmin keeps topics and their configuration in memory.
+type fakeAdmin struct {
+	sarama.ClusterAdmin
+	topics  map[string]sarama.TopicDetail
+	created []string
+}
+
+func (a *fakeAdmin) ListTopics() (map[string]sarama.TopicDetail, error) {
+	return a.topics, nil
+}
+
+func (a *fakeAdmin) CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error {
+	a.topics[topic] = *detail
+	a.created = append(a.created, topic)
+	return nil
+}
+
+func (a *fakeAdmin) DescribeConfig(resource sarama.ConfigResource) ([]sarama.ConfigEntry, error) {
+	var entries []sarama.ConfigEntry
+	for k, v := range a.topics[resource.Name].ConfigEntries {
+		entries = append(entries, sarama.ConfigEntry{Name: k, Value: *v})
+	}
+	return entries, nil
+}
+
+var discard = log.New(io.Discard, "", 0)
+
+func TestDeclareCreatesMissingTopics(t *testing.T) {
+	admin := &fakeAdmin{topics: make(map[string]sarama.TopicDetail)}
+
+	err := Declare(admin, Topics, discard)
+	if err != nil {
+		t.Fatalf("Declare: %v", err)
+	}
+	if len(admin.created) != len(Topics) {
+		t.Errorf("created %d topics, want %d", len(admin.created), len(Topics))
+	}
+	if policy := *admin.topics[SagaEvents].ConfigEntries["cleanup.policy"]; policy != "compact" {
+		t.Errorf("%s created with cleanup.policy %q, want compact", SagaEvents, policy)
+	}
+
+	// a second service finds the topology in place
+	admin.created = nil
+	err = Declare(admin, Topics, discard)
+	if err != nil || len(admin.created) != 0 {
+		t.Errorf("second Declare created %v, err = %v, want nothing", admin.created, err)
+	}
+}
+
+func TestDeclareReportsDrift(t *testing.T) {
+	deletePolicy := "delete"
+	admin := &fakeAdmin{topics: map[string]sarama.TopicDetail{
+		// created automatically with the broker defaults
+		SagaEvents: {NumPartitions: 1, ReplicationFactor: 1, ConfigEntries: map[string]*string{"cleanup.policy": &deletePolicy}},
+	}}
+
+	var sagaEvents Topic
+	for _, topic := range Topics {
+		if topic.Name == SagaEvents {
+			sagaEvents = topic
+		}
+	}
+
+	err := Declare(admin, []Topic{sagaEvents}, discard)
+	if !errors.Is(err, ErrDrift) {
+		t.Fatalf("Declare() = %v, want ErrDrift", err)
+	}
+	for _, want := range []string{"saga-events: partitions 1, want 6", `saga-events: cleanup.policy "delete", want "compact"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
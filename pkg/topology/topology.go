@@ -0,0 +1,107 @@
+// Package topology is the single definition of the Kafka topics the shop uses.
+// Services declare it at startup: missing topics are created, and a topic whose
+// partitions, replication or configuration differ from the definition stops the
+// service instead of running against a topology nobody planned.
+package topology
+
+import (
+	"shop/pkg/broker"
+	"strconv"
+	"time"
+)
+
+const (
+	OrderSagaCommands = "order-saga-commands"
+	OrderCommands     = "order-commands"
+	OrderEvents       = "order-events"
+	ProductCommands   = "product-commands"
+	ProductEvents     = "product-events"
+	InventoryCommands = "inventory-commands"
+	InventoryEvents   = "inventory-events"
+	PaymentCommands   = "payment-commands"
+	PaymentEvents     = "payment-events"
+	SagaEvents        = "saga-events"
+)
+
+const (
+	// messages are keyed by saga id, partitions bound the consumers of a group
+	defaultPartitions = 6
+	// the local docker-compose runs a single broker
+	defaultReplication  = 1
+	defaultRetention    = 7 * 24 * time.Hour
+	deadLetterRetention = 30 * 24 * time.Hour
+)
+
+type Topic struct {
+	Name              string
+	Partitions        int32
+	ReplicationFactor int16
+	// Retention is ignored for compacted topics.
+	Retention time.Duration
+	// Compacted keeps the latest message per key instead of deleting by age.
+	Compacted bool
+}
+
+// Config returns the topic level configuration Kafka stores for t.
+func (t Topic) Config() map[string]string {
+	if t.Compacted {
+		return map[string]string{"cleanup.policy": "compact"}
+	}
+	return map[string]string{
+		"cleanup.policy": "delete",
+		"retention.ms":   strconv.FormatInt(t.Retention.Milliseconds(), 10),
+	}
+}
+
+func stream(name string) Topic {
+	return Topic{
+		Name:              name,
+		Partitions:        defaultPartitions,
+		ReplicationFactor: defaultReplication,
+		Retention:         defaultRetention,
+	}
+}
+
+func deadLetter(t Topic) Topic {
+	return Topic{
+		Name:              broker.DeadLetterTopic(t.Name),
+		Partitions:        1,
+		ReplicationFactor: t.ReplicationFactor,
+		Retention:         deadLetterRetention,
+	}
+}
+
+// Topics is the topology of the shop, dead-letter topics included.
+var Topics = withDeadLetters(
+	stream(OrderSagaCommands),
+	stream(OrderCommands),
+	stream(OrderEvents),
+	stream(ProductCommands),
+	stream(ProductEvents),
+	stream(InventoryCommands),
+	stream(InventoryEvents),
+	stream(PaymentCommands),
+	stream(PaymentEvents),
+	// only the latest status of a saga matters
+	Topic{Name: SagaEvents, Partitions: defaultPartitions, ReplicationFactor: defaultReplication, Compacted: true},
+)
+
+func withDeadLetters(topics ...Topic) []Topic {
+	all := append([]Topic(nil), topics...)
+	for _, t := range topics {
+		all = append(all, deadLetter(t))
+	}
+	return all
+}
+
+// Compacted reports whether Kafka compacts the topic name. Compaction drops
+// all but the latest message of a key, so consumers cannot expect the
+// messages of a compacted topic to arrive without gaps.
+func Compacted(name string) bool {
+	for _, t := range Topics {
+		if t.Name == name {
+			return t.Compacted
+		}
+	}
+	return false
+}
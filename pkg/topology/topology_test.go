@@ -0,0 +1,64 @@
+package topology
+
+import (
+	"maps"
+	"shop/pkg/broker"
+	"testing"
+)
+
+func TestTopicConfig(t *testing.T) {
+	week := map[string]string{"cleanup.policy": "delete", "retention.ms": "604800000"}
+	month := map[string]string{"cleanup.policy": "delete", "retention.ms": "2592000000"}
+	compact := map[string]string{"cleanup.policy": "compact"}
+
+	want := map[string]map[string]string{
+		OrderSagaCommands: week,
+		OrderCommands:     week,
+		OrderEvents:       week,
+		ProductCommands:   week,
+		ProductEvents:     week,
+		InventoryCommands: week,
+		InventoryEvents:   week,
+		PaymentCommands:   week,
+		PaymentEvents:     week,
+		SagaEvents:        compact,
+	}
+
+	if len(Topics) != 2*len(want) {
+		t.Fatalf("got %d topics, want %d with dead-letter topics", len(Topics), 2*len(want))
+	}
+	byName := make(map[string]Topic, len(Topics))
+	for _, topic := range Topics {
+		byName[topic.Name] = topic
+	}
+
+	for name, config := range want {
+		topic, ok := byName[name]
+		if !ok {
+			t.Errorf("topic %s is missing", name)
+			continue
+		}
+		if got := topic.Config(); !maps.Equal(got, config) {
+			t.Errorf("%s config = %v, want %v", name, got, config)
+		}
+		if topic.Partitions != 6 || topic.ReplicationFactor != 1 {
+			t.Errorf("%s has %d partitions and replication %d, want 6 and 1", name, topic.Partitions, topic.ReplicationFactor)
+		}
+		if Compacted(name) != (name == SagaEvents) {
+			t.Errorf("Compacted(%s) = %v", name, Compacted(name))
+		}
+
+		dlq, ok := byName[broker.DeadLetterTopic(name)]
+		if !ok {
+			t.Errorf("dead-letter topic of %s is missing", name)
+			continue
+		}
+		// dead letters wait for an operator, they are kept longer and never compacted
+		if got := dlq.Config(); !maps.Equal(got, month) {
+			t.Errorf("%s config = %v, want %v", dlq.Name, got, month)
+		}
+		if dlq.Partitions != 1 {
+			t.Errorf("%s has %d partitions, want 1", dlq.Name, dlq.Partitions)
+		}
+	}
+}
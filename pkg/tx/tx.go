@@ -0,0 +1,126 @@
+// Package tx runs units of work in database transactions and hands the
+// current transaction to repositories through the context.
+package tx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNoTransaction is returned by From when ctx carries no transaction.
+var ErrNoTransaction = errors.New("transaction not found in context")
+
+// DBTX is what *sql.DB, *sql.Tx and *sql.Conn have in common.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Source gives repositories the connection to use for ctx. Repositories
+// depend on it rather than on *sql.DB or *sql.Tx, so they work inside and
+// outside a transaction.
+type Source interface {
+	Conn(ctx context.Context) DBTX
+}
+
+type txKey struct{}
+
+type current struct {
+	tx *sql.Tx
+	// savepoints counts the WithinTx calls nested in the transaction
+	savepoints int
+}
+
+// With returns a copy of ctx carrying tx, for code that begins transactions
+// itself.
+func With(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, &current{tx: tx})
+}
+
+// From returns the transaction ctx carries, or ErrNoTransaction. Code whose
+// writes must commit with the caller's, like the outbox, uses it instead of
+// Source.
+func From(ctx context.Context) (*sql.Tx, error) {
+	c, ok := ctx.Value(txKey{}).(*current)
+	if !ok {
+		return nil, ErrNoTransaction
+	}
+	return c.tx, nil
+}
+
+// Manager runs units of work on db.
+type Manager struct {
+	db *sql.DB
+}
+
+func NewManager(db *sql.DB) *Manager {
+	return &Manager{db: db}
+}
+
+// Conn returns the transaction ctx carries, or the database outside a
+// transaction.
+func (m *Manager) Conn(ctx context.Context) DBTX {
+	if c, ok := ctx.Value(txKey{}).(*current); ok {
+		return c.tx
+	}
+	return m.db
+}
+
+// WithinTx runs fn in a transaction, which fn and the repositories it calls
+// find in ctx. The transaction commits when fn returns nil and rolls back
+// when it fails or panics. Called inside another WithinTx it runs fn in a
+// savepoint of the outer transaction instead: a failing fn undoes only its
+// own work, and nothing commits before the outermost call.
+func (m *Manager) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if c, ok := ctx.Value(txKey{}).(*current); ok {
+		return withinSavepoint(ctx, c, fn)
+	}
+
+	t, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.Rollback()
+			panic(r)
+		}
+	}()
+
+	err = fn(With(ctx, t))
+	if err != nil {
+		t.Rollback()
+		return err
+	}
+
+	return t.Commit()
+}
+
+func withinSavepoint(ctx context.Context, c *current, fn func(ctx context.Context) error) error {
+	name := fmt.Sprintf("sp_%d", c.savepoints+1)
+	_, err := c.tx.ExecContext(ctx, "SAVEPOINT "+name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.tx.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+name)
+			panic(r)
+		}
+	}()
+
+	err = fn(context.WithValue(ctx, txKey{}, &current{tx: c.tx, savepoints: c.savepoints + 1}))
+	if err != nil {
+		_, rollbackErr := c.tx.ExecContext(context.WithoutCancel(ctx), "ROLLBACK TO SAVEPOINT "+name)
+		if rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		return err
+	}
+
+	_, err = c.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
@@ -0,0 +1,160 @@
+package tx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newMockManager(t *testing.T) (*Manager, *sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewManager(db), db, mock
+}
+
+func TestWithinTx(t *testing.T) {
+	failure := errors.New("cannot do it")
+	tests := []struct {
+		name    string
+		fn      func(ctx context.Context) error
+		expect  func(mock sqlmock.Sqlmock)
+		wantErr error
+	}{
+		{
+			name: "commits when fn succeeds",
+			fn:   func(context.Context) error { return nil },
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "rolls back when fn fails",
+			fn:   func(context.Context) error { return failure },
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			wantErr: failure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _, mock := newMockManager(t)
+			tt.expect(mock)
+
+			err := m.WithinTx(context.Background(), tt.fn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WithinTx = %v, want %v", err, tt.wantErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWithinTxRollsBackOnPanic(t *testing.T) {
+	m, _, mock := newMockManager(t)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("recovered %v, want the panic to go on", r)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	m.WithinTx(context.Background(), func(context.Context) error {
+		panic("boom")
+	})
+}
+
+func TestNestedWithinTxUsesSavepoints(t *testing.T) {
+	failure := errors.New("cannot do it")
+	m, _, mock := newMockManager(t)
+
+	mock.ExpectBegin()
+	// the first nested call succeeds and keeps its work
+	mock.ExpectExec("SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO orders (id) VALUES ($1)").WithArgs("order-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("RELEASE SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	// the second fails inside a deeper call and undoes only its own work
+	mock.ExpectExec("SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SAVEPOINT sp_2").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO orders (id) VALUES ($1)").WithArgs("order-2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT sp_2").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ROLLBACK TO SAVEPOINT sp_1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	insert := func(id string, err error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			_, execErr := m.Conn(ctx).ExecContext(ctx, "INSERT INTO orders (id) VALUES ($1)", id)
+			if execErr != nil {
+				return execErr
+			}
+			return err
+		}
+	}
+
+	err := m.WithinTx(context.Background(), func(ctx context.Context) error {
+		err := m.WithinTx(ctx, insert("order-1", nil))
+		if err != nil {
+			return err
+		}
+		err = m.WithinTx(ctx, func(ctx context.Context) error {
+			return m.WithinTx(ctx, insert("order-2", failure))
+		})
+		if !errors.Is(err, failure) {
+			t.Errorf("nested WithinTx = %v, want %v", err, failure)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WithinTx: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnAndFrom(t *testing.T) {
+	m, db, mock := newMockManager(t)
+
+	ctx := context.Background()
+	if conn := m.Conn(ctx); conn != db {
+		t.Errorf("Conn outside a transaction = %v, want the database", conn)
+	}
+	if _, err := From(ctx); !errors.Is(err, ErrNoTransaction) {
+		t.Errorf("From outside a transaction = %v, want %v", err, ErrNoTransaction)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	err := m.WithinTx(ctx, func(ctx context.Context) error {
+		sqlTx, err := From(ctx)
+		if err != nil {
+			return err
+		}
+		if conn := m.Conn(ctx); conn != sqlTx {
+			return errors.New("Conn inside a transaction is not the transaction")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -2,7 +2,6 @@ package handler
 
 import (
 	"context"
-	"database/sql"
 	"log"
 	"shop/pkg/proto"
 	"shop/product/internal/repository"
@@ -10,26 +9,16 @@ import (
 
 type GrpcHandler struct {
 	proto.UnimplementedProductServiceServer
-	db           *sql.DB
 	categoryRepo repository.CategoryRepository
 	productRepo  repository.ProductRepository
 	logger       *log.Logger
 }
 
-func NewGrpcHandler(db *sql.DB, categoryRepo repository.CategoryRepository, productRepo repository.ProductRepository, logger *log.Logger) *GrpcHandler {
-	return &GrpcHandler{db: db, categoryRepo: categoryRepo, productRepo: productRepo, logger: logger}
+func NewGrpcHandler(categoryRepo repository.CategoryRepository, productRepo repository.ProductRepository, logger *log.Logger) *GrpcHandler {
+	return &GrpcHandler{categoryRepo: categoryRepo, productRepo: productRepo, logger: logger}
 }
 
 func (h *GrpcHandler) GetCategories(ctx context.Context, in *proto.GetCategoriesRequest) (*proto.GetCategoriesResponse, error) {
-	//tx, err := h.db.Begin()
-	//if err != nil {
-	//	h.logger.Println("Failed to begin transaction", "error", err)
-	//	return nil, err
-	//}
-	//defer tx.Rollback()
-	//
-	//ctxWithTx := context.WithValue(ctx, "tx", tx)
-
 	categories, err := h.categoryRepo.Get(ctx, int(in.GetPage()), int(in.GetLimit()))
 	if err != nil {
 		h.logger.Printf("Failed to get categories: %+v", err)
@@ -45,26 +34,11 @@ func (h *GrpcHandler) GetCategories(ctx context.Context, in *proto.GetCategories
 		})
 	}
 
-	//err = tx.Commit()
-	//if err != nil {
-	//	h.logger.Println("Failed to commit transaction", "error", err)
-	//	return nil, err
-	//}
-
 	return &proto.GetCategoriesResponse{Categories: protoCategories}, nil
 }
 
 func (h *GrpcHandler) GetProductsByCategoryId(ctx context.Context, in *proto.GetProductsRequest) (*proto.GetProductsResponse, error) {
-	tx, err := h.db.Begin()
-	if err != nil {
-		h.logger.Println("Failed to begin transaction", "error", err)
-		return nil, err
-	}
-	defer tx.Rollback()
-
-	ctxWithTx := context.WithValue(ctx, "tx", tx)
-
-	products, err := h.productRepo.GetByCategoryId(ctxWithTx, in.CategoryId, int(in.GetPage()), int(in.GetLimit()))
+	products, err := h.productRepo.GetByCategoryId(ctx, in.CategoryId, int(in.GetPage()), int(in.GetLimit()))
 	if err != nil {
 		h.logger.Printf("Failed to get products: %+v", err)
 		return nil, err
@@ -81,11 +55,5 @@ func (h *GrpcHandler) GetProductsByCategoryId(ctx context.Context, in *proto.Get
 		})
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		h.logger.Println("Failed to commit transaction", "error", err)
-		return nil, err
-	}
-
 	return &proto.GetProductsResponse{Products: protoProducts}, nil
 }
@@ -2,8 +2,7 @@ package repository
 
 import (
 	"context"
-	"database/sql"
-	"errors"
+	"shop/pkg/tx"
 	"shop/product/internal/model"
 )
 
@@ -14,22 +13,19 @@ type CategoryRepository interface {
 }
 
 type PostgresCategoryRepository struct {
-	db *sql.DB
+	db tx.Source
 }
 
-func NewPostgresCategoryRepository(db *sql.DB) *PostgresCategoryRepository {
+func NewPostgresCategoryRepository(db tx.Source) *PostgresCategoryRepository {
 	return &PostgresCategoryRepository{
 		db: db,
 	}
 }
 
 func (r *PostgresCategoryRepository) Create(ctx context.Context, category model.Category) (model.Category, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Category{}, errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
-	_, err := tx.ExecContext(ctx, "INSERT INTO categories (id, name) VALUES ($1, $2)", category.ID, category.Name)
+	_, err := conn.ExecContext(ctx, "INSERT INTO categories (id, name) VALUES ($1, $2)", category.ID, category.Name)
 	if err != nil {
 		return model.Category{}, err
 	}
@@ -38,13 +34,10 @@ func (r *PostgresCategoryRepository) Create(ctx context.Context, category model.
 }
 
 func (r *PostgresCategoryRepository) FindByID(ctx context.Context, id string) (model.Category, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Category{}, errors.New("transaction not found in context")
-	}
+	conn := r.db.Conn(ctx)
 
 	var category model.Category
-	err := tx.QueryRowContext(ctx, "SELECT id, name  FROM categories WHERE id = $1", id).Scan(
+	err := conn.QueryRowContext(ctx, "SELECT id, name  FROM categories WHERE id = $1", id).Scan(
 		&category.ID, &category.Name,
 	)
 	if err != nil {
@@ -55,15 +48,10 @@ func (r *PostgresCategoryRepository) FindByID(ctx context.Context, id string) (m
 }
 
 func (r *PostgresCategoryRepository) Get(ctx context.Context, page int, limit int) ([]model.Category, error) {
-	//tx, ok := ctx.Value("tx").(*sql.Tx)
-	//if !ok {
-	//	return []model.Category{}, errors.New("transaction not found in context")
-	//}
-	//
 	var categories []model.Category
 	offset := (page - 1) * limit
 	query := `SELECT id, name, created_at  FROM categories ORDER BY created_at DESC OFFSET $1 LIMIT $2`
-	rows, err := r.db.QueryContext(ctx, query, offset, limit)
+	rows, err := r.db.Conn(ctx).QueryContext(ctx, query, offset, limit)
 	if err != nil {
 		return nil, err
 	}
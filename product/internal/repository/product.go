@@ -2,8 +2,7 @@ package repository
 
 import (
 	"context"
-	"database/sql"
-	"errors"
+	"shop/pkg/tx"
 	"shop/product/internal/model"
 )
 
@@ -13,19 +12,18 @@ type ProductRepository interface {
 	GetByCategoryId(ctx context.Context, categoryId string, page int, limit int) ([]model.Product, error)
 }
 
-type PostgresProductRepository struct{}
+type PostgresProductRepository struct {
+	db tx.Source
+}
 
-func NewPostgresProductRepository() *PostgresProductRepository {
-	return &PostgresProductRepository{}
+func NewPostgresProductRepository(db tx.Source) *PostgresProductRepository {
+	return &PostgresProductRepository{db: db}
 }
 
 func (p *PostgresProductRepository) Create(ctx context.Context, product model.Product) (model.Product, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Product{}, errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
-	_, err := tx.ExecContext(ctx, "INSERT INTO products (id, name, price, category_id) VALUES ($1, $2, $3, $4)", product.ID, product.Name, product.Price, product.CategoryID)
+	_, err := conn.ExecContext(ctx, "INSERT INTO products (id, name, price, category_id) VALUES ($1, $2, $3, $4)", product.ID, product.Name, product.Price, product.CategoryID)
 	if err != nil {
 		return model.Product{}, err
 	}
@@ -34,13 +32,10 @@ func (p *PostgresProductRepository) Create(ctx context.Context, product model.Pr
 }
 
 func (p *PostgresProductRepository) FindById(ctx context.Context, id string) (model.Product, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return model.Product{}, errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	var product model.Product
-	err := tx.QueryRowContext(ctx, "SELECT id, name, price, category_id FROM products WHERE id=$1", id).Scan(&product.ID, &product.Name, &product.Price, &product.CategoryID)
+	err := conn.QueryRowContext(ctx, "SELECT id, name, price, category_id FROM products WHERE id=$1", id).Scan(&product.ID, &product.Name, &product.Price, &product.CategoryID)
 	if err != nil {
 		return model.Product{}, err
 	}
@@ -49,15 +44,12 @@ func (p *PostgresProductRepository) FindById(ctx context.Context, id string) (mo
 }
 
 func (p *PostgresProductRepository) GetByCategoryId(ctx context.Context, categoryId string, page int, limit int) ([]model.Product, error) {
-	tx, ok := ctx.Value("tx").(*sql.Tx)
-	if !ok {
-		return nil, errors.New("transaction not found in context")
-	}
+	conn := p.db.Conn(ctx)
 
 	var products []model.Product
 	offset := (page - 1) * limit
 	query := `SELECT id, name, price, category_id, created_at  FROM products WHERE category_id = $1 ORDER BY created_at DESC OFFSET $2 LIMIT $3`
-	rows, err := tx.QueryContext(ctx, query, categoryId, offset, limit)
+	rows, err := conn.QueryContext(ctx, query, categoryId, offset, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,4 @@
+ALTER TABLE outbox
+    ADD COLUMN attempts        INTEGER   NOT NULL DEFAULT 0,
+    ADD COLUMN last_error      TEXT      NULL,
+    ADD COLUMN next_attempt_at TIMESTAMP NULL;
@@ -0,0 +1,13 @@
+ALTER TABLE inbox
+    ADD COLUMN headers         JSONB     NOT NULL DEFAULT '{}',
+    ADD COLUMN attempts        INTEGER   NOT NULL DEFAULT 0,
+    ADD COLUMN last_error      TEXT      NULL,
+    ADD COLUMN next_attempt_at TIMESTAMP NULL;
+
+ALTER TABLE inbox_archive
+    ADD COLUMN headers         JSONB     NOT NULL DEFAULT '{}',
+    ADD COLUMN attempts        INTEGER   NOT NULL DEFAULT 0,
+    ADD COLUMN last_error      TEXT      NULL,
+    ADD COLUMN next_attempt_at TIMESTAMP NULL;
+
+CREATE INDEX inbox_error_next_attempt_at_index ON inbox (next_attempt_at) WHERE status = 'error';
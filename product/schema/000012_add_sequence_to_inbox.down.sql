@@ -0,0 +1,11 @@
+DROP INDEX IF EXISTS inbox_error_aggregate_sequence_index;
+
+DROP TABLE IF EXISTS inbox_sequences;
+
+ALTER TABLE inbox_archive
+    DROP COLUMN aggregate_id,
+    DROP COLUMN sequence;
+
+ALTER TABLE inbox
+    DROP COLUMN aggregate_id,
+    DROP COLUMN sequence;